@@ -0,0 +1,143 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// defaultBackupTag is the default template of the tag given to the image that
+// is replaced by the patch and update commands when `--replace` is given.
+const defaultBackupTag = "{{.Tag}}-pre{{.Operation}}-{{.Date}}"
+
+// tagRegexp matches the whole string against the tag grammar of Docker.
+var tagRegexp = regexp.MustCompile("^" + reference.TagRegexp.String() + "$")
+
+// backupTagData is the data available to the template of backup tags.
+type backupTagData struct {
+	Repository string // Repository of the replaced image (e.g. "opensuse").
+	Tag        string // Tag of the replaced image (e.g. "42.3").
+	Operation  string // Either "patch" or "update".
+	Date       string // Current date in the YYYYMMDD format.
+	Time       string // Current time (UTC) in the HHMMSS format.
+	ID         string // Short ID of the replaced image.
+}
+
+// imageBackup is an image whose reference is about to be taken over by a
+// patched or updated image. The image is kept under a backup reference.
+type imageBackup struct {
+	ID        string
+	Reference string
+	Backup    string
+
+	// Whether the backup reference has been created.
+	created bool
+}
+
+// newImageBackup returns the backup of the image referenced by the given repo
+// and tag, which is to be named after the given template. It returns nil if
+// no image is referenced by them, since there's nothing to be backed up then.
+// Note that nothing is done until the `create` method is called.
+func newImageBackup(repo, tag, tmpl, operation string) (*imageBackup, error) {
+	exists, err := checkImageExists(repo, tag)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot proceed safely: %v", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	ref := repo + ":" + tag
+	id, err := getImageID(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	backupTag, err := backupTagName(tmpl, backupTagData{
+		Repository: repo,
+		Tag:        tag,
+		Operation:  operation,
+		Date:       now.Format("20060102"),
+		Time:       now.Format("150405"),
+		ID:         shortImageID(id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if exists, err = checkImageExists(repo, backupTag); err != nil {
+		return nil, fmt.Errorf("Cannot proceed safely: %v", err)
+	} else if exists {
+		return nil, fmt.Errorf("The backup image %s:%s already exists. Please use a different --backup-tag", repo, backupTag)
+	}
+
+	return &imageBackup{ID: id, Reference: ref, Backup: repo + ":" + backupTag}, nil
+}
+
+// backupTagName executes the given template of backup tags and checks that
+// the result is a valid tag.
+func backupTagName(tmpl string, data backupTagData) (string, error) {
+	t, err := template.New("backup-tag").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("Invalid backup tag template: %v", err)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := t.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("Invalid backup tag template: %v", err)
+	}
+	if tag := buf.String(); tagRegexp.MatchString(tag) {
+		return tag, nil
+	}
+	return "", fmt.Errorf("Invalid backup tag '%s'", buf.String())
+}
+
+// shortImageID returns the ID of an image as printed by the docker CLI.
+func shortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// create tags the image with its backup reference.
+func (b *imageBackup) create() error {
+	if err := getDockerClient().ImageTag(context.Background(), b.ID, b.Backup); err != nil {
+		return err
+	}
+	b.created = true
+	return nil
+}
+
+// restore points the original reference to the backed up image again, and
+// removes the backup reference.
+func (b *imageBackup) restore() error {
+	client := getDockerClient()
+	if err := client.ImageTag(context.Background(), b.ID, b.Reference); err != nil {
+		return err
+	}
+	_, err := client.ImageRemove(context.Background(), b.Backup, types.ImageRemoveOptions{})
+	return err
+}
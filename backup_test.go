@@ -0,0 +1,131 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupTagName(t *testing.T) {
+	data := backupTagData{Repository: "opensuse", Tag: "42.3", Operation: "patch", Date: "20181017", Time: "120000", ID: "0c5b1e4b3a8f"}
+
+	tag, err := backupTagName(defaultBackupTag, data)
+	if err != nil || tag != "42.3-prepatch-20181017" {
+		t.Fatalf("Unexpected result '%s': %v", tag, err)
+	}
+	tag, err = backupTagName("{{.Operation}}-{{.Date}}{{.Time}}-{{.ID}}", data)
+	if err != nil || tag != "patch-20181017120000-0c5b1e4b3a8f" {
+		t.Fatalf("Unexpected result '%s': %v", tag, err)
+	}
+
+	// The fields are named as in the other templates.
+	tag, err = backupTagName("{{.Repository}}-{{.Tag}}", data)
+	if err != nil || tag != "opensuse-42.3" {
+		t.Fatalf("Unexpected result '%s': %v", tag, err)
+	}
+
+	for _, tmpl := range []string{"{{.Tag", "{{.Unknown}}", "", "{{.Repository}}/{{.Tag}}", "-{{.Tag}}"} {
+		if _, err := backupTagName(tmpl, data); err == nil {
+			t.Fatalf("Expected an error for '%s'", tmpl)
+		}
+	}
+}
+
+func TestShortImageID(t *testing.T) {
+	if id := shortImageID("sha256:0c5b1e4b3a8f0c5b1e4b3a8f"); id != "0c5b1e4b3a8f" {
+		t.Fatalf("Unexpected ID: %s", id)
+	}
+	if id := shortImageID("1"); id != "1" {
+		t.Fatalf("Unexpected ID: %s", id)
+	}
+}
+
+func TestPatchReplace(t *testing.T) {
+	backup := "opensuse:13.2-prepatch-" + time.Now().UTC().Format("20060102")
+
+	mock := &mockClient{}
+	stdout, logged := runCommand(mock, "patch", "--replace", "--backup-tag", defaultBackupTag, "opensuse:13.2", "opensuse:13.2")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+	if mock.tagged[backup] != "1" || len(mock.tagged) != 1 {
+		t.Fatalf("Unexpected tags: %v", mock.tagged)
+	}
+	if mock.lastCommit.Reference != "opensuse:13.2" {
+		t.Fatalf("Unexpected reference: %s", mock.lastCommit.Reference)
+	}
+	if !strings.Contains(stdout, "The previous opensuse:13.2 has been kept as "+backup) {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+	if strings.Contains(strings.Join(mock.lastCmd, ""), "replace") {
+		t.Fatalf("Unexpected command: %v", mock.lastCmd)
+	}
+
+	// Nothing to be backed up.
+	mock = &mockClient{}
+	_, logged = runCommand(mock, "patch", "--replace", "--backup-tag", defaultBackupTag, "opensuse:13.2", "opensuse:new")
+	if lastCode != 0 || len(mock.tagged) != 0 || mock.lastCommit.Reference != "opensuse:new" {
+		t.Fatalf("Unexpected result %v (%v): %s", lastCode, mock.tagged, logged)
+	}
+}
+
+func TestPatchReplaceFailures(t *testing.T) {
+	backup := "opensuse:13.2-prepatch-" + time.Now().UTC().Format("20060102")
+
+	// The original reference is restored if the commit fails.
+	mock := &mockClient{commitFail: true}
+	_, logged := runCommand(mock, "patch", "--replace", "--backup-tag", defaultBackupTag, "opensuse:13.2", "opensuse:13.2")
+	if lastCode != 1 || !strings.Contains(logged, "Could not commit to the new image") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+	if mock.tagged["opensuse:13.2"] != "1" || len(mock.removedImages) != 1 || mock.removedImages[0] != backup {
+		t.Fatalf("The original image was not restored: %v, %v", mock.tagged, mock.removedImages)
+	}
+
+	// Nothing is backed up if the container fails.
+	mock = &mockClient{startFail: true}
+	_, logged = runCommand(mock, "patch", "--replace", "--backup-tag", defaultBackupTag, "opensuse:13.2", "opensuse:13.2")
+	if lastCode != 1 || len(mock.tagged) != 0 || len(mock.removedImages) != 0 {
+		t.Fatalf("Unexpected result %v (%v, %v): %s", lastCode, mock.tagged, mock.removedImages, logged)
+	}
+
+	mock = &mockClient{tagFail: true}
+	_, logged = runCommand(mock, "patch", "--replace", "--backup-tag", defaultBackupTag, "opensuse:13.2", "opensuse:13.2")
+	if lastCode != 1 || !strings.Contains(logged, "Could not back up opensuse:13.2 as "+backup+": tag fail") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+	if mock.lastCommit.Reference != "" {
+		t.Fatalf("Nothing should have been committed: %+v", mock.lastCommit)
+	}
+
+	// The backup reference already exists.
+	_, logged = runCommand(&mockClient{}, "patch", "--replace", "--backup-tag", "latest", "opensuse:13.2", "opensuse:tag")
+	if lastCode != 1 || !strings.Contains(logged, "The backup image opensuse:latest already exists") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{}, "patch", "--replace", "--backup-tag", "{{.Nope}}", "opensuse:13.2", "opensuse:13.2")
+	if lastCode != 1 || !strings.Contains(logged, "Invalid backup tag template") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	// Without --replace existing images are not overwritten.
+	_, logged = runCommand(&mockClient{}, "patch", "opensuse:13.2", "opensuse:13.2")
+	if lastCode != 1 || !strings.Contains(logged, "Cannot overwrite an existing image") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/api/types"
+)
+
+// The statuses of the images processed by the patch-all and update-all
+// commands, besides the name of the operation for the successful ones.
+const (
+	batchSkipped = "skipped"
+	batchFailed  = "failed"
+)
+
+// batchJob is an image to be patched or updated by the patch-all and the
+// update-all commands, along with the outcome of the operation.
+type batchJob struct {
+	ID      string   // Full ID of the image.
+	Image   string   // Name of the image (repository and tag).
+	Digests []string // Repo digests of the image.
+	Target  string   // Name of the image to be created.
+
+	Status  string
+	Details string
+	Log     string
+	NewID   string
+}
+
+// targetNameData is the data available to the template of the names of the
+// images created by the patch-all and update-all commands.
+type targetNameData struct {
+	Repository string // Repository of the image (e.g. "opensuse").
+	Tag        string // Tag of the image (e.g. "42.3").
+	ID         string // Short ID of the image.
+	Operation  string // Either "patch" or "update".
+	Date       string // Current date in the YYYYMMDD format.
+}
+
+// batchOperation is the operation applied to each image by the patch-all and
+// update-all commands.
+type batchOperation struct {
+	zypperCmd string // Either "patch" or "up".
+	operation string // Either "patch" or "update".
+	done      string // Status of the successful jobs.
+	progress  string // Label of the progress report.
+	cmd       string
+	filters   string
+	comment   string
+	author    string
+	logDir    string
+}
+
+// selectBatchImages returns the jobs for the SUSE images matching the filters
+// given through the `--filter` flag, sorted by name. Images with multiple tags
+// are only processed once, under the first tag in alphabetical order. Images
+// produced by zypper-docker and outdated images, which have already been
+// patched or updated, are skipped unless the "outdated" filter is given, so
+// running the command again does not process its own results. It also
+// returns whether the operation has been interrupted.
+func selectBatchImages(ctx *cli.Context) ([]*batchJob, bool, error) {
+	args, local, err := parseImageFilters(ctx.StringSlice("filter"))
+	if err != nil {
+		return nil, false, err
+	}
+	images, err := getDockerClient().ImageList(context.Background(), types.ImageListOptions{Filters: args})
+	if err != nil {
+		return nil, false, fmt.Errorf("Cannot proceed safely: %v", err)
+	}
+
+	cache := getCacheFile()
+	candidates := []types.ImageSummary{}
+	_, outdatedFilter := local["outdated"]
+	for _, img := range images {
+		if !outdatedFilter && (parseProvenance(img.Labels) != nil || cache.isImageOutdated(img.ID)) {
+			continue
+		}
+		if matchesLocalFilters(img, local, cache) {
+			candidates = append(candidates, img)
+		}
+	}
+	suse, interrupted := inspectImages(candidates, ctx.Int("parallel"), cache)
+	cache.flush()
+	if interrupted {
+		return nil, true, nil
+	}
+
+	jobs := []*batchJob{}
+	for i, img := range candidates {
+		if !suse[i] || !matchesOSFilter(img, local, cache) {
+			continue
+		}
+		names := []string{}
+		for _, info := range newImageInfos(img, cache) {
+			names = append(names, info.Repository+":"+info.Tag)
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			jobs = append(jobs, &batchJob{ID: img.ID, Image: names[0], Digests: img.RepoDigests})
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Image < jobs[j].Image })
+	return jobs, false, nil
+}
+
+// targetName executes the given template of target names for the given
+// image, and it returns the resulting name in the "repository:tag" form.
+func targetName(tmpl *template.Template, job *batchJob, operation, date string) (string, error) {
+	repo, tag, _ := parseImageName(job.Image)
+	buf := bytes.NewBuffer([]byte{})
+	err := tmpl.Execute(buf, targetNameData{
+		Repository: repo,
+		Tag:        tag,
+		ID:         shortImageID(job.ID),
+		Operation:  operation,
+		Date:       date,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not execute the target template: %v", err)
+	}
+
+	repo, tag, err = parseImageName(buf.String())
+	if err != nil {
+		return "", err
+	}
+	return repo + ":" + tag, nil
+}
+
+// pending returns the number of patches or package updates to be applied to
+// the given image, as listed with the same filters as the operation itself.
+func (op *batchOperation) pending(img string) (int, error) {
+	if op.zypperCmd == "up" {
+		updates, err := fetchUpdates(img, "lu"+op.filters)
+		if updates == nil {
+			return 0, err
+		}
+		return len(updates), nil
+	}
+
+	patches, err := fetchPatches(img, "lp"+op.filters)
+	if patches == nil {
+		return 0, err
+	}
+	needed := 0
+	for _, p := range patches {
+		if p.Status == "needed" {
+			needed++
+		}
+	}
+	return needed, nil
+}
+
+// apply patches or updates the image of the given job, unless there's
+// nothing to be applied or the target image already exists. The output of
+// zypper is written into the log file of the job.
+func (op *batchOperation) apply(job *batchJob) {
+	fail := func(format string, args ...interface{}) {
+		job.Status, job.Details = batchFailed, fmt.Sprintf(format, args...)
+		log.Printf("Could not %s %s: %s", op.operation, job.Image, job.Details)
+	}
+
+	repo, tag, _ := parseImageName(job.Target)
+	if exists, err := checkImageExists(repo, tag); err != nil {
+		fail("%v", err)
+		return
+	} else if exists {
+		job.Status, job.Details = batchSkipped, fmt.Sprintf("%s already exists", job.Target)
+		return
+	}
+
+	pending, err := op.pending(job.Image)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	if pending == 0 {
+		job.Status, job.Details = batchSkipped, "nothing to apply"
+		return
+	}
+
+	// Different names might be sanitized into the same one (e.g. "a/b:c" and
+	// "a_b:c"), so the ID of the image, which is unique among jobs, is added.
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(job.Image)
+	job.Log = filepath.Join(op.logDir, name+"-"+shortImageID(job.ID)+".log")
+	f, err := os.Create(job.Log)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	defer f.Close()
+
+	// As with the patch command, the patches are recorded as they are listed
+	// by the container that applies them.
+	prov := newProvenance(job.ID, job.Image, job.Digests, op.operation, op.filters)
+	output := newPatchesWriter(f)
+	labels := func() (map[string]string, error) {
+		if patches := output.patches(); patches != nil {
+			prov.setPatches(patches)
+		}
+		return prov.labels(), nil
+	}
+	job.NewID, err = runCommandAndCommitToImageOutput(job.Image, repo, tag, op.cmd, op.comment, op.author, labels, output)
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+
+	unit := "patches"
+	if op.zypperCmd == "up" {
+		unit = "packages"
+	}
+	job.Status, job.Details = op.done, fmt.Sprintf("%d %s", pending, unit)
+}
+
+// printBatchJobs prints a table with the outcome of the given jobs, followed
+// by a summary line.
+func printBatchJobs(jobs []*batchJob, done string) {
+	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(writer, "IMAGE\tTARGET\tSTATUS\tDETAILS\tLOG")
+
+	counts := map[string]int{}
+	for _, job := range jobs {
+		counts[job.Status]++
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", job.Image, valueOrDash(job.Target),
+			job.Status, job.Details, valueOrDash(job.Log))
+	}
+	writer.Flush()
+
+	fmt.Printf("\n%d %s, %d %s, %d %s.\n", counts[done], done,
+		counts[batchSkipped], batchSkipped, counts[batchFailed], batchFailed)
+}
+
+// batchCmd patches or updates (as given by zypperCmd) all the SUSE images
+// matching the given filters.
+func batchCmd(zypperCmd string, ctx *cli.Context) {
+	if len(ctx.Args()) != 0 {
+		logAndFatalf("Wrong invocation: expected no arguments, %d given.\n", len(ctx.Args()))
+		return
+	}
+	if ctx.Int("parallel") < 1 {
+		logAndFatalf("Error: the value of --parallel has to be greater than 0.\n")
+		return
+	}
+	tmpl, err := template.New("target").Parse(ctx.String("target"))
+	if err != nil {
+		logAndFatalf("Error: invalid target template: %v.\n", err)
+		return
+	}
+
+	op := &batchOperation{
+		zypperCmd: zypperCmd,
+		operation: "patch",
+		done:      "patched",
+		progress:  "Patching images",
+		comment:   ctx.String("message"),
+		author:    ctx.String("author"),
+		logDir:    ctx.String("log-dir"),
+	}
+	if zypperCmd == "up" {
+		op.operation, op.done, op.progress = "update", "updated", "Updating images"
+	}
+	op.cmd, op.filters = operationCommand(zypperCmd, ctx,
+		[]string{"author", "message", "filter", "target", "parallel", "log-dir"}, zypperCmd == "patch")
+
+	if op.logDir == "" {
+		op.logDir, err = ioutil.TempDir("", "zypper-docker-"+op.operation+"-")
+	} else {
+		err = os.MkdirAll(op.logDir, 0755)
+	}
+	if err != nil {
+		logAndFatalf("Error: could not create the log directory: %v.\n", err)
+		return
+	}
+
+	jobs, interrupted, err := selectBatchImages(ctx)
+	if err != nil {
+		logAndFatalf("Error: %v.\n", err)
+		return
+	} else if interrupted {
+		return
+	}
+
+	// Targets are computed upfront, so clashes are detected before
+	// anything is committed.
+	date := time.Now().UTC().Format("20060102")
+	targets := map[string]string{}
+	pending := []*batchJob{}
+	for _, job := range jobs {
+		if job.Target, err = targetName(tmpl, job, op.operation, date); err != nil {
+			job.Status, job.Details = batchFailed, err.Error()
+		} else if other, ok := targets[job.Target]; ok {
+			job.Status, job.Details = batchFailed, fmt.Sprintf("same target as %s", other)
+		} else if job.Target == job.Image {
+			job.Status, job.Details = batchFailed, "the target is the image itself"
+		} else {
+			targets[job.Target] = job.Image
+			pending = append(pending, job)
+		}
+	}
+
+	report := newProgress(op.progress, len(pending))
+	interrupted = forEachParallel(len(pending), ctx.Int("parallel"), func(i int) {
+		op.apply(pending[i])
+		report.increment()
+	})
+	report.finish()
+	if interrupted {
+		return
+	}
+
+	// The cache is updated afterwards, since it's flushed on each update.
+	cache := getCacheFile()
+	for _, job := range pending {
+		if job.Status != op.done {
+			continue
+		}
+		if err := cache.updateCacheAfterUpdate(job.ID, job.NewID); err != nil {
+			log.Printf("Cannot add the details of %s to the cache: %v", job.Target, err)
+		}
+	}
+
+	printBatchJobs(jobs, op.done)
+	logAndPrintf("The logs have been written into %s\n", op.logDir)
+	for _, job := range jobs {
+		if job.Status == batchFailed {
+			exitWithCode(1)
+			return
+		}
+	}
+	exitWithCode(0)
+}
+
+// zypper-docker patch-all [flags]
+func patchAllCmd(ctx *cli.Context) {
+	batchCmd("patch", ctx)
+}
+
+// zypper-docker update-all [flags]
+func updateAllCmd(ctx *cli.Context) {
+	batchCmd("up", ctx)
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/docker/docker/api/types"
+)
+
+const testNoPatchesXML = `<?xml version='1.0'?>
+<stream>
+<update-status version="0.6">
+<update-list>
+</update-list>
+</update-status>
+</stream>
+`
+
+// batchLine returns the line of the table printed by the batch commands for
+// the given image, with its columns separated by a single space.
+func batchLine(stdout, image string) string {
+	for _, line := range strings.Split(stdout, "\n") {
+		if strings.HasPrefix(line, image+" ") {
+			return strings.Join(strings.Fields(line), " ")
+		}
+	}
+	return ""
+}
+
+func TestTargetName(t *testing.T) {
+	tmpl := template.Must(template.New("target").Parse("registry.example.com/{{.Repository}}:{{.Tag}}-{{.Operation}}-{{.Date}}"))
+	job := &batchJob{ID: "sha256:0c5b1e4b3a8f0c5b1e4b3a8f", Image: "opensuse:42.3"}
+
+	name, err := targetName(tmpl, job, "patch", "20181017")
+	if err != nil || name != "registry.example.com/opensuse:42.3-patch-20181017" {
+		t.Fatalf("Unexpected name '%s': %v", name, err)
+	}
+
+	tmpl = template.Must(template.New("target").Parse("{{.Repository}}-{{.ID}}"))
+	if name, err = targetName(tmpl, job, "patch", "20181017"); err != nil || name != "opensuse-0c5b1e4b3a8f:latest" {
+		t.Fatalf("Unexpected name '%s': %v", name, err)
+	}
+
+	for _, format := range []string{"{{.Unknown}}", "{{.Repository}}:{{.Tag}}:x", ""} {
+		tmpl = template.Must(template.New("target").Parse(format))
+		if _, err = targetName(tmpl, job, "patch", "20181017"); err == nil {
+			t.Fatalf("Expected an error for '%s'", format)
+		}
+	}
+}
+
+func TestPatchAll(t *testing.T) {
+	// Other tests might have marked some of the images as outdated.
+	restoreOutdatedImages()
+	defer restoreOutdatedImages()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-batch")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The patches are listed by the same container that applies them, as
+	// done by the patch command.
+	output := "Refreshing service\r\n" + patchesBeginMarker + "\r\n" + testPatchesXML +
+		"\r\n" + patchesEndMarker + "\r\nInstalling patches\r\n"
+	client := &mockClient{logOutputs: map[string]string{
+		"zypper-docker-private-busybox:latest":  testNoPatchesXML,
+		"zypper-docker-private-opensuse:13.2":   output,
+		"zypper-docker-private-opensuse:latest": output,
+	}}
+	stdout, logged := runCommand(client, "patch-all", "--log-dir", dir, "--parallel", "1", "--cve", "CVE-2018-1000300")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+
+	if line := batchLine(stdout, "busybox:latest"); line != "busybox:latest busybox:latest-patched skipped nothing to apply -" {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	logFile := filepath.Join(dir, "opensuse_13.2-2.log")
+	if line := batchLine(stdout, "opensuse:13.2"); line != "opensuse:13.2 opensuse:13.2-patched patched 2 patches "+logFile {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	if line := batchLine(stdout, "opensuse:latest"); !strings.HasPrefix(line, "opensuse:latest opensuse:latest-patched patched") {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	// Images with multiple tags are only patched once.
+	if line := batchLine(stdout, "opensuse:tag"); line != "" {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	if !strings.Contains(stdout, "2 patched, 1 skipped, 0 failed.") || !strings.Contains(stdout, "The logs have been written into "+dir) {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+
+	// The listing is not written into the log.
+	contents, err := ioutil.ReadFile(logFile)
+	if err != nil || string(contents) != "Refreshing service\r\nInstalling patches\r\n" {
+		t.Fatalf("Unexpected log (%v): %q", err, contents)
+	}
+	if cmd := strings.Join(client.lastCmd, ""); !strings.Contains(cmd, "lp --cve=CVE-2018-1000300") ||
+		!strings.Contains(cmd, "-n patch --cve=CVE-2018-1000300") ||
+		strings.Contains(cmd, "log-dir") || strings.Contains(cmd, "parallel") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+
+	prov := parseProvenance(client.lastCommit.Config.Labels)
+	if prov == nil || prov.Operation != "patch" || prov.Filters != "--cve=CVE-2018-1000300" {
+		t.Fatalf("Unexpected provenance: %+v", prov)
+	}
+	if err = compareStringSlices(prov.Patches, []string{"openSUSE-2018-10", "openSUSE-2018-20"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = compareStringSlices(prov.CVEs, []string{"CVE-2018-1000300"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The patched images are now outdated (the mock client always inspects
+	// opensuse:latest), so they are not selected again unless they are
+	// explicitly asked for.
+	stdout, _ = runCommand(client, "patch-all", "--log-dir", dir)
+	if batchLine(stdout, "opensuse:latest") != "" || batchLine(stdout, "opensuse:13.2") == "" {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+	stdout, _ = runCommand(client, "patch-all", "--log-dir", dir, "--filter", "outdated=true")
+	if batchLine(stdout, "opensuse:latest") == "" || batchLine(stdout, "opensuse:13.2") != "" {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+}
+
+func TestPatchAllSkipsProducedImages(t *testing.T) {
+	defer restoreOutdatedImages()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-batch")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Both images have the same sanitized name, but different log files.
+	client := &mockClient{logOutput: testPatchesXML, images: []types.ImageSummary{
+		{ID: testOutdatedImageID, RepoTags: []string{"a/b:c"}},
+		{ID: "2", RepoTags: []string{"a_b:c"}},
+		{ID: "3", RepoTags: []string{"opensuse:13.2-patched"}, Labels: map[string]string{labelOperation: "patch"}},
+	}}
+	stdout, logged := runCommand(client, "patch-all", "--log-dir", dir)
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+	if batchLine(stdout, "opensuse:13.2-patched") != "" || !strings.Contains(stdout, "2 patched, 0 skipped, 0 failed.") {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+	first, second := batchLine(stdout, "a/b:c"), batchLine(stdout, "a_b:c")
+	if !strings.HasSuffix(first, "a_b_c-"+shortImageID(testOutdatedImageID)+".log") || !strings.HasSuffix(second, "a_b_c-2.log") {
+		t.Fatalf("Unexpected lines:\n%s\n%s", first, second)
+	}
+}
+
+func TestPatchAllFailures(t *testing.T) {
+	defer restoreOutdatedImages()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-batch")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &mockClient{logOutput: testPatchesXML}
+	stdout, logged := runCommand(client, "patch-all", "--log-dir", dir, "--target", "{{.Repository}}:13.2")
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v: %s", lastCode, logged)
+	}
+	if line := batchLine(stdout, "opensuse:13.2"); line != "opensuse:13.2 opensuse:13.2 failed the target is the image itself -" {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	if line := batchLine(stdout, "opensuse:latest"); line != "opensuse:latest opensuse:13.2 skipped opensuse:13.2 already exists -" {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	if line := batchLine(stdout, "busybox:latest"); !strings.HasPrefix(line, "busybox:latest busybox:13.2 patched") {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+
+	restoreOutdatedImages()
+	stdout, logged = runCommand(&mockClient{logOutput: testPatchesXML, commitFail: true}, "patch-all", "--log-dir", dir, "--target", "same:tag")
+	if lastCode != 1 || !strings.Contains(stdout, "0 patched, 0 skipped, 3 failed.") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, stdout)
+	}
+	if line := batchLine(stdout, "opensuse:latest"); line != "opensuse:latest same:tag failed same target as busybox:latest -" {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	if !strings.Contains(logged, "Could not patch busybox:latest: Fake failure while committing container") {
+		t.Fatalf("Unexpected log: %s", logged)
+	}
+}
+
+func TestPatchAllErrors(t *testing.T) {
+	defer restoreOutdatedImages()
+
+	cases := []struct {
+		args []string
+		msg  string
+	}{
+		{[]string{"opensuse:13.2"}, "expected no arguments, 1 given"},
+		{[]string{"--parallel", "0"}, "--parallel has to be greater than 0"},
+		{[]string{"--target", "{{.Tag"}, "invalid target template"},
+		{[]string{"--filter", "foo=bar"}, "Error:"},
+	}
+	for _, c := range cases {
+		_, logged := runCommand(&mockClient{}, append([]string{"patch-all"}, c.args...)...)
+		if lastCode != 1 || !strings.Contains(logged, c.msg) {
+			t.Fatalf("Unexpected result for %v: %v: %s", c.args, lastCode, logged)
+		}
+	}
+}
+
+func TestUpdateAll(t *testing.T) {
+	defer restoreOutdatedImages()
+
+	dir, err := ioutil.TempDir("", "zypper-docker-batch")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &mockClient{logOutputs: map[string]string{
+		"zypper-docker-private-busybox:latest":  testNoPatchesXML,
+		"zypper-docker-private-opensuse:13.2":   testUpdatesXML,
+		"zypper-docker-private-opensuse:latest": testUpdatesXML,
+	}}
+	stdout, logged := runCommand(client, "update-all", "--log-dir", dir, "--target", "{{.Repository}}:{{.Tag}}-updated")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+	if !strings.Contains(stdout, "2 updated, 1 skipped, 0 failed.") {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+	if line := batchLine(stdout, "opensuse:13.2"); !strings.HasPrefix(line, "opensuse:13.2 opensuse:13.2-updated updated 2 packages") {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	if line := batchLine(stdout, "busybox:latest"); !strings.Contains(line, "nothing to apply") {
+		t.Fatalf("Unexpected line: %s\n%s", line, stdout)
+	}
+	if cmd := strings.Join(client.lastCmd, ""); !strings.Contains(cmd, "-n up") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+}
+
+func TestBatchPendingFilters(t *testing.T) {
+	client := &mockClient{logOutput: testUpdatesXML}
+	safeClient.client = client
+
+	// The pending updates are listed with the same flags as the update.
+	op := &batchOperation{zypperCmd: "up", filters: " --repo=update"}
+	pending, err := op.pending("opensuse:13.2")
+	if err != nil || pending != 2 {
+		t.Fatalf("Unexpected pending updates (%v): %d", err, pending)
+	}
+	if cmd := strings.Join(client.lastCmd, ""); !strings.Contains(cmd, "lu --repo=update") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+}
@@ -15,76 +15,261 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/etcd/pkg/fileutil"
 )
 
 const cacheName = "docker-zypper.json"
 
+// cacheVersion is the version of the format of the cache file. Files written
+// with older versions are migrated when read.
+const cacheVersion = 2
+
+// cachedImage contains everything that is known about an image.
+type cachedImage struct {
+	// Whether the image is based on either openSUSE or SLE. This is only
+	// meaningful if CheckedAt is set.
+	SUSE bool `json:"suse"`
+
+	// When the image was classified. A zero value means that it has never
+	// been classified (e.g. only its outdated status is known).
+	CheckedAt time.Time `json:"checked_at"`
+
+	// The distribution (as given by the PRETTY_NAME field of os-release) and
+	// the version of zypper detected inside of the image.
+	Distribution  string `json:"distribution,omitempty"`
+	ZypperVersion string `json:"zypper_version,omitempty"`
+
+	// The operating system as given by the os-release file of the image.
+	OS *osRelease `json:"os,omitempty"`
+
+	// Whether the image has been either patched or upgraded using
+	// zypper-docker.
+	Outdated bool `json:"outdated,omitempty"`
+
+	// The ID of the image produced the last time that this image was either
+	// patched or upgraded.
+	Successor string `json:"successor,omitempty"`
+}
+
+// classified returns whether the classification of this image is known and
+// has not expired according to the given TTL. A TTL of zero means that entries
+// never expire.
+func (ci *cachedImage) classified(ttl time.Duration) bool {
+	if ci.CheckedAt.IsZero() {
+		return false
+	}
+	return ttl <= 0 || time.Since(ci.CheckedAt) < ttl
+}
+
+// merge updates this entry with the given one: the most recent classification
+// wins, while the outdated status is kept if any of them has it. The successor
+// of the given entry, if any, has precedence.
+func (ci *cachedImage) merge(other *cachedImage) {
+	outdated, successor := ci.Outdated || other.Outdated, ci.Successor
+	if other.Successor != "" {
+		successor = other.Successor
+	}
+	if other.CheckedAt.After(ci.CheckedAt) {
+		*ci = *other
+	}
+	ci.Outdated, ci.Successor = outdated, successor
+}
+
 // The representation of cached data for this application.
 type cachedData struct {
 	// The path to the original cache file.
 	Path string `json:"-"`
 
-	// Contains all the IDs that are known to be valid openSUSE/SLE images.
-	Suse []string `json:"suse"`
+	// The version of the format of the cache file.
+	Version int `json:"version"`
 
-	// Contains all the IDs that are known to be non-openSUSE/SLE images.
-	Other []string `json:"other"`
+	// All the known images, indexed by their ID.
+	Images map[string]*cachedImage `json:"images"`
 
-	// Contains all the IDs of the images that have been either patched or
-	// upgraded or patched using zypper-docker
-	Outdated []string `json:"outdated"`
+	// How long classifications are considered valid. Zero means forever.
+	TTL time.Duration `json:"-"`
 
 	// Whether this data comes from a valid file or not.
 	Valid bool `json:"-"`
+
+	// Protects the data from concurrent accesses (e.g. when multiple images
+	// are being inspected at the same time).
+	mutex sync.Mutex
+}
+
+// legacyCache is the format of the cache file before it was versioned. It's
+// only used to migrate old files.
+type legacyCache struct {
+	Suse     []string `json:"suse"`
+	Other    []string `json:"other"`
+	Outdated []string `json:"outdated"`
+}
+
+// entry returns the entry for the given ID, creating it if it doesn't exist.
+// The caller is responsible for holding the lock.
+func (cd *cachedData) entry(id string) *cachedImage {
+	if cd.Images == nil {
+		cd.Images = map[string]*cachedImage{}
+	}
+	if _, ok := cd.Images[id]; !ok {
+		cd.Images[id] = &cachedImage{}
+	}
+	return cd.Images[id]
 }
 
 // Checks whether the given Id exists or not. It returns two booleans:
-//  - Whether it exists or not.
-//  - If it exists, whether it is a SUSE image or not.
+//   - Whether it exists or not.
+//   - If it exists, whether it is a SUSE image or not.
+//
+// Entries whose classification has expired are reported as non-existing.
 func (cd *cachedData) idExists(id string) (bool, bool) {
-	suse := arrayIncludeString(cd.Suse, id)
-	other := arrayIncludeString(cd.Other, id)
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
 
-	return suse || other, suse
+	return cd.lookup(id)
+}
+
+// lookup does the same as idExists, but the caller is responsible for holding
+// the lock.
+func (cd *cachedData) lookup(id string) (bool, bool) {
+	if img, ok := cd.Images[id]; ok && img.classified(cd.TTL) {
+		return true, img.SUSE
+	}
+	return false, false
 }
 
 // Returns whether the given ID matches an image that has been
 // updated via zypper-docker patch|update
 func (cd *cachedData) isImageOutdated(id string) bool {
-	return arrayIncludeString(cd.Outdated, id)
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	img, ok := cd.Images[id]
+	return ok && img.Outdated
 }
 
-// Returns whether the given ID matches an image that is based on SUSE.
+// successors returns the chain of images produced by patching or upgrading
+// the image with the given ID, from the first to the last one. For example, if
+// an image has been patched and the result has been patched again, the IDs of
+// both patched images are returned.
+func (cd *cachedData) successors(id string) []string {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	chain := []string{}
+	seen := map[string]bool{id: true}
+	for {
+		img, ok := cd.Images[id]
+		if !ok || img.Successor == "" || seen[img.Successor] {
+			return chain
+		}
+		id = img.Successor
+		seen[id] = true
+		chain = append(chain, id)
+	}
+}
+
+// Returns whether the given ID matches an image that is based on SUSE. It is
+// safe to call this function concurrently: the lock is not held while the
+// image is being inspected.
 func (cd *cachedData) isSUSE(id string) bool {
+	cd.mutex.Lock()
 	if cd.Valid {
-		if exists, suse := cd.idExists(id); exists {
+		if exists, suse := cd.lookup(id); exists {
+			cd.mutex.Unlock()
 			return suse
 		}
 	}
+	cd.mutex.Unlock()
+
+	classification := classifyImage(id)
 
-	suse := checkCommandInImage(id, "zypper")
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
 	if cd.Valid {
-		if suse {
-			cd.Suse = append(cd.Suse, id)
-		} else {
-			cd.Other = append(cd.Other, id)
+		entry := cd.entry(id)
+		classification.Outdated, classification.Successor = entry.Outdated, entry.Successor
+		cd.Images[id] = classification
+	}
+	return classification.SUSE
+}
+
+// classifyImage finds out whether the given image is based on SUSE or not.
+// First of all, the os-release file of the image is read without starting any
+// container, so images that are not based on SUSE are skipped right away.
+// Otherwise, a container is spawned to check whether zypper is available and
+// which version it is.
+func classifyImage(id string) *cachedImage {
+	img := &cachedImage{CheckedAt: time.Now().UTC()}
+
+	fields, err := readOSRelease(id)
+	if err != nil {
+		log.Printf("Could not read the os-release file of %v: %v", id, err)
+	} else if img.OS = newOSRelease(fields); img.OS != nil {
+		img.Distribution = fields["PRETTY_NAME"]
+		if !img.OS.isSUSE() {
+			return img
+		}
+		if img.OS.Variant == "" {
+			img.OS.Variant = bciVariant(imageLabels(id))
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	img.SUSE = checkCommandInImageOutput(id, "zypper --version", buf)
+	if img.SUSE {
+		scanner := bufio.NewScanner(buf)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "zypper ") {
+				img.ZypperVersion = strings.TrimPrefix(line, "zypper ")
+			}
 		}
 	}
-	return suse
+	return img
+}
+
+// imageLabels returns the labels of the given image.
+func imageLabels(id string) map[string]string {
+	img, _, err := getDockerClient().ImageInspectWithRaw(context.Background(), id)
+	if err != nil || img.Config == nil {
+		return nil
+	}
+	return img.Config.Labels
+}
+
+// imageOS returns the operating system of the given image, or nil if it is
+// not known.
+func (cd *cachedData) imageOS(id string) *osRelease {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	if img, ok := cd.Images[id]; ok {
+		return img.OS
+	}
+	return nil
 }
 
 // Writes all the cached data back to the cache file. This is needed because
 // functions like `inSUSE` only write to memory. Therefore, once you're done
 // with this instance, you should call this function to keep everything synced.
 func (cd *cachedData) flush() {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
 	if !cd.Valid {
 		// Silently fail, the user has probably already been notified about it.
 		return
@@ -107,13 +292,21 @@ func (cd *cachedData) flush() {
 	// cache will possibly be inconsistent.
 	oldCache := cd.readCache(file)
 
-	// Merge the old and "new" cache, and remove duplicates.
-	cd.Suse = append(cd.Suse, oldCache.Suse...)
-	cd.Other = append(cd.Other, oldCache.Other...)
-	cd.Outdated = append(cd.Outdated, oldCache.Outdated...)
-	cd.Suse = removeDuplicates(cd.Suse)
-	cd.Other = removeDuplicates(cd.Other)
-	cd.Outdated = removeDuplicates(cd.Outdated)
+	// Merge the old and "new" cache.
+	for id, img := range oldCache.Images {
+		cd.entry(id).merge(img)
+	}
+
+	cd.write(file)
+}
+
+// write replaces the contents of the given file with this cache. The caller
+// is responsible for holding the lock.
+func (cd *cachedData) write(file *fileutil.LockedFile) {
+	if cd.Images == nil {
+		cd.Images = map[string]*cachedImage{}
+	}
+	cd.Version = cacheVersion
 
 	// Clear file content.
 	file.Seek(0, 0)
@@ -123,8 +316,12 @@ func (cd *cachedData) flush() {
 	_ = enc.Encode(cd)
 }
 
-// Empty the contents of the cache file.
+// Forget about the classification of all the images. The outdated status of
+// images is kept, since it cannot be computed again.
 func (cd *cachedData) reset() {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
 	file, err := fileutil.LockFile(cd.Path, os.O_RDWR, 0666)
 	if err != nil {
 		log.Printf("Cannot write to the cache file: %v", err)
@@ -132,56 +329,198 @@ func (cd *cachedData) reset() {
 	}
 	defer file.Close()
 
-	cd.Suse, cd.Other = []string{}, []string{}
+	for id, img := range cd.Images {
+		if img.Outdated {
+			cd.Images[id] = &cachedImage{Outdated: true, Successor: img.Successor}
+		} else {
+			delete(cd.Images, id)
+		}
+	}
 
-	enc := json.NewEncoder(file)
-	_ = enc.Encode(cd)
+	cd.write(file)
+}
+
+// update applies the given function to the images stored in the cache file
+// and writes the result back. The file is locked during the whole operation,
+// so changes performed by other processes in the meantime are not lost. The
+// images in memory are replaced with the result.
+func (cd *cachedData) update(f func(images map[string]*cachedImage)) error {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	if !cd.Valid {
+		return fmt.Errorf("the cache file is not available")
+	}
+
+	file, err := fileutil.LockFile(cd.Path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	images, err := decodeCache(file)
+	if err != nil {
+		log.Printf("Decoding of cache file failed: %v\n", err)
+		images = map[string]*cachedImage{}
+	}
+	f(images)
+
+	cd.Images = images
+	cd.write(file)
+	return nil
 }
 
 // Update the Cachefile after an update.
-// The ID of the outdated image will be added to outdated Images and
-// the ID of the new image will be added to the SUSE Images.
+// The image with the given name will be marked as outdated, and the image with
+// the given ID will be classified as a SUSE image.
 func (cd *cachedData) updateCacheAfterUpdate(outdatedImg, updatedImgID string) error {
 	outdatedImgID, err := getImageID(outdatedImg)
 	if err != nil {
 		return err
 	}
-	if !arrayIncludeString(cd.Outdated, outdatedImgID) {
-		cd.Outdated = append(cd.Outdated, outdatedImgID)
-		cd.flush()
-	}
-	if !arrayIncludeString(cd.Suse, updatedImgID) {
-		cd.Suse = append(cd.Suse, updatedImgID)
-		cd.flush()
+
+	cd.mutex.Lock()
+	outdated := cd.entry(outdatedImgID)
+	outdated.Outdated, outdated.Successor = true, updatedImgID
+	updated := cd.entry(updatedImgID)
+	if !updated.classified(cd.TTL) || !updated.SUSE {
+		*updated = cachedImage{SUSE: true, CheckedAt: time.Now().UTC()}
 	}
+	cd.mutex.Unlock()
 
+	cd.flush()
 	return nil
 }
 
+// readCache decodes the cache stored in the given reader. Files written in an
+// older format are migrated transparently.
 func (cd *cachedData) readCache(r io.Reader) *cachedData {
-	ret := &cachedData{Valid: true, Path: cd.Path}
-	dec := json.NewDecoder(r)
-	if err := dec.Decode(&ret); err != nil && err != io.EOF {
+	ret := &cachedData{Valid: true, Path: cd.Path, TTL: cd.TTL}
+	images, err := decodeCache(r)
+	if err != nil {
 		log.Printf("Decoding of cache file failed: %v\n", err)
-		return &cachedData{Valid: true, Path: cd.Path}
+		return ret
 	}
 
+	ret.Version = cacheVersion
+	ret.Images = images
 	return ret
 }
 
+// decodeCache decodes the cache stored in the given reader and returns the
+// images contained in it. If the data has the format used before the cache
+// was versioned, then it's migrated: all the known images are considered to
+// have been classified at the moment of the migration.
+func decodeCache(r io.Reader) (map[string]*cachedImage, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		if err == io.EOF {
+			return map[string]*cachedImage{}, nil
+		}
+		return nil, err
+	}
+
+	current := struct {
+		Version int                     `json:"version"`
+		Images  map[string]*cachedImage `json:"images"`
+	}{}
+	if err := json.Unmarshal(raw, &current); err != nil {
+		return nil, err
+	}
+	if current.Version > 0 {
+		if current.Images == nil {
+			current.Images = map[string]*cachedImage{}
+		}
+		return current.Images, nil
+	}
+
+	legacy := legacyCache{}
+	if err := json.Unmarshal(raw, &legacy); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	images := map[string]*cachedImage{}
+	for _, id := range legacy.Suse {
+		images[id] = &cachedImage{SUSE: true, CheckedAt: now}
+	}
+	for _, id := range legacy.Other {
+		images[id] = &cachedImage{SUSE: false, CheckedAt: now}
+	}
+	for _, id := range legacy.Outdated {
+		if _, ok := images[id]; !ok {
+			images[id] = &cachedImage{}
+		}
+		images[id].Outdated = true
+	}
+	return images, nil
+}
+
+// cacheTTL returns the amount of time in which the classification of an image
+// is considered valid, as given by the `--cache-ttl` global flag.
+func cacheTTL() time.Duration {
+	if currentContext == nil {
+		return 0
+	}
+	return currentContext.GlobalDuration("cache-ttl")
+}
+
 // Retrieves the path for the cache file. It checks the following directories
 // in this specific order:
-//  1. $HOME/.cache
-//  2. /tmp
+//  1. The directory given by the `--cache-dir` global flag. If it has been
+//     given, then no other directory is checked.
+//  2. $XDG_CACHE_HOME
+//  3. $HOME/.cache
+//  4. /tmp
+//
 // It will try to open (or create if it doesn't exist) the cache file in each
-// directory until it finds a directory that is accessible.
+// directory until it finds a directory that is accessible. Cache files are
+// namespaced by the Docker daemon being used, so they are actually stored in
+// the "zypper-docker/<daemon ID>" subdirectory.
 func cachePath() *os.File {
-	candidates := []string{filepath.Join(os.Getenv("HOME"), ".cache"), "/tmp"}
+	return openCacheFile(cacheName)
+}
+
+// cacheDirs returns the directories in which cache files can be stored, in
+// order of preference.
+func cacheDirs() []string {
+	if currentContext != nil {
+		if dir := currentContext.GlobalString("cache-dir"); dir != "" {
+			return []string{dir}
+		}
+	}
+
+	dirs := []string{}
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		dirs = append(dirs, xdg)
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		dirs = append(dirs, filepath.Join(home, ".cache"))
+	}
+	return append(dirs, "/tmp")
+}
 
-	for _, dir := range candidates {
+// openCacheFile opens (or creates) the cache file with the given name, as
+// explained in the documentation of the `cachePath` function.
+func openCacheFile(base string) *os.File {
+	namespace, err := daemonNamespace()
+	if err != nil {
+		log.Printf("Could not identify the Docker daemon: %v", err)
+		return nil
+	}
+
+	for _, dir := range cacheDirs() {
 		dirs := strings.Split(dir, ":")
 		for _, d := range dirs {
-			name := filepath.Join(d, cacheName)
+			// The directory might be shared (e.g. /tmp), so it's only
+			// accessible by the current user.
+			nsDir := filepath.Join(d, "zypper-docker", namespace)
+			if err := os.MkdirAll(nsDir, 0700); err != nil {
+				continue
+			}
+			name := filepath.Join(nsDir, base)
+			adoptLegacyCacheFile(base, name)
+
 			lock, err := fileutil.LockFile(name, os.O_RDWR|os.O_CREATE, 0666)
 			if err == nil {
 				return lock.File
@@ -191,6 +530,88 @@ func cachePath() *os.File {
 	return nil
 }
 
+// legacyCacheDirs returns the directories in which cache files were stored
+// before they were namespaced by daemon, in the order in which they were
+// tried. These are used regardless of the cache directory being used now.
+func legacyCacheDirs() []string {
+	return []string{filepath.Join(os.Getenv("HOME"), ".cache"), "/tmp"}
+}
+
+// adoptLegacyCacheFile moves the cache file with the given base name, which
+// was written before cache files were namespaced by daemon, to the given path.
+// This is only done if there is no file in the given path yet. Since the file
+// is moved, it's only adopted by the first daemon being used after upgrading.
+func adoptLegacyCacheFile(base, name string) {
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		return
+	}
+	for _, dir := range legacyCacheDirs() {
+		legacy := filepath.Join(dir, base)
+		if _, err := os.Stat(legacy); err != nil {
+			continue
+		}
+		if err := moveFile(legacy, name); err != nil {
+			log.Printf("Could not migrate the cache file %v: %v", legacy, err)
+			return
+		}
+		log.Printf("Migrated the cache file %v to %v", legacy, name)
+		return
+	}
+}
+
+// moveFile moves the given file, copying it if it has to be moved into a
+// different filesystem.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dst, contents, 0666); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// daemonIdentity holds the namespace of the Docker daemon being used, so it's
+// only fetched once per execution.
+var daemonIdentity struct {
+	sync.Mutex
+	namespace string
+}
+
+// daemonNamespace returns the name of the directory in which the cache files
+// of the Docker daemon being used are stored. It's based on the ID of the
+// daemon as reported by its info endpoint.
+func daemonNamespace() (string, error) {
+	daemonIdentity.Lock()
+	defer daemonIdentity.Unlock()
+
+	if daemonIdentity.namespace != "" {
+		return daemonIdentity.namespace, nil
+	}
+
+	info, err := getDockerClient().Info(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if info.ID == "" {
+		return "", fmt.Errorf("the daemon did not report its ID")
+	}
+
+	// IDs of old daemons look like "7TRN:IPZB:QYBB:..." while newer ones
+	// are UUIDs, so replace anything that might not be safe in a path.
+	daemonIdentity.namespace = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, info.ID)
+	return daemonIdentity.namespace, nil
+}
+
 // Create a cache file or get the current one if it already exists. If that is
 // not possible, then the returned struct will be marked as invalid (meaning
 // that `isSUSE` will work without caching).
@@ -198,16 +619,11 @@ func getCacheFile() *cachedData {
 	file := cachePath()
 	if file == nil {
 		log.Println("Could not find path for the cache!")
-		return &cachedData{Valid: false}
+		return &cachedData{Valid: false, Images: map[string]*cachedImage{}}
 	}
 
-	cd := &cachedData{Valid: true, Path: file.Name()}
-	dec := json.NewDecoder(file)
-	err := dec.Decode(&cd)
+	cd := &cachedData{Valid: true, Path: file.Name(), TTL: cacheTTL()}
+	cd = cd.readCache(file)
 	_ = file.Close()
-	if err != nil && err != io.EOF {
-		log.Printf("Decoding of cache file failed: %v\n", err)
-		return &cachedData{Valid: true, Path: file.Name()}
-	}
 	return cd
 }
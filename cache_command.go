@@ -0,0 +1,304 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/go-units"
+)
+
+// zypper-docker cache show [--format json]
+func cacheShowCmd(ctx *cli.Context) {
+	if !checkFormat(ctx, formatJSON) {
+		return
+	}
+
+	cd := getCacheFile()
+	if !cd.Valid {
+		logAndFatalf("Error: the cache file is not available.\n")
+		return
+	}
+
+	if ctx.String("format") == formatJSON {
+		cd.Version = cacheVersion
+		if err := printJSON(cd); err != nil {
+			logAndFatalf("Error: %v.\n", err)
+			return
+		}
+		exitWithCode(0)
+		return
+	}
+
+	ids := make([]string, 0, len(cd.Images))
+	for id := range cd.Images {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(writer, "IMAGE ID\tSUSE\tDISTRIBUTION\tZYPPER\tCHECKED\tOUTDATED")
+	for _, id := range ids {
+		img := cd.Images[id]
+		suse, checked := "?", "never"
+		if !img.CheckedAt.IsZero() {
+			suse = yesNo(img.SUSE)
+			checked = units.HumanDuration(time.Now().UTC().Sub(img.CheckedAt)) + " ago"
+			if !img.classified(cd.TTL) {
+				checked += " (expired)"
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", stringid.TruncateID(id),
+			suse, valueOrDash(img.Distribution), valueOrDash(img.ZypperVersion),
+			checked, yesNo(img.Outdated))
+	}
+	writer.Flush()
+	exitWithCode(0)
+}
+
+// zypper-docker cache prune
+func cachePruneCmd(ctx *cli.Context) {
+	client := getDockerClient()
+	images, err := client.ImageList(context.Background(), types.ImageListOptions{All: true})
+	if err != nil {
+		logAndFatalf("Cannot proceed safely: %v.\n", err)
+		return
+	}
+
+	present := map[string]bool{}
+	for _, img := range images {
+		present[img.ID] = true
+	}
+
+	removed := 0
+	err = updateCaches(func(id string) bool {
+		if present[id] {
+			return false
+		}
+		removed++
+		return true
+	})
+	if err != nil {
+		logAndFatalf("Could not prune the cache: %v.\n", err)
+		return
+	}
+	logAndPrintf("Entries removed from the cache: %d.\n", removed)
+	exitWithCode(0)
+}
+
+// zypper-docker cache forget <image>
+func cacheForgetCmd(ctx *cli.Context) {
+	name := ctx.Args().First()
+	if name == "" {
+		logAndFatalf("Error: no image name specified.\n")
+		return
+	}
+
+	// The image might not be available anymore, so it can also be referred
+	// by its (possibly truncated) ID.
+	id, err := getImageID(name)
+	if err != nil {
+		id = name
+	}
+
+	matches := matchCachedIDs(id)
+	switch len(matches) {
+	case 0:
+		logAndFatalf("Error: image '%s' is not in the cache.\n", name)
+		return
+	case 1:
+	default:
+		logAndFatalf("Error: '%s' matches %d cached images, please use a longer ID.\n", name, len(matches))
+		return
+	}
+
+	removed := 0
+	err = updateCaches(func(cached string) bool {
+		if cached != matches[0] {
+			return false
+		}
+		removed++
+		return true
+	})
+	if err != nil {
+		logAndFatalf("Could not update the cache: %v.\n", err)
+		return
+	}
+	logAndPrintf("Entries removed from the cache: %d.\n", removed)
+	exitWithCode(0)
+}
+
+// matchCachedIDs returns the IDs stored in the cache files that match the given
+// ID. An exact match is preferred, otherwise all the IDs having the given
+// (possibly truncated) ID as a prefix are returned.
+func matchCachedIDs(id string) []string {
+	known := map[string]bool{}
+	for cached := range getCacheFile().Images {
+		known[cached] = true
+	}
+	for cached := range getScanCache().Images {
+		known[cached] = true
+	}
+
+	if known[id] {
+		return []string{id}
+	}
+	if known["sha256:"+id] {
+		return []string{"sha256:" + id}
+	}
+	matches := []string{}
+	for cached := range known {
+		if strings.HasPrefix(strings.TrimPrefix(cached, "sha256:"), strings.TrimPrefix(id, "sha256:")) {
+			matches = append(matches, cached)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// zypper-docker cache clear
+func cacheClearCmd(ctx *cli.Context) {
+	if err := updateCaches(func(string) bool { return true }); err != nil {
+		logAndFatalf("Could not clear the cache: %v.\n", err)
+		return
+	}
+	logAndPrintf("The cache has been cleared.\n")
+	exitWithCode(0)
+}
+
+// zypper-docker cache export [file]
+func cacheExportCmd(ctx *cli.Context) {
+	cd := getCacheFile()
+	if !cd.Valid {
+		logAndFatalf("Error: the cache file is not available.\n")
+		return
+	}
+	cd.Version = cacheVersion
+
+	var out io.Writer = os.Stdout
+	if path := ctx.Args().First(); path != "" && path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			logAndFatalf("Error: %v.\n", err)
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(cd); err != nil {
+		logAndFatalf("Could not export the cache: %v.\n", err)
+		return
+	}
+	exitWithCode(0)
+}
+
+// zypper-docker cache import <file>
+func cacheImportCmd(ctx *cli.Context) {
+	path := ctx.Args().First()
+	if path == "" {
+		logAndFatalf("Error: no file specified.\n")
+		return
+	}
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			logAndFatalf("Error: %v.\n", err)
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+
+	// Files exported by older versions are migrated on the way.
+	imported, err := decodeCache(in)
+	if err != nil {
+		logAndFatalf("Could not import the cache: %v.\n", err)
+		return
+	}
+
+	cd := getCacheFile()
+	err = cd.update(func(images map[string]*cachedImage) {
+		for id, img := range imported {
+			if current, ok := images[id]; ok {
+				current.merge(img)
+			} else {
+				images[id] = img
+			}
+		}
+	})
+	if err != nil {
+		logAndFatalf("Could not import the cache: %v.\n", err)
+		return
+	}
+	logAndPrintf("Imported %d images into the cache.\n", len(imported))
+	exitWithCode(0)
+}
+
+// updateCaches removes the entries of both the cache and the scans cache whose
+// image ID is matched by the given function, which is called once for each ID.
+func updateCaches(remove func(id string) bool) error {
+	removed := map[string]bool{}
+	err := getCacheFile().update(func(images map[string]*cachedImage) {
+		for id := range images {
+			if remove(id) {
+				removed[id] = true
+				delete(images, id)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return getScanCache().update(func(images map[string]*scannedImage) {
+		for id := range images {
+			if removed[id] || remove(id) {
+				delete(images, id)
+			}
+		}
+	})
+}
+
+// yesNo returns "yes" or "no" depending on the given value.
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// valueOrDash returns the given value, or "-" if it's empty.
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
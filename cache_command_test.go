@@ -0,0 +1,312 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mssola/capture"
+)
+
+// fillCaches writes the given images into the cache, and a scan result for
+// each one of them into the scans cache.
+func fillCaches(t *testing.T, images map[string]*cachedImage) {
+	err := getCacheFile().update(func(cached map[string]*cachedImage) {
+		for id, img := range images {
+			cached[id] = img
+		}
+	})
+	if err != nil {
+		t.Fatalf("Could not fill the cache: %v", err)
+	}
+
+	err = getScanCache().update(func(scanned map[string]*scannedImage) {
+		for id := range images {
+			scanned[id] = &scannedImage{Scans: map[string]*scanResult{
+				"zypper lp": {Output: "output", ScannedAt: time.Now().UTC()},
+			}}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Could not fill the scans cache: %v", err)
+	}
+}
+
+// cachedKeys returns the sorted IDs stored in both the cache and the scans
+// cache.
+func cachedKeys() ([]string, []string) {
+	cd, sc := getCacheFile(), getScanCache()
+
+	ids := append(cachedIDs(cd, true), cachedIDs(cd, false)...)
+	for id, img := range cd.Images {
+		if img.CheckedAt.IsZero() {
+			ids = append(ids, id)
+		}
+	}
+	scans := []string{}
+	for id := range sc.Images {
+		scans = append(scans, id)
+	}
+	return sortedStrings(ids), sortedStrings(scans)
+}
+
+func TestCacheShow(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	checked := time.Now().UTC().Add(-2 * time.Hour)
+	fillCaches(t, map[string]*cachedImage{
+		"sha256:35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01": {
+			SUSE: true, CheckedAt: checked, Distribution: "openSUSE Leap 15.0", ZypperVersion: "1.14.5",
+		},
+		"sha256:5a25a4fd8e8bc32c1b6b1bdb9ab8b3c17b5a11cca7e7c3d8b9c1d9a18c4bd9cf": {
+			SUSE: false, CheckedAt: checked, Distribution: "Ubuntu 18.04 LTS",
+		},
+		"sha256:9b4ee4e23d9bd8e1d9c5fc0ce3b4a2b1d4fdab5d2a3c3b6a0f6a19b4cb3c5d2e": {Outdated: true},
+	})
+
+	setupTestExitStatus()
+	res := capture.All(func() { cacheShowCmd(testContext([]string{}, false)) })
+	testReaderData(t, bytes.NewBuffer(res.Stdout), []string{
+		"IMAGE ID            SUSE                DISTRIBUTION         ZYPPER              CHECKED             OUTDATED",
+		"35ae93c88cf8        yes                 openSUSE Leap 15.0   1.14.5              2 hours ago         no",
+		"5a25a4fd8e8b        no                  Ubuntu 18.04 LTS     -                   2 hours ago         no",
+		"9b4ee4e23d9b        ?                   -                    -                   never               yes",
+	})
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+
+	res = capture.All(func() {
+		cacheShowCmd(testContextWithFlags([]string{"--format", "json"}, func(set *flag.FlagSet) {
+			set.String("format", "", "doc")
+		}))
+	})
+	cd := &cachedData{}
+	if err := json.Unmarshal(res.Stdout, cd); err != nil {
+		t.Fatalf("Could not decode the output: %v", err)
+	}
+	if cd.Version != cacheVersion || len(cd.Images) != 3 {
+		t.Fatalf("Unexpected output: %v", string(res.Stdout))
+	}
+}
+
+func TestCacheShowInvalidFormat(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	setupTestExitStatus()
+	capture.All(func() {
+		cacheShowCmd(testContextWithFlags([]string{"--format", "yaml"}, func(set *flag.FlagSet) {
+			set.String("format", "", "doc")
+		}))
+	})
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v", lastCode)
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	fillCaches(t, map[string]*cachedImage{
+		"1":  {SUSE: true, CheckedAt: time.Now().UTC()},
+		"2":  {Outdated: true},
+		"42": {SUSE: true, CheckedAt: time.Now().UTC(), Outdated: true},
+	})
+
+	setupTestExitStatus()
+	safeClient.client = &mockClient{}
+	res := capture.All(func() { cachePruneCmd(testContext([]string{}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+	if !bytes.Contains(res.Stdout, []byte("Entries removed from the cache: 1.")) {
+		t.Fatalf("Unexpected output: %v", string(res.Stdout))
+	}
+
+	ids, scans := cachedKeys()
+	expected := []string{"1", "2"}
+	if err := compareStringSlices(ids, expected); err != nil {
+		t.Fatalf("Unexpected cache: %v", err)
+	}
+	if err := compareStringSlices(scans, expected); err != nil {
+		t.Fatalf("Unexpected scans cache: %v", err)
+	}
+
+	// The cache is left untouched if the images cannot be listed.
+	setupTestExitStatus()
+	safeClient.client = &mockClient{listFail: true}
+	capture.All(func() { cachePruneCmd(testContext([]string{}, false)) })
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v", lastCode)
+	}
+	if ids, _ = cachedKeys(); len(ids) != 2 {
+		t.Fatalf("Unexpected cache: %v", ids)
+	}
+}
+
+func TestCacheForget(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	fillCaches(t, map[string]*cachedImage{
+		"1": {SUSE: true, CheckedAt: time.Now().UTC()},
+		"sha256:35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01": {Outdated: true},
+	})
+
+	// The image is known by the daemon.
+	setupTestExitStatus()
+	safeClient.client = &mockClient{}
+	capture.All(func() { cacheForgetCmd(testContext([]string{"opensuse:42.3"}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+
+	// The image is gone, but it can be referred by its truncated ID.
+	safeClient.client = &mockClient{inspectFail: true}
+	capture.All(func() { cacheForgetCmd(testContext([]string{"35ae93c88cf8"}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+
+	ids, scans := cachedKeys()
+	if len(ids) != 0 || len(scans) != 0 {
+		t.Fatalf("Everything should have been forgotten: %v %v", ids, scans)
+	}
+
+	capture.All(func() { cacheForgetCmd(testContext([]string{"unknown"}, false)) })
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v", lastCode)
+	}
+	setupTestExitStatus()
+	capture.All(func() { cacheForgetCmd(testContext([]string{}, false)) })
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v", lastCode)
+	}
+}
+
+func TestCacheForgetAmbiguous(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	fillCaches(t, map[string]*cachedImage{
+		"sha256:abc1": {SUSE: true, CheckedAt: time.Now().UTC()},
+		"sha256:abc2": {Outdated: true},
+	})
+
+	setupTestExitStatus()
+	safeClient.client = &mockClient{inspectFail: true}
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	capture.All(func() { cacheForgetCmd(testContext([]string{"a"}, false)) })
+	if lastCode != 1 || !strings.Contains(buffer.String(), "'a' matches 2 cached images") {
+		t.Fatalf("Expected to fail with an ambiguous ID, got %v: %v", lastCode, buffer.String())
+	}
+	if ids, _ := cachedKeys(); len(ids) != 2 {
+		t.Fatalf("Nothing should have been forgotten: %v", ids)
+	}
+
+	setupTestExitStatus()
+	capture.All(func() { cacheForgetCmd(testContext([]string{"abc2"}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+	if ids, _ := cachedKeys(); len(ids) != 1 || ids[0] != "sha256:abc1" {
+		t.Fatalf("Unexpected cache: %v", ids)
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	fillCaches(t, map[string]*cachedImage{
+		"1": {SUSE: true, CheckedAt: time.Now().UTC()},
+		"2": {Outdated: true},
+	})
+
+	setupTestExitStatus()
+	capture.All(func() { cacheClearCmd(testContext([]string{}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+
+	ids, scans := cachedKeys()
+	if len(ids) != 0 || len(scans) != 0 {
+		t.Fatalf("Everything should have been removed: %v %v", ids, scans)
+	}
+}
+
+func TestCacheExportImport(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	checked := time.Date(2018, time.May, 1, 0, 0, 0, 0, time.UTC)
+	fillCaches(t, map[string]*cachedImage{
+		"1": {SUSE: true, CheckedAt: checked, Distribution: "openSUSE Leap 15.0"},
+		"2": {Outdated: true},
+	})
+
+	path := filepath.Join(os.Getenv("HOME"), "exported.json")
+	setupTestExitStatus()
+	capture.All(func() { cacheExportCmd(testContext([]string{path}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+
+	// Import it into a cache that has a more recent entry for "1".
+	capture.All(func() { cacheClearCmd(testContext([]string{}, false)) })
+	fillCaches(t, map[string]*cachedImage{
+		"1": {SUSE: false, CheckedAt: checked.Add(time.Hour)},
+	})
+	capture.All(func() { cacheImportCmd(testContext([]string{path}, false)) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+
+	cd := getCacheFile()
+	if len(cd.Images) != 2 {
+		t.Fatalf("Unexpected cache: %v", cd.Images)
+	}
+	if cd.Images["1"].SUSE || !cd.Images["2"].Outdated {
+		t.Fatalf("Unexpected merge: %+v %+v", cd.Images["1"], cd.Images["2"])
+	}
+
+	// Old cache files can be imported too.
+	legacy := filepath.Join(os.Getenv("HOME"), "legacy.json")
+	if err := ioutil.WriteFile(legacy, []byte(`{"suse":["3"],"other":[],"outdated":["4"]}`), 0644); err != nil {
+		t.Fatal("Could not write file")
+	}
+	capture.All(func() { cacheImportCmd(testContext([]string{legacy}, false)) })
+	if ids, _ := cachedKeys(); len(ids) != 4 {
+		t.Fatalf("Unexpected cache: %v", ids)
+	}
+
+	capture.All(func() { cacheImportCmd(testContext([]string{"/does/not/exist"}, false)) })
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v", lastCode)
+	}
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -25,11 +26,20 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
 )
 
 // NOTE: some functions are already covered in other places of this test suite,
 // so there's no point to add more tests in this specific file.
 
+// testCachePath returns the path of the given cache file for the mocked daemon
+// inside of the given home directory.
+func testCachePath(home, name string) string {
+	return filepath.Join(home, ".cache", "zypper-docker", "MOCK-DAEM-ON00", name)
+}
+
 func TestCachePath(t *testing.T) {
 	home, umask := os.Getenv("HOME"), syscall.Umask(0)
 	abs, _ := filepath.Abs(".")
@@ -56,7 +66,7 @@ func TestCachePath(t *testing.T) {
 	name, mode := file.Name(), info.Mode().Perm()
 	_ = file.Close()
 	_ = os.Remove(name)
-	if name != filepath.Join(abs, ".cache", cacheName) {
+	if name != filepath.Join(abs, ".cache", "zypper-docker", "MOCK-DAEM-ON00", cacheName) {
 		t.Fatal("Unexpected name")
 	}
 	if mode != 0666 {
@@ -95,11 +105,14 @@ func TestCacheBadJson(t *testing.T) {
 	defer func() {
 		syscall.Umask(umask)
 		_ = os.Setenv("HOME", home)
-		_ = os.Rename(filepath.Join(test, ".cache", cacheName),
+		_ = os.Rename(testCachePath(test, cacheName),
 			filepath.Join(test, ".cache", "bad.json"))
 	}()
 
+	// The file is in the location used before cache files were namespaced, so
+	// it will be adopted by the daemon being used.
 	_ = os.Setenv("HOME", test)
+	_ = os.Remove(testCachePath(test, cacheName))
 	_ = os.Rename(filepath.Join(test, ".cache", "bad.json"),
 		filepath.Join(test, ".cache", cacheName))
 
@@ -122,11 +135,14 @@ func TestCacheGoodJson(t *testing.T) {
 	defer func() {
 		syscall.Umask(umask)
 		_ = os.Setenv("HOME", home)
-		_ = os.Rename(filepath.Join(test, ".cache", cacheName),
+		_ = os.Rename(testCachePath(test, cacheName),
 			filepath.Join(test, ".cache", "ok.json"))
 	}()
 
+	// The file is in the location used before cache files were namespaced, so
+	// it will be adopted by the daemon being used.
 	_ = os.Setenv("HOME", test)
+	_ = os.Remove(testCachePath(test, cacheName))
 	_ = os.Rename(filepath.Join(test, ".cache", "ok.json"),
 		filepath.Join(test, ".cache", cacheName))
 
@@ -135,25 +151,28 @@ func TestCacheGoodJson(t *testing.T) {
 	if !file.Valid {
 		t.Fatal("It should be valid")
 	}
-	if file.Path != filepath.Join(test, ".cache", cacheName) {
+	if file.Path != testCachePath(test, cacheName) {
 		t.Fatal("Wrong path")
 	}
 
-	if len(file.Suse) != 2 {
-		t.Fatal("Wrong value for SUSE")
+	// The file uses the format from before the cache was versioned, so it
+	// has been migrated.
+	if file.Version != cacheVersion {
+		t.Fatalf("Expected version %v, got %v", cacheVersion, file.Version)
 	}
-	if len(file.Other) != 2 {
-		t.Fatal("Wrong value for Other")
+	if len(file.Images) != 4 {
+		t.Fatalf("Expected 4 images, got %v", len(file.Images))
 	}
-	if len(file.Outdated) != 0 {
-		t.Fatal("Wrong value for Outdated")
-	}
-
-	elements := append(file.Suse, file.Other...)
-	elements = append(elements, file.Outdated...)
-	for i, value := range elements {
-		if value != fmt.Sprintf("%v", i+1) {
-			t.Fatal("Wrong value")
+	for i := 1; i <= 4; i++ {
+		img, ok := file.Images[fmt.Sprintf("%v", i)]
+		if !ok {
+			t.Fatalf("Image %v should be there", i)
+		}
+		if img.SUSE != (i <= 2) {
+			t.Fatalf("Wrong SUSE value for image %v", i)
+		}
+		if img.CheckedAt.IsZero() || img.Outdated {
+			t.Fatalf("Wrong migration for image %v: %+v", i, img)
 		}
 	}
 }
@@ -163,17 +182,18 @@ func TestFlush(t *testing.T) {
 	test := filepath.Join(abs, "test")
 	path := filepath.Join(test, "testflush.json")
 
+	checked := time.Date(2018, time.May, 1, 0, 0, 0, 0, time.UTC)
 	cd := &cachedData{
-		Path:     path,
-		Valid:    false,
-		Suse:     []string{},
-		Other:    []string{},
-		Outdated: []string{},
+		Path:  path,
+		Valid: false,
+		Images: map[string]*cachedImage{
+			"2": {SUSE: false, CheckedAt: checked},
+		},
 	}
 
 	// Now put some contents there.
-	expected := "{\"suse\": [\"1\"], \"other\": [], \"outdated\": []}"
-	err := ioutil.WriteFile(path, []byte(expected), 0666)
+	original := `{"version":2,"images":{"1":{"suse":true,"checked_at":"2018-04-01T00:00:00Z","outdated":true}}}`
+	err := ioutil.WriteFile(path, []byte(original), 0666)
 	if err != nil {
 		t.Fatal("Failed on writing a file")
 	}
@@ -185,7 +205,7 @@ func TestFlush(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed on reading a file")
 	}
-	if strings.TrimSpace(string(contents)) != expected {
+	if strings.TrimSpace(string(contents)) != original {
 		t.Fatal("Wrong contents")
 	}
 
@@ -193,7 +213,9 @@ func TestFlush(t *testing.T) {
 	// again.
 	cd.Valid = true
 	cd.flush()
-	expected = "{\"suse\":[\"1\"],\"other\":[],\"outdated\":[]}"
+	expected := `{"version":2,"images":{` +
+		`"1":{"suse":true,"checked_at":"2018-04-01T00:00:00Z","outdated":true},` +
+		`"2":{"suse":false,"checked_at":"2018-05-01T00:00:00Z"}}}`
 	contents, err = ioutil.ReadFile(path)
 	if err != nil {
 		t.Fatal("Failed on reading a file")
@@ -216,6 +238,101 @@ func TestFlush(t *testing.T) {
 	}
 }
 
+func TestFlushMerge(t *testing.T) {
+	abs, _ := filepath.Abs(".")
+	path := filepath.Join(abs, "test", "testflushmerge.json")
+	defer func() { _ = os.Remove(path) }()
+
+	// The file has a more recent classification for "1", and an older one for
+	// "2" which is outdated.
+	contents := `{"version":2,"images":{` +
+		`"1":{"suse":false,"checked_at":"2018-06-01T00:00:00Z"},` +
+		`"2":{"suse":false,"checked_at":"2018-01-01T00:00:00Z","outdated":true}}}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+		t.Fatal("Failed on writing a file")
+	}
+
+	checked := time.Date(2018, time.May, 1, 0, 0, 0, 0, time.UTC)
+	cd := &cachedData{
+		Path:  path,
+		Valid: true,
+		Images: map[string]*cachedImage{
+			"1": {SUSE: true, CheckedAt: checked},
+			"2": {SUSE: true, CheckedAt: checked, Distribution: "openSUSE Leap 15.0"},
+		},
+	}
+	cd.flush()
+
+	if cd.Images["1"].SUSE {
+		t.Fatal("The most recent classification should have won")
+	}
+	img := cd.Images["2"]
+	if !img.SUSE || img.Distribution != "openSUSE Leap 15.0" || !img.Outdated {
+		t.Fatalf("Unexpected merge: %+v", img)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now().UTC()
+	cd := &cachedData{
+		Valid: true,
+		Images: map[string]*cachedImage{
+			"1": {SUSE: true, CheckedAt: now.Add(-2 * time.Hour)},
+			"2": {SUSE: true, CheckedAt: now},
+			"3": {Outdated: true},
+		},
+	}
+
+	for _, id := range []string{"1", "2"} {
+		if exists, suse := cd.idExists(id); !exists || !suse {
+			t.Fatalf("Image %v should be known when there is no TTL", id)
+		}
+	}
+	if exists, _ := cd.idExists("3"); exists {
+		t.Fatal("Image 3 has never been classified")
+	}
+	if !cd.isImageOutdated("3") {
+		t.Fatal("Image 3 should be outdated")
+	}
+
+	cd.TTL = time.Hour
+	if exists, _ := cd.idExists("1"); exists {
+		t.Fatal("Image 1 should have expired")
+	}
+	if exists, suse := cd.idExists("2"); !exists || !suse {
+		t.Fatal("Image 2 should not have expired")
+	}
+}
+
+func TestCacheReset(t *testing.T) {
+	abs, _ := filepath.Abs(".")
+	path := filepath.Join(abs, "test", "testreset.json")
+	defer func() { _ = os.Remove(path) }()
+
+	if err := ioutil.WriteFile(path, []byte(`{}`), 0666); err != nil {
+		t.Fatal("Failed on writing a file")
+	}
+
+	cd := &cachedData{
+		Path:  path,
+		Valid: true,
+		Images: map[string]*cachedImage{
+			"1": {SUSE: true, CheckedAt: time.Now().UTC()},
+			"2": {SUSE: true, CheckedAt: time.Now().UTC(), Outdated: true},
+		},
+	}
+	cd.reset()
+
+	expected := `{"version":2,"images":{"2":{"suse":false,"checked_at":"0001-01-01T00:00:00Z","outdated":true}}}`
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed on reading a file")
+	}
+	if strings.TrimSpace(string(contents)) != expected {
+		t.Fatalf("Expected %v, got %v", expected, string(contents))
+	}
+}
+
 func TestUpdateCacheAfterUpdateFailsBecauseOfListError(t *testing.T) {
 	cache := cachedData{}
 
@@ -228,31 +345,66 @@ func TestUpdateCacheAfterUpdateFailsBecauseOfListError(t *testing.T) {
 
 func TestUpdateCacheAfterUpdateNothingDoneWhenTheImageIsAlreadyKnown(t *testing.T) {
 	cache := cachedData{
-		Outdated: []string{"35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01"},
-		Suse:     []string{"2"}}
+		Images: map[string]*cachedImage{
+			"35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01": {Outdated: true},
+			"2": {SUSE: true, CheckedAt: time.Now().UTC()},
+		},
+	}
 
 	safeClient.client = &mockClient{inspectFail: true}
 	err := cache.updateCacheAfterUpdate("opensuse:13.2", "2")
 	if err == nil {
 		t.Fatal("Expected failure")
 	}
-	if len(cache.Outdated) != 1 {
+	if len(cache.Images) != 2 {
 		t.Fatal("Nothing should have changed")
 	}
-	if len(cache.Suse) != 1 {
+	if !cache.Images["2"].SUSE {
 		t.Fatal("Nothing should have changed")
 	}
 }
 
+func TestUpdateCacheAfterUpdateRecordsSuccessor(t *testing.T) {
+	cache := cachedData{Images: map[string]*cachedImage{}}
+
+	// The mock client inspects every image as "1".
+	safeClient.client = &mockClient{}
+	if err := cache.updateCacheAfterUpdate("opensuse:13.2", "2"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if img := cache.Images["1"]; !img.Outdated || img.Successor != "2" {
+		t.Fatalf("Unexpected entry: %+v", img)
+	}
+	if err := compareStringSlices(cache.successors("1"), []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The successor survives newer classifications.
+	img := &cachedImage{SUSE: true, CheckedAt: time.Now().UTC()}
+	cache.Images["1"].merge(img)
+	if img := cache.Images["1"]; !img.Outdated || img.Successor != "2" || !img.SUSE {
+		t.Fatalf("Unexpected entry: %+v", img)
+	}
+	cache.Images["1"].merge(&cachedImage{Successor: "3"})
+	if img := cache.Images["1"]; img.Successor != "3" {
+		t.Fatalf("Unexpected entry: %+v", img)
+	}
+}
+
 func TestReadCacheSuccess(t *testing.T) {
 	cache := cachedData{}
 	expected := &cachedData{
-		Valid:    true,
-		Suse:     []string{"1"},
-		Other:    []string{"2"},
-		Outdated: []string{"3"},
+		Valid:   true,
+		Version: cacheVersion,
+		Images: map[string]*cachedImage{
+			"1": {SUSE: true, CheckedAt: time.Date(2018, time.May, 1, 0, 0, 0, 0, time.UTC),
+				Distribution: "openSUSE Leap 15.0", ZypperVersion: "1.14.5"},
+			"3": {Outdated: true},
+		},
 	}
-	buffer := bytes.NewBufferString(`{"suse":["1"],"other":["2"],"outdated":["3"]}`)
+	buffer := bytes.NewBufferString(`{"version":2,"images":{` +
+		`"1":{"suse":true,"checked_at":"2018-05-01T00:00:00Z","distribution":"openSUSE Leap 15.0","zypper_version":"1.14.5"},` +
+		`"3":{"suse":false,"checked_at":"0001-01-01T00:00:00Z","outdated":true}}}`)
 
 	got := cache.readCache(buffer)
 	if !reflect.DeepEqual(got, expected) {
@@ -260,6 +412,98 @@ func TestReadCacheSuccess(t *testing.T) {
 	}
 }
 
+func TestReadCacheMigration(t *testing.T) {
+	cache := cachedData{}
+	buffer := bytes.NewBufferString(`{"suse":["1"],"other":["2"],"outdated":["1","3"]}`)
+
+	got := cache.readCache(buffer)
+	if got.Version != cacheVersion {
+		t.Fatalf("Expected version %v, got %v", cacheVersion, got.Version)
+	}
+	if len(got.Images) != 3 {
+		t.Fatalf("Expected 3 images, got %v", len(got.Images))
+	}
+
+	if img := got.Images["1"]; !img.SUSE || img.CheckedAt.IsZero() || !img.Outdated {
+		t.Fatalf("Wrong migration for image 1: %+v", img)
+	}
+	if img := got.Images["2"]; img.SUSE || img.CheckedAt.IsZero() || img.Outdated {
+		t.Fatalf("Wrong migration for image 2: %+v", img)
+	}
+	if img := got.Images["3"]; !img.CheckedAt.IsZero() || !img.Outdated {
+		t.Fatalf("Wrong migration for image 3: %+v", img)
+	}
+}
+
+func TestClassifyImage(t *testing.T) {
+	safeClient.client = &mockClient{logOutput: "zypper 1.14.5\n"}
+
+	img := classifyImage("opensuse:42.3")
+	if !img.SUSE || img.CheckedAt.IsZero() {
+		t.Fatalf("Wrong classification: %+v", img)
+	}
+	if img.Distribution != "openSUSE Leap 15.0" {
+		t.Fatalf("Wrong distribution: %v", img.Distribution)
+	}
+	if img.ZypperVersion != "1.14.5" {
+		t.Fatalf("Wrong zypper version: %v", img.ZypperVersion)
+	}
+	expected := &osRelease{ID: "opensuse-leap", VersionID: "15.0", IDLike: "suse opensuse"}
+	if !reflect.DeepEqual(img.OS, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, img.OS)
+	}
+}
+
+func TestClassifyImageNotSUSE(t *testing.T) {
+	mock := &mockClient{osRelease: ubuntuOSRelease}
+	safeClient.client = mock
+
+	img := classifyImage("ubuntu:18.04")
+	if img.SUSE || img.CheckedAt.IsZero() || img.ZypperVersion != "" {
+		t.Fatalf("Wrong classification: %+v", img)
+	}
+	if img.Distribution != "Ubuntu 18.04.1 LTS" || img.OS.String() != "ubuntu 18.04" {
+		t.Fatalf("Wrong operating system: %v %v", img.Distribution, img.OS)
+	}
+
+	// The only container created is the one to read the os-release file,
+	// which is never started.
+	if len(mock.lastCmd) != 1 || mock.lastCmd[0] != "true" {
+		t.Fatalf("Unexpected command: %v", mock.lastCmd)
+	}
+}
+
+func TestClassifyImageSymlinkAndBCI(t *testing.T) {
+	safeClient.client = &mockClient{
+		osReleaseLink: true,
+		osRelease:     "ID=\"sles\"\nVERSION_ID=\"15.5\"\nPRETTY_NAME=\"SUSE Linux Enterprise Server 15 SP5\"\n",
+		labels:        map[string]string{"com.suse.image-type": "sle-bci", "com.suse.bci.base.version": "15.5.36.5.33"},
+		logOutput:     "zypper 1.14.61\n",
+	}
+
+	img := classifyImage("registry.suse.com/bci/bci-base:15.5")
+	if !img.SUSE || img.ZypperVersion != "1.14.61" {
+		t.Fatalf("Wrong classification: %+v", img)
+	}
+	if img.OS == nil || img.OS.String() != "sles 15.5 (sle-bci)" {
+		t.Fatalf("Wrong operating system: %v", img.OS)
+	}
+}
+
+func TestClassifyImageWithoutOSRelease(t *testing.T) {
+	safeClient.client = &mockClient{copyFail: true, logOutput: "zypper 1.14.5\n"}
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	img := classifyImage("opensuse:42.3")
+	if !img.SUSE || img.OS != nil || img.ZypperVersion != "1.14.5" {
+		t.Fatalf("Wrong classification: %+v", img)
+	}
+	if !strings.Contains(buffer.String(), "Could not read the os-release file") {
+		t.Fatal("Wrong log")
+	}
+}
+
 func TestReadCacheFail(t *testing.T) {
 	cache := cachedData{}
 	expected := &cachedData{
@@ -272,3 +516,113 @@ func TestReadCacheFail(t *testing.T) {
 		t.Fatalf("Expected %v, got %v", expected, got)
 	}
 }
+
+func TestCacheDirs(t *testing.T) {
+	home, xdg := os.Getenv("HOME"), os.Getenv("XDG_CACHE_HOME")
+	defer func() {
+		_ = os.Setenv("HOME", home)
+		_ = os.Setenv("XDG_CACHE_HOME", xdg)
+		currentContext = nil
+	}()
+
+	_ = os.Setenv("HOME", "/home/user")
+	_ = os.Setenv("XDG_CACHE_HOME", "")
+	if err := compareStringSlices(cacheDirs(), []string{"/home/user/.cache", "/tmp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = os.Setenv("XDG_CACHE_HOME", "/xdg")
+	if err := compareStringSlices(cacheDirs(), []string{"/xdg", "/home/user/.cache", "/tmp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = os.Setenv("HOME", "")
+	if err := compareStringSlices(cacheDirs(), []string{"/xdg", "/tmp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	globals := flag.NewFlagSet("global", 0)
+	globals.String("cache-dir", "/explicit", "doc")
+	currentContext = cli.NewContext(nil, flag.NewFlagSet("test", 0), cli.NewContext(nil, globals, nil))
+	if err := compareStringSlices(cacheDirs(), []string{"/explicit"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheNamespacedByDaemon(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer func() {
+		restore()
+		daemonIdentity.namespace = ""
+		safeClient.client = &mockClient{}
+	}()
+
+	daemonIdentity.namespace = ""
+	safeClient.client = &mockClient{daemonID: "7TRN:IPZB:QYBB"}
+	cd := getCacheFile()
+	cd.Images["1"] = &cachedImage{SUSE: true, CheckedAt: time.Now().UTC()}
+	cd.flush()
+	if cd.Path != filepath.Join(os.Getenv("HOME"), ".cache", "zypper-docker", "7TRN-IPZB-QYBB", cacheName) {
+		t.Fatalf("Unexpected path: %v", cd.Path)
+	}
+
+	// Another daemon does not see the images of the first one.
+	daemonIdentity.namespace = ""
+	safeClient.client = &mockClient{daemonID: "a9c4f3c2-1b7e-4d6f-8e2a-3f5b6c7d8e9f"}
+	cd = getCacheFile()
+	if !cd.Valid || len(cd.Images) != 0 {
+		t.Fatalf("Unexpected cache: %v", cd.Images)
+	}
+
+	// The cache is not available if the daemon cannot be identified.
+	daemonIdentity.namespace = ""
+	safeClient.client = &mockClient{infoFail: true}
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	if cd = getCacheFile(); cd.Valid {
+		t.Fatal("Cache should not be valid")
+	}
+	if !strings.Contains(buffer.String(), "Could not identify the Docker daemon") {
+		t.Fatal("Wrong log")
+	}
+}
+
+func TestCacheLegacyFileWithCacheDir(t *testing.T) {
+	home := os.Getenv("HOME")
+	dir, err := ioutil.TempDir("", "zypper-docker-legacy")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer func() {
+		_ = os.Setenv("HOME", home)
+		_ = os.RemoveAll(dir)
+		currentContext = nil
+	}()
+
+	// The legacy file was always written into $HOME/.cache, even if another
+	// cache directory is being used now.
+	_ = os.Setenv("HOME", filepath.Join(dir, "home"))
+	legacy := filepath.Join(dir, "home", ".cache", cacheName)
+	_ = os.MkdirAll(filepath.Dir(legacy), 0755)
+	if err := ioutil.WriteFile(legacy, []byte(`{"suse":["1"],"other":[],"outdated":["1"]}`), 0644); err != nil {
+		t.Fatalf("Could not write the legacy file: %v", err)
+	}
+
+	globals := flag.NewFlagSet("global", 0)
+	globals.String("cache-dir", filepath.Join(dir, "cache"), "doc")
+	currentContext = cli.NewContext(nil, flag.NewFlagSet("test", 0), cli.NewContext(nil, globals, nil))
+
+	cd := getCacheFile()
+	if cd.Path != filepath.Join(dir, "cache", "zypper-docker", "MOCK-DAEM-ON00", cacheName) {
+		t.Fatalf("Unexpected path: %v", cd.Path)
+	}
+	if !cd.isImageOutdated("1") {
+		t.Fatalf("The outdated images should have been migrated: %v", cd.Images)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatal("The legacy file should have been moved")
+	}
+	if info, err := os.Stat(filepath.Dir(cd.Path)); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("Unexpected permissions of the cache directory: %v", info.Mode())
+	}
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -34,6 +35,10 @@ import (
 // zypperExitCode is used as zypper-docker's exit code.
 var zypperExitCode int64
 
+// exitCodeMutex protects the writes to zypperExitCode, since multiple
+// containers might be running at the same time.
+var exitCodeMutex sync.Mutex
+
 // rootUser is the explicit value to use for the USER directive to specify a user
 // as being root. Oddly, specifying the default value ("") doesn't work even though
 // images that have the default value set for .Config.User run as root.
@@ -65,14 +70,22 @@ type DockerClient interface {
 	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
 	ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error)
 	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
+	ContainerRename(ctx context.Context, containerID, newContainerName string) error
 	ContainerResize(ctx context.Context, containerID string, options types.ResizeOptions) error
 	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
 	ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
 	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error)
 
 	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
 	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
 	ImageRemove(ctx context.Context, containerID string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+	ImageTag(ctx context.Context, source, target string) error
+
+	Info(ctx context.Context) (types.Info, error)
+
+	NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error
 }
 
 // The timeout in which the container is allowed to run a command as given
@@ -87,6 +100,88 @@ var safeClient struct {
 	client DockerClient
 }
 
+// helperContainers keeps track of the containers that have been created by
+// zypper-docker and that have not been removed yet. This way all of them can
+// be removed when zypper-docker gets interrupted, even if they were spawned by
+// different goroutines.
+var helperContainers struct {
+	sync.Mutex
+	ids []string
+}
+
+// temporaryImages keeps track of the images committed from containers by the
+// *-container commands, which are removed right after being analyzed.
+var temporaryImages struct {
+	sync.Mutex
+	ids map[string]bool
+}
+
+// setTemporaryImage marks or unmarks the given image as temporary.
+func setTemporaryImage(id string, temporary bool) {
+	temporaryImages.Lock()
+	defer temporaryImages.Unlock()
+
+	if temporaryImages.ids == nil {
+		temporaryImages.ids = map[string]bool{}
+	}
+	if temporary {
+		temporaryImages.ids[id] = true
+	} else {
+		delete(temporaryImages.ids, id)
+	}
+}
+
+// isTemporaryImage returns whether the given image has been committed from a
+// container just to be analyzed.
+func isTemporaryImage(id string) bool {
+	temporaryImages.Lock()
+	defer temporaryImages.Unlock()
+
+	return temporaryImages.ids[id]
+}
+
+// trackContainer adds the given container to the list of helper containers.
+func trackContainer(id string) {
+	helperContainers.Lock()
+	defer helperContainers.Unlock()
+
+	helperContainers.ids = append(helperContainers.ids, id)
+}
+
+// untrackContainer removes the given container from the list of helper
+// containers.
+func untrackContainer(id string) {
+	helperContainers.Lock()
+	defer helperContainers.Unlock()
+
+	for i, v := range helperContainers.ids {
+		if v == id {
+			helperContainers.ids = append(helperContainers.ids[:i], helperContainers.ids[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeHelperContainers removes all the helper containers that are still
+// around. The lock is held during the whole operation, so concurrent callers
+// wait until everything has been cleaned up.
+func removeHelperContainers() {
+	helperContainers.Lock()
+	defer helperContainers.Unlock()
+
+	client := getDockerClient()
+	for _, id := range helperContainers.ids {
+		err := client.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	helperContainers.ids = nil
+}
+
 // getDockerClient safely returns the singleton instance of the Docker client.
 func getDockerClient() DockerClient {
 	safeClient.Lock()
@@ -96,12 +191,15 @@ func getDockerClient() DockerClient {
 		return safeClient.client
 	}
 
-	if dc, err := client.NewEnvClient(); err != nil {
-		log.Printf("Could not get a docker client: %v", err)
-	} else {
-		safeClient.client = dc
-		return dc
+	endpoint, err := resolveDockerEndpoint(currentContext)
+	if err == nil {
+		var dc *client.Client
+		if dc, err = newDockerClient(endpoint); err == nil {
+			safeClient.client = dc
+			return dc
+		}
 	}
+	log.Printf("Could not get a docker client: %v", err)
 
 	// The return statement is just to make golint happy about this and for
 	// compliance with the API.
@@ -135,9 +233,14 @@ func humanizeCommandError(cmd, image string, err error) {
 // then passed to startContainer, which starts the container.
 // It returns true if the command was successful, false otherwise.
 func checkCommandInImage(img, cmd string) bool {
+	return checkCommandInImageOutput(img, cmd, nil)
+}
 
+// checkCommandInImageOutput does the same as checkCommandInImage, but the
+// output of the command is written into the given writer (if not nil).
+func checkCommandInImageOutput(img, cmd string, dst io.Writer) bool {
 	containerID, err := createContainer(img, []string{cmd})
-	containerID, err = startContainer(containerID, false, nil)
+	containerID, err = startContainer(containerID, false, dst)
 
 	defer removeContainer(containerID)
 
@@ -166,8 +269,7 @@ func runStreamedCommand(img, cmd string, getError bool) error {
 	}
 
 	cmd = formatZypperCommand("ref", cmd)
-	id, err := runCommandInContainer(img, []string{cmd}, os.Stdout)
-	removeContainer(id)
+	err := runScanCommand(img, cmd, os.Stdout)
 
 	if getError {
 		return err
@@ -180,6 +282,47 @@ func runStreamedCommand(img, cmd string, getError bool) error {
 	return nil
 }
 
+// runCapturedCommand works like `runStreamedCommand`, but instead of streaming
+// the output of the given command to the standard output, it returns it as a
+// string. This is meant for commands producing machine-readable output (e.g.
+// when `--xmlout` is passed to zypper). For this reason, the repositories are
+// refreshed quietly, so their output does not get mixed with the actual
+// result.
+//
+// The returned error is the one given by the `runCommandInContainer` function.
+func runCapturedCommand(img, cmd string) (string, error) {
+	if img == "" {
+		logAndFatalf("Error: no image name specified.\n")
+		return "", nil
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	cmd = formatZypperCommand("--quiet ref", cmd)
+	err := runScanCommand(img, cmd, buf)
+
+	return buf.String(), err
+}
+
+// runXMLCommand runs the given zypper command in XML mode (i.e. `--xmlout` is
+// prepended to it) in a container based on the given image, and returns the
+// parsed output. The returned error might be a non-severe dockerError (e.g.
+// zypper telling that there are patches to be installed), in which case the
+// returned stream is still valid.
+func runXMLCommand(img, cmd string) (*zypperStream, error) {
+	output, err := runCapturedCommand(img, "--xmlout "+cmd)
+	if err != nil {
+		if de, ok := err.(dockerError); !ok || isZypperExitCodeSevere(int(de.exitCode)) {
+			return nil, err
+		}
+	}
+
+	stream, parseErr := parseZypperXML(output)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return stream, err
+}
+
 // Run the given command in a container based on the given image. The given
 // image string is just the ID of said image.
 // The STDOUT and STDERR of the container can be streamed by providing a
@@ -261,6 +404,7 @@ func startContainer(containerID string, wait bool, dst io.Writer) (string, error
 	}
 
 	var waitErr error
+	var statusCode int64
 	ctx := context.Background()
 	if !wait {
 		var cancel context.CancelFunc
@@ -280,22 +424,27 @@ func startContainer(containerID string, wait bool, dst io.Writer) (string, error
 		} else {
 			removeContainer(containerID)
 		}
+		// Other containers might have been spawned concurrently.
+		removeHelperContainers()
 		exitWithCode(1)
 
 	case err := <-errCh:
 		waitErr = err
 
 	case exitCode := <-statusCh:
-		zypperExitCode = exitCode.StatusCode
+		statusCode = exitCode.StatusCode
+		exitCodeMutex.Lock()
+		zypperExitCode = statusCode
+		exitCodeMutex.Unlock()
 		if dst != nil {
 			<-sc
 		}
 	}
 	if waitErr != nil {
 		return containerID, waitErr
-	} else if zypperExitCode != 0 {
+	} else if statusCode != 0 {
 		return containerID, dockerError{
-			exitCode: zypperExitCode,
+			exitCode: statusCode,
 			err:      nil}
 	}
 	return containerID, waitErr
@@ -319,6 +468,16 @@ func getHostConfig() *container.HostConfig {
 func createContainer(img string, cmd []string) (string, error) {
 	client := getDockerClient()
 
+	// We need to run as root in order to run zypper commands. The user is
+	// only forced when the image sets another one, because the daemon fills
+	// the user of committed images with the one of the container when it's
+	// empty (see `commitContainerToImage`).
+	user := rootUser
+	if info, _, err := client.ImageInspectWithRaw(context.Background(), img); err == nil &&
+		(info.Config == nil || info.Config.User == "") {
+		user = ""
+	}
+
 	// First of all we create a container in which we will run the command.
 	config := &container.Config{
 		Image:        img,
@@ -326,8 +485,7 @@ func createContainer(img string, cmd []string) (string, error) {
 		Entrypoint:   []string{"/bin/sh", "-c"},
 		AttachStdout: true,
 		AttachStderr: true,
-		// We need to run as root in order to run zypper commands.
-		User: rootUser,
+		User:         user,
 		// required to avoid garbage when cmd overwrites the terminal
 		// like "zypper ref" does
 		Tty: true,
@@ -340,6 +498,7 @@ func createContainer(img string, cmd []string) (string, error) {
 	for _, warning := range resp.Warnings {
 		log.Print(warning)
 	}
+	trackContainer(resp.ID)
 	return resp.ID, nil
 }
 
@@ -354,35 +513,59 @@ func removeContainer(containerID string) {
 	})
 	if err != nil {
 		log.Println(err)
+		return
 	}
+	untrackContainer(containerID)
 }
 
 // commitContainerToImage commits the container with the given containerID
 // that is based on the given img into a new image. The given repo should also
-// contain the namespace. Returns the id of the created image.
-func commitContainerToImage(img, containerID, repo, tag, comment, author string) (string, error) {
+// contain the namespace. The given labels are added to the ones of the parent
+// image. Returns the id of the created image.
+func commitContainerToImage(img, containerID, repo, tag, comment, author string, labels map[string]string) (string, error) {
 	client := getDockerClient()
 
-	// First of all, we inspect the parent image and fetch the values for the
-	// entrypoint and the cmd. We do this to preserve them on the committed
-	// image. See issue: https://github.com/SUSE/zypper-docker/issues/75.
+	// First of all, we inspect the parent image and fetch its configuration,
+	// since the committed image has to be configured exactly as its parent.
+	// See issue: https://github.com/SUSE/zypper-docker/issues/75.
 	info, _, err := client.ImageInspectWithRaw(context.Background(), img)
 	if err != nil {
 		return "", fmt.Errorf("could not inspect image '%s': %v", img, err)
 	}
+	config := &container.Config{}
+	if info.Config != nil {
+		*config = *info.Config
+	}
 
-	user := info.Config.User
-	if user == "" {
-		// While images what have .Config.User set to "" run as root, we cannot
-		// explicity set it to this value. Instead, just set it to rootUser.
-		user = rootUser
+	if len(labels) > 0 {
+		merged := map[string]string{}
+		for k, v := range config.Labels {
+			merged[k] = v
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		config.Labels = merged
 	}
 
-	changes := []string{
-		"USER " + user,
-		"ENTRYPOINT " + joinAsArray(info.Config.Entrypoint, false),
-		"CMD " + joinAsArray(info.Config.Cmd, true),
+	// The Docker daemon fills the fields that are empty in the given
+	// configuration with the values of the container, which has been created
+	// with its own entrypoint and command. Hence, the user, the environment,
+	// the entrypoint and the command are also given as changes, so they are
+	// preserved even if they are empty. An empty user cannot be given as a
+	// change, but then the helper container doesn't set one either (see
+	// `createContainer`).
+	var changes []string
+	if config.User != "" {
+		changes = append(changes, "USER "+config.User)
 	}
+	for _, env := range config.Env {
+		changes = append(changes, "ENV "+envChange(env))
+	}
+	changes = append(changes,
+		"ENTRYPOINT "+joinAsArray(config.Entrypoint, false),
+		"CMD "+joinAsArray(config.Cmd, true),
+	)
 
 	var reference string
 	if repo != "" {
@@ -394,24 +577,56 @@ func commitContainerToImage(img, containerID, repo, tag, comment, author string)
 		Comment:   comment,
 		Author:    author,
 		Changes:   changes,
-		Config:    &container.Config{},
+		Config:    config,
 	})
 	return resp.ID, err
 }
 
+// envChange returns the given "KEY=value" environment variable in the syntax
+// of the ENV directive. The value is quoted, so spaces, quotes and dollar
+// signs are taken literally.
+func envChange(env string) string {
+	parts := strings.SplitN(env, "=", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+	value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(parts[1])
+	return parts[0] + `="` + value + `"`
+}
+
 // Spawns a container from the specified image, runs the specified command inside
 // of it and commits the results to a new image.
 // The name of the new image is specified via target_repo and target_tag.
 // The container is always deleted.
 // If something goes wrong an error message is returned.
+// The `beforeCommit` function, if any, is called once the command has run
+// successfully and right before committing. It returns the labels of the new
+// image, and the image is not committed if it returns an error.
 // Returns the ID of the new image on success.
-func runCommandAndCommitToImage(img, targetRepo, targetTag, cmd, comment, author string) (string, error) {
-	containerID, err := runCommandInContainer(img, []string{cmd}, os.Stdout)
+func runCommandAndCommitToImage(img, targetRepo, targetTag, cmd, comment, author string, beforeCommit commitHook) (string, error) {
+	return runCommandAndCommitToImageOutput(img, targetRepo, targetTag, cmd, comment, author, beforeCommit, os.Stdout)
+}
+
+// commitHook is a function called right before committing an image, which
+// returns the labels of the image.
+type commitHook func() (map[string]string, error)
+
+// runCommandAndCommitToImageOutput does the same as runCommandAndCommitToImage,
+// but the output of the command is written into the given writer.
+func runCommandAndCommitToImageOutput(img, targetRepo, targetTag, cmd, comment, author string, beforeCommit commitHook, dst io.Writer) (string, error) {
+	containerID, err := runCommandInContainer(img, []string{cmd}, dst)
 	if err != nil {
 		return "", err
 	}
 
-	imageID, err := commitContainerToImage(img, containerID, targetRepo, targetTag, comment, author)
+	var labels map[string]string
+	if beforeCommit != nil {
+		if labels, err = beforeCommit(); err != nil {
+			removeContainer(containerID)
+			return "", err
+		}
+	}
+	imageID, err := commitContainerToImage(img, containerID, targetRepo, targetTag, comment, author, labels)
 
 	// always remove the container
 	removeContainer(containerID)
@@ -485,7 +700,9 @@ func commitAndExecute(f commandFunc, ctx *cli.Context, containerID string) (stri
 		return "", err
 	}
 	// given commandFunc is executed.
+	setTemporaryImage(image.ID, true)
 	err = f(image.ID, ctx)
+	setTemporaryImage(image.ID, false)
 
 	removeOpts := types.ImageRemoveOptions{
 		Force:         true,
@@ -16,6 +16,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"log"
 	"os"
 	"reflect"
@@ -24,7 +25,9 @@ import (
 	"time"
 
 	"github.com/codegangsta/cli"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 	"github.com/mssola/capture"
 )
 
@@ -252,7 +255,8 @@ func TestRunCommandAndCommitToImageSuccess(t *testing.T) {
 			"new_tag",
 			"touch foo",
 			"comment",
-			"author")
+			"author",
+			nil)
 	})
 
 	if err != nil {
@@ -271,7 +275,8 @@ func TestRunCommandAndCommitToImageRunFailure(t *testing.T) {
 			"new_tag",
 			"touch foo",
 			"comment",
-			"author")
+			"author",
+			nil)
 	})
 
 	if err == nil {
@@ -293,7 +298,8 @@ func TestRunCommandAndCommitToImageCommitFailure(t *testing.T) {
 			"new_tag",
 			"touch foo",
 			"comment",
-			"author")
+			"author",
+			nil)
 	})
 
 	if err == nil {
@@ -304,6 +310,152 @@ func TestRunCommandAndCommitToImageCommitFailure(t *testing.T) {
 	}
 }
 
+func TestCommitContainerToImageConfig(t *testing.T) {
+	parent := &container.Config{
+		User:         "web:web",
+		ExposedPorts: nat.PortSet{"80/tcp": struct{}{}, "443/tcp": struct{}{}},
+		Env:          []string{"PATH=/usr/local/bin:/usr/bin:/bin", "APP_ENV=production", `GREETING=say "hi" to $USER\n`},
+		Cmd:          []string{"sh", "-c", "echo \"ready\" && exec server"},
+		Healthcheck: &container.HealthConfig{
+			Test:     []string{"CMD-SHELL", "curl -f http://localhost/ || exit 1"},
+			Interval: 30 * time.Second,
+			Retries:  3,
+		},
+		Image:       "sha256:parent",
+		Volumes:     map[string]struct{}{"/data": {}},
+		WorkingDir:  "/srv/app",
+		Entrypoint:  []string{"/entrypoint.sh"},
+		OnBuild:     []string{"RUN make"},
+		Labels:      map[string]string{"maintainer": "someone"},
+		StopSignal:  "SIGQUIT",
+		ArgsEscaped: true,
+	}
+	mock := &mockClient{imageConfig: parent}
+	safeClient.client = mock
+
+	id, err := createContainer("parent", []string{"zypper ref"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mock.lastConfig.User != rootUser {
+		t.Fatalf("The helper container should run as root, got %q", mock.lastConfig.User)
+	}
+	if _, err = commitContainerToImage("parent", id, "repo", "tag", "comment", "author", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	config := mock.lastCommit.Config
+	if config == nil {
+		t.Fatal("No configuration was given to the commit")
+	}
+	if config == parent {
+		t.Fatal("The configuration of the parent image should have been copied")
+	}
+	checkConfig(t, parent, config)
+
+	// The user, environment, entrypoint and command given as changes have to
+	// be the ones of the parent, and the resulting configuration must not
+	// contain anything from the helper container.
+	checkCommitChanges(t, mock.lastCommit.Changes, parent)
+	checkConfig(t, parent, mock.committedConfig)
+	if mock.lastCommit.Reference != "repo:tag" || mock.lastCommit.Author != "author" ||
+		mock.lastCommit.Comment != "comment" {
+		t.Fatalf("Unexpected commit options: %+v", mock.lastCommit)
+	}
+}
+
+// checkConfig checks that all the fields of the given configuration are the
+// same as the ones of the expected one.
+func checkConfig(t *testing.T, expected, config *container.Config) {
+	e, got := reflect.ValueOf(*expected), reflect.ValueOf(*config)
+	for i := 0; i < e.NumField(); i++ {
+		name := e.Type().Field(i).Name
+		if !reflect.DeepEqual(e.Field(i).Interface(), got.Field(i).Interface()) {
+			t.Fatalf("Field %s differs: expected %v, got %v", name, e.Field(i).Interface(), got.Field(i).Interface())
+		}
+	}
+}
+
+// checkCommitChanges checks that the given changes of a commit set the user,
+// the environment, the entrypoint and the command of the given parent
+// configuration.
+func checkCommitChanges(t *testing.T, changes []string, parent *container.Config) {
+	found := map[string]bool{}
+	env := []string{}
+	for _, change := range changes {
+		parts := strings.SplitN(change, " ", 2)
+		if len(parts) != 2 {
+			t.Fatalf("Malformed change: %q", change)
+		}
+		found[parts[0]] = true
+
+		switch parts[0] {
+		case "USER":
+			if parts[1] != parent.User {
+				t.Fatalf("Expected user %q, got %q", parent.User, parts[1])
+			}
+		case "ENV":
+			variable, err := parseEnvChange(parts[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			env = append(env, variable)
+		case "ENTRYPOINT", "CMD":
+			expected := []string(parent.Entrypoint)
+			if parts[0] == "CMD" {
+				expected = parent.Cmd
+			}
+			var got []string
+			if parts[1] != "" {
+				if err := json.Unmarshal([]byte(parts[1]), &got); err != nil {
+					t.Fatalf("Change %q is not a JSON array: %v", change, err)
+				}
+			}
+			if len(got) != len(expected) || (len(got) > 0 && !reflect.DeepEqual(got, expected)) {
+				t.Fatalf("Expected %s %q, got %q", parts[0], expected, got)
+			}
+		default:
+			t.Fatalf("Unexpected change: %q", change)
+		}
+	}
+
+	if found["USER"] != (parent.User != "") || !found["ENTRYPOINT"] || !found["CMD"] {
+		t.Fatalf("Unexpected changes: %#v", changes)
+	}
+	if err := compareStringSlices(env, parent.Env); err != nil {
+		t.Fatalf("Unexpected environment: %v", err)
+	}
+}
+
+func TestCommitContainerToImageEmptyConfig(t *testing.T) {
+	parent := &container.Config{Image: "sha256:parent", Cmd: []string{"/bin/bash"}}
+	mock := &mockClient{imageConfig: parent}
+	safeClient.client = mock
+
+	// The image doesn't set a user, so the helper container doesn't either:
+	// otherwise its user would end up in the committed image.
+	id, err := createContainer("parent", []string{"zypper ref"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mock.lastConfig.User != "" {
+		t.Fatalf("Unexpected user for the helper container: %q", mock.lastConfig.User)
+	}
+	if _, err = commitContainerToImage("parent", id, "", "", "", "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The empty user and environment are not given as changes.
+	checkCommitChanges(t, mock.lastCommit.Changes, parent)
+	if len(mock.lastCommit.Changes) != 2 {
+		t.Fatalf("Unexpected changes: %#v", mock.lastCommit.Changes)
+	}
+
+	expected := *parent
+	expected.Entrypoint = []string{}
+	checkConfig(t, &expected, mock.committedConfig)
+}
+
 func TestCheckContainerRunningListContainersFailure(t *testing.T) {
 	safeClient.client = &mockClient{listFail: true}
 
@@ -427,3 +579,31 @@ func TestHostConfig(t *testing.T) {
 		t.Fatalf("Did not expect %v", hc.ExtraHosts[0])
 	}
 }
+
+func TestRemoveHelperContainers(t *testing.T) {
+	safeClient.client = &mockClient{}
+	helperContainers.ids = nil
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+
+	for _, img := range []string{"a", "b", "c"} {
+		if _, err := createContainer(img, []string{"zypper"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	removeContainer("zypper-docker-private-b")
+	if len(helperContainers.ids) != 2 {
+		t.Fatalf("Expected 2 tracked containers, got %v", helperContainers.ids)
+	}
+
+	removeHelperContainers()
+	if len(helperContainers.ids) != 0 {
+		t.Fatalf("Expected no tracked containers, got %v", helperContainers.ids)
+	}
+	testReaderData(t, buffer, []string{
+		"Removed container zypper-docker-private-b",
+		"Removed container zypper-docker-private-a",
+		"Removed container zypper-docker-private-c",
+	})
+}
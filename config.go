@@ -0,0 +1,380 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// The prefix of all the environment variables that provide default values
+// for flags.
+const envPrefix = "ZYPPER_DOCKER_"
+
+// config contains the default values for flags as read from the
+// configuration file. Flags are identified by their long name, and values are
+// given either as JSON scalars or, for flags that can be repeated, as arrays.
+// For example:
+//
+//   {
+//     "global": { "gpg-auto-import-keys": true, "add-host": ["registry:10.0.0.1"] },
+//     "commands": { "patch": { "author": "John Doe <john.doe@example.com>" } }
+//   }
+//
+// Subcommands are identified by their full name (e.g. "cache show").
+type config struct {
+	Global   map[string]interface{}            `json:"global"`
+	Commands map[string]map[string]interface{} `json:"commands"`
+}
+
+// defaultConfigPath returns the path of the configuration file to be used
+// when neither the `--config` flag nor the ZYPPER_DOCKER_CONFIG environment
+// variable have been given.
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "zypper-docker", "config.json")
+}
+
+// configPath returns the path of the configuration file and whether it has
+// been explicitly requested by the user. The `--config` flag is looked up in
+// the given arguments because it has to be known before they get parsed.
+func configPath(args []string) (string, bool) {
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if arg == "--config" || arg == "-config" {
+			if i+1 < len(args) {
+				return args[i+1], true
+			}
+			break
+		}
+		for _, prefix := range []string{"--config=", "-config="} {
+			if strings.HasPrefix(arg, prefix) {
+				return strings.TrimPrefix(arg, prefix), true
+			}
+		}
+	}
+
+	if path := os.Getenv(envPrefix + "CONFIG"); path != "" {
+		return path, true
+	}
+	return defaultConfigPath(), false
+}
+
+// readConfig reads the configuration file at the given path. A missing file
+// is only an error if it has been explicitly requested.
+func readConfig(path string, explicit bool) (*config, error) {
+	cfg := &config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	if err = json.NewDecoder(file).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %v", path, err)
+	}
+	return cfg, nil
+}
+
+// configureApp sets the default values of the flags of the given application
+// out of the configuration file and the environment. The precedence order is:
+// command line flags, environment variables, the configuration file and
+// finally the built-in defaults.
+func configureApp(app *cli.App, args []string) error {
+	path, explicit := configPath(args)
+	cfg, err := readConfig(path, explicit)
+	if err != nil {
+		return err
+	}
+	return applyConfig(app, cfg)
+}
+
+// applyConfig applies the given configuration to the flags of the given
+// application and all of its commands. Unknown commands or flags in the
+// configuration are considered errors, so typos do not go unnoticed.
+func applyConfig(app *cli.App, cfg *config) error {
+	configuredFlags = map[string]bool{}
+
+	flags, slices, err := configureFlags(app.Flags, "", cfg.Global)
+	if err != nil {
+		return fmt.Errorf("global options: %v", err)
+	}
+	app.Flags = flags
+	if len(slices) > 0 {
+		app.Before = sliceDefaults(app.Before, slices)
+	}
+
+	known := map[string]bool{}
+	if err = configureCommands(app.Commands, "", cfg.Commands, known); err != nil {
+		return err
+	}
+	for name := range cfg.Commands {
+		if !known[name] {
+			return fmt.Errorf("unknown command '%s' in the configuration", name)
+		}
+	}
+	return nil
+}
+
+// configureCommands applies the given per-command values to the given
+// commands and their subcommands. The names of the visited commands are
+// recorded in `known`.
+func configureCommands(commands []cli.Command, parent string, values map[string]map[string]interface{}, known map[string]bool) error {
+	for i := range commands {
+		name := strings.TrimSpace(parent + " " + commands[i].Name)
+		known[name] = true
+
+		flags, slices, err := configureFlags(commands[i].Flags, name, values[name])
+		if err != nil {
+			return fmt.Errorf("command '%s': %v", name, err)
+		}
+		commands[i].Flags = flags
+		if len(slices) > 0 {
+			commands[i].Before = sliceDefaults(commands[i].Before, slices)
+		}
+
+		if err = configureCommands(commands[i].Subcommands, name, values, known); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagEnvVar returns the name of the environment variable that provides the
+// default value of the given flag of the given command (empty for global
+// flags). For example, the `--author` flag of the patch command can be set
+// through ZYPPER_DOCKER_PATCH_AUTHOR.
+func flagEnvVar(command, flag string) string {
+	name := strings.TrimSpace(command + " " + flag)
+	name = strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+	return envPrefix + strings.ToUpper(name)
+}
+
+// longName returns the long name of a flag out of its full name (e.g.
+// "force" out of "f, force").
+func longName(flag cli.Flag) string {
+	name := ""
+	for _, part := range strings.Split(flag.GetName(), ",") {
+		part = strings.TrimSpace(part)
+		if len(part) > len(name) {
+			name = part
+		}
+	}
+	return name
+}
+
+// configuredFlags contains the string flags whose default value has been
+// given by the configuration file, identified by their environment variable.
+var configuredFlags = map[string]bool{}
+
+// hasConfiguredDefault returns whether the default value of the given flag of
+// the command being run comes from the configuration file. The flag can be
+// given by any of its names.
+func hasConfiguredDefault(ctx *cli.Context, name string) bool {
+	for _, flag := range ctx.Command.Flags {
+		for _, part := range strings.Split(flag.GetName(), ",") {
+			if strings.TrimSpace(part) == name {
+				return configuredFlags[flagEnvVar(ctx.Command.FullName(), longName(flag))]
+			}
+		}
+	}
+	return false
+}
+
+// sliceDefault contains the default values of a slice flag: the environment
+// variable that may provide them and the values given by the configuration
+// file.
+type sliceDefault struct {
+	env    string
+	values []string
+}
+
+// sliceDefaults returns a function to be run before the action of a command,
+// which sets the default values of the given slice flags that have not been
+// given in the command line. The values of the environment variable take
+// precedence over the ones from the configuration file. These cannot be set
+// as the default values of the flags (nor through their EnvVar) because the
+// values given in the command line would be appended to them. The given
+// function, if any, is called afterwards.
+func sliceDefaults(before cli.BeforeFunc, defaults map[string]sliceDefault) cli.BeforeFunc {
+	return func(ctx *cli.Context) error {
+		for name, def := range defaults {
+			if ctx.IsSet(name) {
+				continue
+			}
+			values := def.values
+			if env := os.Getenv(def.env); env != "" {
+				values = nil
+				for _, value := range strings.Split(env, ",") {
+					values = append(values, strings.TrimSpace(value))
+				}
+			}
+			for _, value := range values {
+				if err := ctx.Set(name, value); err != nil {
+					return err
+				}
+			}
+		}
+		if before != nil {
+			return before(ctx)
+		}
+		return nil
+	}
+}
+
+// configureFlags returns the given flags after setting their environment
+// variables and the default values given in `values`. The defaults of slice
+// flags are returned separately, since they have to be set once the command
+// line has been parsed (see `sliceDefaults`).
+func configureFlags(flags []cli.Flag, command string, values map[string]interface{}) ([]cli.Flag, map[string]sliceDefault, error) {
+	slices := map[string]sliceDefault{}
+	known := map[string]bool{}
+	res := make([]cli.Flag, len(flags))
+
+	for i, flag := range flags {
+		name := longName(flag)
+		known[name] = true
+		env := flagEnvVar(command, name)
+		value, ok := values[name]
+
+		var err error
+		switch f := flag.(type) {
+		case cli.BoolFlag:
+			f.EnvVar = env
+			res[i] = f
+			if ok {
+				var b bool
+				if b, err = configBool(value); err == nil && b {
+					// There's no way to set the default value of a BoolFlag.
+					res[i] = cli.BoolTFlag{Name: f.Name, Usage: f.Usage, EnvVar: env, Hidden: f.Hidden}
+				}
+			}
+		case cli.StringFlag:
+			f.EnvVar = env
+			if ok {
+				f.Value, err = configString(value)
+				configuredFlags[env] = true
+			}
+			res[i] = f
+		case cli.IntFlag:
+			f.EnvVar = env
+			if ok {
+				var s string
+				if s, err = configString(value); err == nil {
+					f.Value, err = strconv.Atoi(s)
+				}
+			}
+			res[i] = f
+		case cli.DurationFlag:
+			f.EnvVar = env
+			if ok {
+				var s string
+				if s, err = configString(value); err == nil {
+					f.Value, err = time.ParseDuration(s)
+				}
+			}
+			res[i] = f
+		case cli.StringSliceFlag:
+			def := sliceDefault{env: env}
+			if ok {
+				def.values, err = configStrings(value)
+			}
+			slices[name] = def
+			res[i] = f
+		default:
+			if ok {
+				err = fmt.Errorf("flag '%s' cannot be configured", name)
+			}
+			res[i] = flag
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for '%s': %v", name, err)
+		}
+	}
+
+	for name := range values {
+		if !known[name] {
+			return nil, nil, fmt.Errorf("unknown flag '%s'", name)
+		}
+	}
+	return res, slices, nil
+}
+
+// configString returns the given configuration value as it would be given on
+// the command line. Only scalars are accepted.
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("expected a scalar value, got '%v'", value)
+}
+
+// configBool returns the given configuration value as a boolean.
+func configBool(value interface{}) (bool, error) {
+	s, err := configString(value)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(s)
+}
+
+// configStrings returns the given configuration value as a list of strings.
+// Both arrays and single scalars are accepted.
+func configStrings(value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		s, err := configString(value)
+		return []string{s}, err
+	}
+
+	res := []string{}
+	for _, v := range list {
+		s, err := configString(v)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// configTestApp returns an application with some flags of each type and a
+// command whose action stores the context into `result`.
+func configTestApp(result **cli.Context) *cli.App {
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{Name: "f, force"},
+		cli.StringSliceFlag{Name: "add-host"},
+		cli.DurationFlag{Name: "scan-ttl", Value: time.Hour},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name: "patch",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "author", Value: "builtin"},
+				cli.IntFlag{Name: "parallel", Value: 1},
+				cli.BoolFlag{Name: "no-recommends"},
+			},
+			Action: func(ctx *cli.Context) { *result = ctx },
+		},
+	}
+	return app
+}
+
+func TestConfigPath(t *testing.T) {
+	oldXDG, oldEnv := os.Getenv("XDG_CONFIG_HOME"), os.Getenv("ZYPPER_DOCKER_CONFIG")
+	defer func() {
+		_ = os.Setenv("XDG_CONFIG_HOME", oldXDG)
+		_ = os.Setenv("ZYPPER_DOCKER_CONFIG", oldEnv)
+	}()
+	_ = os.Unsetenv("ZYPPER_DOCKER_CONFIG")
+	_ = os.Setenv("XDG_CONFIG_HOME", "/xdg")
+
+	tests := []struct {
+		args     []string
+		path     string
+		explicit bool
+	}{
+		{[]string{"zypper-docker", "images"}, "/xdg/zypper-docker/config.json", false},
+		{[]string{"zypper-docker", "--config", "/a.json", "images"}, "/a.json", true},
+		{[]string{"zypper-docker", "--config=/b.json", "images"}, "/b.json", true},
+		{[]string{"zypper-docker", "images", "--", "--config=/c.json"}, "/xdg/zypper-docker/config.json", false},
+	}
+	for _, test := range tests {
+		path, explicit := configPath(test.args)
+		if path != test.path || explicit != test.explicit {
+			t.Fatalf("Expected %v (%v) for %v, got %v (%v)", test.path, test.explicit, test.args, path, explicit)
+		}
+	}
+
+	_ = os.Setenv("ZYPPER_DOCKER_CONFIG", "/env.json")
+	if path, explicit := configPath([]string{"zypper-docker"}); path != "/env.json" || !explicit {
+		t.Fatalf("Unexpected path: %v (%v)", path, explicit)
+	}
+	if path, _ := configPath([]string{"zypper-docker", "--config", "/a.json"}); path != "/a.json" {
+		t.Fatalf("The flag should have precedence, got: %v", path)
+	}
+
+	_ = os.Unsetenv("XDG_CONFIG_HOME")
+	if path := defaultConfigPath(); path != filepath.Join(os.Getenv("HOME"), ".config", "zypper-docker", "config.json") {
+		t.Fatalf("Unexpected default path: %v", path)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zypper-docker-config")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	missing := filepath.Join(dir, "missing.json")
+	if cfg, err := readConfig(missing, false); err != nil || cfg.Global != nil {
+		t.Fatalf("A missing default file should be ignored: %v", err)
+	}
+	if _, err := readConfig(missing, true); err == nil {
+		t.Fatal("A missing explicit file should be an error")
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	_ = ioutil.WriteFile(bad, []byte("{"), 0644)
+	if _, err := readConfig(bad, false); err == nil || !strings.Contains(err.Error(), "could not parse") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	vars := []string{"ZYPPER_DOCKER_PATCH_AUTHOR", "ZYPPER_DOCKER_SCAN_TTL", "ZYPPER_DOCKER_PATCH_NO_RECOMMENDS"}
+	for _, v := range vars {
+		_ = os.Unsetenv(v)
+	}
+	defer func() {
+		for _, v := range vars {
+			_ = os.Unsetenv(v)
+		}
+	}()
+
+	cfg := &config{
+		Global: map[string]interface{}{
+			"force":    true,
+			"add-host": []interface{}{"registry:10.0.0.1"},
+			"scan-ttl": "2h",
+		},
+		Commands: map[string]map[string]interface{}{
+			"patch": {"author": "file", "parallel": float64(8), "no-recommends": true},
+		},
+	}
+
+	var ctx *cli.Context
+	app := configTestApp(&ctx)
+	if err := applyConfig(app, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Values from the file.
+	_ = app.Run([]string{"zypper-docker", "patch"})
+	if ctx.String("author") != "file" || ctx.Int("parallel") != 8 || !ctx.Bool("no-recommends") {
+		t.Fatalf("Unexpected command flags: %v %v %v", ctx.String("author"), ctx.Int("parallel"), ctx.Bool("no-recommends"))
+	}
+	if !ctx.GlobalBool("force") || ctx.GlobalDuration("scan-ttl") != 2*time.Hour ||
+		strings.Join(ctx.GlobalStringSlice("add-host"), ",") != "registry:10.0.0.1" {
+		t.Fatalf("Unexpected global flags: %v %v %v", ctx.GlobalBool("force"),
+			ctx.GlobalDuration("scan-ttl"), ctx.GlobalStringSlice("add-host"))
+	}
+
+	// The environment has precedence over the file.
+	_ = os.Setenv("ZYPPER_DOCKER_PATCH_AUTHOR", "env")
+	_ = os.Setenv("ZYPPER_DOCKER_SCAN_TTL", "3h")
+	_ = os.Setenv("ZYPPER_DOCKER_PATCH_NO_RECOMMENDS", "false")
+	_ = app.Run([]string{"zypper-docker", "patch"})
+	if ctx.String("author") != "env" || ctx.GlobalDuration("scan-ttl") != 3*time.Hour || ctx.Bool("no-recommends") {
+		t.Fatalf("Unexpected flags: %v %v %v", ctx.String("author"), ctx.GlobalDuration("scan-ttl"), ctx.Bool("no-recommends"))
+	}
+
+	// And flags have precedence over everything else.
+	_ = app.Run([]string{"zypper-docker", "--scan-ttl", "4h", "patch", "--author", "flag", "--no-recommends"})
+	if ctx.String("author") != "flag" || ctx.GlobalDuration("scan-ttl") != 4*time.Hour || !ctx.Bool("no-recommends") {
+		t.Fatalf("Unexpected flags: %v %v %v", ctx.String("author"), ctx.GlobalDuration("scan-ttl"), ctx.Bool("no-recommends"))
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	tests := []struct {
+		cfg *config
+		msg string
+	}{
+		{&config{Global: map[string]interface{}{"unknown": true}}, "unknown flag 'unknown'"},
+		{&config{Global: map[string]interface{}{"force": "maybe"}}, "invalid value for 'force'"},
+		{&config{Global: map[string]interface{}{"scan-ttl": "forever"}}, "invalid value for 'scan-ttl'"},
+		{&config{Commands: map[string]map[string]interface{}{"pach": {}}}, "unknown command 'pach'"},
+		{&config{Commands: map[string]map[string]interface{}{"patch": {"parallel": "many"}}}, "command 'patch'"},
+		{&config{Commands: map[string]map[string]interface{}{"patch": {"author": []interface{}{"a"}}}}, "expected a scalar"},
+	}
+
+	for _, test := range tests {
+		var ctx *cli.Context
+		err := applyConfig(configTestApp(&ctx), test.cfg)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Fatalf("Expected an error containing '%s', got: %v", test.msg, err)
+		}
+	}
+}
+
+func TestConfigureAppSubcommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zypper-docker-config")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	contents := `{"commands": {"cache show": {"format": "json"}, "patch": {"author": "Jane"}}}`
+	_ = ioutil.WriteFile(path, []byte(contents), 0644)
+
+	app := newApp()
+	if err = configureApp(app, []string{"zypper-docker", "--config", path}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, cmd := range app.Commands {
+		if cmd.Name == "patch" {
+			for _, flag := range cmd.Flags {
+				if f, ok := flag.(cli.StringFlag); ok && f.Name == "author" {
+					if f.Value != "Jane" || f.EnvVar != "ZYPPER_DOCKER_PATCH_AUTHOR" {
+						t.Fatalf("Unexpected flag: %+v", f)
+					}
+				}
+			}
+		}
+		if cmd.Name == "cache" {
+			f := cmd.Subcommands[0].Flags[0].(cli.StringFlag)
+			if f.Value != "json" || f.EnvVar != "ZYPPER_DOCKER_CACHE_SHOW_FORMAT" {
+				t.Fatalf("Unexpected flag: %+v", f)
+			}
+		}
+	}
+}
+
+func TestApplyConfigStringSlices(t *testing.T) {
+	_ = os.Unsetenv("ZYPPER_DOCKER_ADD_HOST")
+	_ = os.Unsetenv("ZYPPER_DOCKER_IMAGES_FILTER")
+	defer func() {
+		_ = os.Unsetenv("ZYPPER_DOCKER_ADD_HOST")
+		_ = os.Unsetenv("ZYPPER_DOCKER_IMAGES_FILTER")
+	}()
+
+	cfg := &config{
+		Global: map[string]interface{}{"add-host": []interface{}{"a:1.1.1.1"}},
+		Commands: map[string]map[string]interface{}{
+			"images": {"filter": []interface{}{"reference=opensuse/*"}},
+		},
+	}
+
+	var ctx *cli.Context
+	app := newApp()
+	for i := range app.Commands {
+		if app.Commands[i].Name == "images" {
+			app.Commands[i].Action = func(c *cli.Context) { ctx = c }
+		}
+	}
+	if err := applyConfig(app, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Values from the file.
+	if err := app.Run([]string{"zypper-docker", "images"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hosts := strings.Join(ctx.GlobalStringSlice("add-host"), ","); hosts != "a:1.1.1.1" {
+		t.Fatalf("Unexpected hosts: %v", hosts)
+	}
+	if filters := strings.Join(ctx.StringSlice("filter"), ","); filters != "reference=opensuse/*" {
+		t.Fatalf("Unexpected filters: %v", filters)
+	}
+
+	// Values from the command line replace the ones from the file.
+	args := []string{"zypper-docker", "--add-host", "b:2.2.2.2", "images", "--filter", "label=a=b"}
+	if err := app.Run(args); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hosts := strings.Join(ctx.GlobalStringSlice("add-host"), ","); hosts != "b:2.2.2.2" {
+		t.Fatalf("Unexpected hosts: %v", hosts)
+	}
+	if filters := strings.Join(ctx.StringSlice("filter"), ","); filters != "label=a=b" {
+		t.Fatalf("Unexpected filters: %v", filters)
+	}
+
+	// The environment has precedence over the file.
+	_ = os.Setenv("ZYPPER_DOCKER_ADD_HOST", "c:3.3.3.3, d:4.4.4.4")
+	_ = os.Setenv("ZYPPER_DOCKER_IMAGES_FILTER", "dangling=false")
+	if err := app.Run([]string{"zypper-docker", "images"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hosts := strings.Join(ctx.GlobalStringSlice("add-host"), ","); hosts != "c:3.3.3.3,d:4.4.4.4" {
+		t.Fatalf("Unexpected hosts: %v", hosts)
+	}
+	if filters := strings.Join(ctx.StringSlice("filter"), ","); filters != "dangling=false" {
+		t.Fatalf("Unexpected filters: %v", filters)
+	}
+
+	// And values from the command line replace the ones from the environment.
+	if err := app.Run(args); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hosts := strings.Join(ctx.GlobalStringSlice("add-host"), ","); hosts != "b:2.2.2.2" {
+		t.Fatalf("Unexpected hosts: %v", hosts)
+	}
+	if filters := strings.Join(ctx.StringSlice("filter"), ","); filters != "label=a=b" {
+		t.Fatalf("Unexpected filters: %v", filters)
+	}
+}
+
+func TestHasConfiguredDefaultSubcommands(t *testing.T) {
+	cfg := &config{
+		Commands: map[string]map[string]interface{}{
+			"cache show": {"format": "json"},
+		},
+	}
+
+	configured, checked := false, false
+	app := newApp()
+	for i := range app.Commands {
+		if app.Commands[i].Name != "cache" {
+			continue
+		}
+		for j := range app.Commands[i].Subcommands {
+			if app.Commands[i].Subcommands[j].Name == "show" {
+				app.Commands[i].Subcommands[j].Action = func(c *cli.Context) {
+					configured, checked = hasConfiguredDefault(c, "format"), true
+				}
+			}
+		}
+	}
+	if err := applyConfig(app, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() { configuredFlags = map[string]bool{} }()
+
+	if err := app.Run([]string{"zypper-docker", "cache", "show"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !checked || !configured {
+		t.Fatalf("The configured default of 'cache show --format' was not recognized (run: %v)", checked)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+)
+
+// packageChange describes how a package differs between two images. Old is
+// empty for added packages and New is empty for removed ones.
+type packageChange struct {
+	Name string `json:"name"`
+	Arch string `json:"arch"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// packageDiff is the JSON document printed by the diff command.
+type packageDiff struct {
+	Added      []packageChange `json:"added"`
+	Removed    []packageChange `json:"removed"`
+	Upgraded   []packageChange `json:"upgraded"`
+	Downgraded []packageChange `json:"downgraded"`
+}
+
+// diffPackages computes the differences between the packages of two images.
+// Packages are identified by their name and architecture. When multiple
+// versions of the same package are installed (e.g. the kernel), the versions
+// that are only present in one of the images are considered to be added or
+// removed, unless only one version remains on each side.
+func diffPackages(before, after []rpmPackage) packageDiff {
+	diff := packageDiff{
+		Added:      []packageChange{},
+		Removed:    []packageChange{},
+		Upgraded:   []packageChange{},
+		Downgraded: []packageChange{},
+	}
+
+	oldByKey, newByKey := groupPackages(before), groupPackages(after)
+	keys := []string{}
+	for key := range oldByKey {
+		keys = append(keys, key)
+	}
+	for key := range newByKey {
+		if _, ok := oldByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		removed, added := subtractPackages(oldByKey[key], newByKey[key]), subtractPackages(newByKey[key], oldByKey[key])
+
+		if len(removed) == 1 && len(added) == 1 {
+			change := packageChange{Name: added[0].Name, Arch: added[0].Arch, Old: removed[0].evr(), New: added[0].evr()}
+			if added[0].compare(removed[0]) > 0 {
+				diff.Upgraded = append(diff.Upgraded, change)
+			} else {
+				diff.Downgraded = append(diff.Downgraded, change)
+			}
+			continue
+		}
+		for _, pkg := range removed {
+			diff.Removed = append(diff.Removed, packageChange{Name: pkg.Name, Arch: pkg.Arch, Old: pkg.evr()})
+		}
+		for _, pkg := range added {
+			diff.Added = append(diff.Added, packageChange{Name: pkg.Name, Arch: pkg.Arch, New: pkg.evr()})
+		}
+	}
+	return diff
+}
+
+// groupPackages groups the given packages by name and architecture.
+func groupPackages(packages []rpmPackage) map[string][]rpmPackage {
+	groups := map[string][]rpmPackage{}
+	for _, pkg := range packages {
+		key := pkg.Name + "." + pkg.Arch
+		groups[key] = append(groups[key], pkg)
+	}
+	return groups
+}
+
+// subtractPackages returns the packages in a that have no package with the
+// same version in b.
+func subtractPackages(a, b []rpmPackage) []rpmPackage {
+	res := []rpmPackage{}
+	for _, pkg := range a {
+		found := false
+		for _, other := range b {
+			if pkg.compare(other) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, pkg)
+		}
+	}
+	return res
+}
+
+// printPackageDiff prints the given differences in a table, followed by a
+// summary line.
+func printPackageDiff(diff packageDiff) {
+	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(writer, "PACKAGE\tARCH\tCHANGE\tOLD VERSION\tNEW VERSION")
+
+	groups := []struct {
+		name    string
+		changes []packageChange
+	}{
+		{"added", diff.Added},
+		{"removed", diff.Removed},
+		{"upgraded", diff.Upgraded},
+		{"downgraded", diff.Downgraded},
+	}
+	for _, group := range groups {
+		for _, change := range group.changes {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", change.Name, change.Arch, group.name,
+				valueOrDash(change.Old), valueOrDash(change.New))
+		}
+	}
+	writer.Flush()
+
+	fmt.Printf("\n%d added, %d removed, %d upgraded, %d downgraded.\n",
+		len(diff.Added), len(diff.Removed), len(diff.Upgraded), len(diff.Downgraded))
+}
+
+// zypper-docker diff [flags] <image> <image>
+func diffCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 2 {
+		logAndFatalf("Wrong invocation: expected 2 arguments, %d given.\n", len(ctx.Args()))
+		return
+	}
+	if !checkFormat(ctx, formatJSON) {
+		return
+	}
+
+	lists := [][]rpmPackage{}
+	for _, img := range ctx.Args() {
+		packages, err := fetchPackages(img)
+		if err != nil {
+			logAndFatalf("Could not list the packages of image '%s': %v.\n", img, err)
+			return
+		}
+		lists = append(lists, packages)
+	}
+
+	diff := diffPackages(lists[0], lists[1])
+	if ctx.String("format") == formatJSON {
+		if err := printJSON(diff); err != nil {
+			logAndFatalf("Error: %v.\n", err)
+			return
+		}
+	} else {
+		printPackageDiff(diff)
+	}
+	exitWithCode(0)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const (
+	testPackagesBefore = "bash\t(none)\t4.4\t9.3\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"curl\t(none)\t7.60.0\t3.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"kernel-default\t(none)\t4.12.14\t1.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"kernel-default\t(none)\t4.12.14\t2.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"vim\t(none)\t8.0.1568\t5.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"zlib\t(none)\t1.2.11\t3.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n"
+	testPackagesAfter = "bash\t(none)\t4.4\t9.3\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"curl\t(none)\t7.60.0\t11.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"kernel-default\t(none)\t4.12.14\t2.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"kernel-default\t(none)\t4.12.14\t3.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"libcurl4\t(none)\t7.60.0\t11.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n" +
+		"zlib\t(none)\t1.2.8\t1.1\tx86_64\tGPL-2.0-only\tSUSE LLC <https://www.suse.com/>\t(none)\t1527811200\n"
+)
+
+func TestDiffPackages(t *testing.T) {
+	before, _ := parsePackages(testPackagesBefore)
+	after, _ := parsePackages(testPackagesAfter)
+	diff := diffPackages(before, after)
+
+	expected := packageDiff{
+		Added:      []packageChange{{Name: "libcurl4", Arch: "x86_64", New: "7.60.0-11.1"}},
+		Removed:    []packageChange{{Name: "vim", Arch: "x86_64", Old: "8.0.1568-5.1"}},
+		Upgraded:   []packageChange{{Name: "curl", Arch: "x86_64", Old: "7.60.0-3.1", New: "7.60.0-11.1"}, {Name: "kernel-default", Arch: "x86_64", Old: "4.12.14-1.1", New: "4.12.14-3.1"}},
+		Downgraded: []packageChange{{Name: "zlib", Arch: "x86_64", Old: "1.2.11-3.1", New: "1.2.8-1.1"}},
+	}
+	got, _ := json.Marshal(diff)
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Fatalf("Unexpected diff:\n%s\nexpected:\n%s", got, want)
+	}
+
+	if diff = diffPackages(before, before); len(diff.Added)+len(diff.Removed)+len(diff.Upgraded)+len(diff.Downgraded) != 0 {
+		t.Fatalf("Identical images should have no differences: %+v", diff)
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	client := &mockClient{logOutputs: map[string]string{
+		"zypper-docker-private-opensuse:42.3":  testPackagesBefore,
+		"zypper-docker-private-opensuse:patch": testPackagesAfter,
+	}}
+
+	stdout, _ := runCommand(client, "diff", "opensuse:42.3", "opensuse:patch")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+	lines := strings.Split(stdout, "\n")
+	if !strings.HasPrefix(lines[0], "PACKAGE") || !strings.Contains(lines[0], "NEW VERSION") {
+		t.Fatalf("Unexpected header: %s", lines[0])
+	}
+	if strings.Join(strings.Fields(lines[1]), " ") != "libcurl4 x86_64 added - 7.60.0-11.1" {
+		t.Fatalf("Unexpected line: %s", lines[1])
+	}
+	if !strings.Contains(stdout, "1 added, 1 removed, 2 upgraded, 1 downgraded.") {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+	if cmd := strings.Join(client.lastCmd, ""); !strings.HasPrefix(cmd, "rpm -qa --qf") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+
+	stdout, _ = runCommand(client, "diff", "--format", "json", "opensuse:42.3", "opensuse:patch")
+	diff := packageDiff{}
+	if err := json.Unmarshal([]byte(stdout), &diff); err != nil {
+		t.Fatalf("Could not decode the JSON output: %v\n%s", err, stdout)
+	}
+	if len(diff.Upgraded) != 2 || diff.Upgraded[0].Name != "curl" {
+		t.Fatalf("Unexpected diff: %+v", diff)
+	}
+}
+
+func TestDiffCommandErrors(t *testing.T) {
+	_, logged := runCommand(&mockClient{}, "diff", "opensuse:42.3")
+	if lastCode != 1 || !strings.Contains(logged, "expected 2 arguments, 1 given") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{}, "diff", "--format", "yaml", "a", "b")
+	if lastCode != 1 || !strings.Contains(logged, "unknown format 'yaml'") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{startFail: true}, "diff", "opensuse:42.3", "opensuse:patch")
+	if lastCode != 1 || !strings.Contains(logged, "Could not list the packages of image 'opensuse:42.3'") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	// Images without rpm.
+	_, logged = runCommand(&mockClient{}, "diff", "opensuse:42.3", "opensuse:patch")
+	if lastCode != 1 || !strings.Contains(logged, "no packages were found") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// dryRunReport contains what a patch or an update would do to an image.
+type dryRunReport struct {
+	Patches        []zypperSolvable
+	Packages       packageDiff
+	DownloadSize   int64
+	SpaceUsageDiff int64
+
+	// Licenses contains the license agreements that have to be accepted,
+	// Problems the dependency problems that the solver could not fix on its
+	// own and Errors the rest of errors reported by zypper.
+	Licenses []string
+	Problems []string
+	Errors   []string
+
+	// RestartNeeded is true when the package manager itself has to be updated
+	// first. In this case, only the update stack is listed.
+	RestartNeeded bool
+}
+
+// newDryRunReport builds the report of the given output of a zypper install
+// operation run with `--xmlout` and `--dry-run`.
+func newDryRunReport(stream *zypperStream) *dryRunReport {
+	report := &dryRunReport{
+		Patches: []zypperSolvable{},
+		Packages: packageDiff{
+			Added:      []packageChange{},
+			Removed:    []packageChange{},
+			Upgraded:   []packageChange{},
+			Downgraded: []packageChange{},
+		},
+	}
+
+	if summary := stream.Summary; summary != nil {
+		report.DownloadSize = summary.DownloadSize
+		report.SpaceUsageDiff = summary.SpaceUsageDiff
+
+		for _, s := range summary.Install {
+			if s.Type == "patch" {
+				report.Patches = append(report.Patches, s)
+			}
+		}
+		groups := []struct {
+			solvables []zypperSolvable
+			changes   *[]packageChange
+		}{
+			{summary.Install, &report.Packages.Added},
+			{summary.Upgrade, &report.Packages.Upgraded},
+			{summary.Downgrade, &report.Packages.Downgraded},
+		}
+		for _, group := range groups {
+			for _, s := range packagesOnly(group.solvables) {
+				*group.changes = append(*group.changes,
+					packageChange{Name: s.Name, Arch: s.Arch, Old: s.OldEdition, New: s.Edition})
+			}
+		}
+		// The edition of the packages to be removed is the installed one.
+		for _, s := range packagesOnly(summary.Remove) {
+			report.Packages.Removed = append(report.Packages.Removed,
+				packageChange{Name: s.Name, Arch: s.Arch, Old: s.Edition})
+		}
+	}
+
+	for _, msg := range stream.Messages {
+		text := strings.TrimSpace(msg.Text)
+		switch {
+		case strings.HasPrefix(text, "Problem:"):
+			report.Problems = append(report.Problems, text)
+		case strings.Contains(text, "license agreement"):
+			report.Licenses = append(report.Licenses, firstLine(text))
+		case msg.Type == "error":
+			report.Errors = append(report.Errors, text)
+		}
+	}
+	return report
+}
+
+// packagesOnly returns the given solvables which are packages.
+func packagesOnly(solvables []zypperSolvable) []zypperSolvable {
+	packages := []zypperSolvable{}
+	for _, s := range solvables {
+		if s.Type == "package" {
+			packages = append(packages, s)
+		}
+	}
+	return packages
+}
+
+// firstLine returns the first line of the given text.
+func firstLine(text string) string {
+	if idx := strings.Index(text, "\n"); idx >= 0 {
+		return strings.TrimSpace(text[:idx])
+	}
+	return text
+}
+
+// signedSize returns a human readable representation of the given size in
+// bytes, always prefixed by its sign unless it's zero.
+func signedSize(size int64) string {
+	switch {
+	case size > 0:
+		return "+" + units.HumanSize(float64(size))
+	case size < 0:
+		return "-" + units.HumanSize(float64(-size))
+	}
+	return "0B"
+}
+
+// print prints the given report to the standard output.
+func (report *dryRunReport) print() {
+	if len(report.Patches) > 0 {
+		fmt.Printf("The following %d patches would be installed:\n", len(report.Patches))
+		for _, p := range report.Patches {
+			fmt.Printf("  %s %s\n", p.Name, strings.TrimSpace(p.Summary))
+		}
+		fmt.Println()
+	}
+
+	printPackageDiff(report.Packages)
+	fmt.Printf("Download size: %s. Installed size change: %s.\n",
+		units.HumanSize(float64(report.DownloadSize)), signedSize(report.SpaceUsageDiff))
+
+	if report.RestartNeeded {
+		fmt.Println("\nThe package manager would be updated first. Run it again afterwards to get the rest of changes.")
+	}
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"License agreements to be accepted (see --auto-agree-with-licenses):", report.Licenses},
+		{"Dependency problems:", report.Problems},
+		{"Errors:", report.Errors},
+	}
+	for _, section := range sections {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s\n", section.title)
+		for _, line := range section.lines {
+			fmt.Printf("  %s\n", strings.Replace(line, "\n", "\n  ", -1))
+		}
+	}
+}
+
+// dryRun runs the given zypper command, which is expected to be a patch or an
+// update in XML and dry-run modes, and prints what it would do. The helper
+// container is always removed, and neither the image nor the caches are
+// touched.
+func dryRun(img, cmd string) error {
+	id, err := createContainer(img, []string{cmd})
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	_, err = startContainer(id, true, buf)
+	removeContainer(id)
+
+	// Severe zypper errors (e.g. dependency problems) are still described in
+	// the XML output, so it's parsed in any case.
+	stream, parseErr := parseZypperXML(buf.String())
+	if parseErr != nil {
+		if err != nil {
+			return err
+		}
+		return parseErr
+	}
+
+	report := newDryRunReport(stream)
+	if de, ok := err.(dockerError); ok && de.exitCode == zypperExitInfRestartNeeded {
+		report.RestartNeeded = true
+	}
+	logAndPrintf("Dry run of %s: nothing will be committed.\n\n", img)
+	report.print()
+	return err
+}
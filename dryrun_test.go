@@ -0,0 +1,157 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDryRunXML = `<?xml version='1.0'?>
+<stream>
+<message type="info">Loading repository data...</message>
+<message type="info">Reading installed packages...</message>
+<message type="info">In order to install 'flash-player' (11.2.202.644-1.1), you must agree to terms of the following license agreement:
+Adobe Flash Player license</message>
+<install-summary download-size="1258291" space-usage-diff="-3565158" packages-to-change="3">
+<to-upgrade>
+<solvable type="package" name="curl" edition="7.60.0-11.1" arch="x86_64" edition-old="7.60.0-3.1" arch-old="x86_64" summary="A Tool for Transferring Data from URLs" repository="repo-update"/>
+</to-upgrade>
+<to-install>
+<solvable type="patch" name="openSUSE-2018-20" edition="1" arch="noarch" summary="Security update for curl" repository="repo-update"/>
+<solvable type="package" name="libcurl4" edition="7.60.0-11.1" arch="x86_64" summary="Library for Transferring Data from URLs" repository="repo-update"/>
+</to-install>
+<to-remove>
+<solvable type="package" name="libcurl3" edition="7.37.0-1.1" arch="x86_64" summary="Library for Transferring Data from URLs"/>
+</to-remove>
+</install-summary>
+<message type="error">Aborting installation due to the need for license confirmation.</message>
+</stream>
+`
+
+const testDryRunProblemXML = `<?xml version='1.0'?>
+<stream>
+<message type="info">Problem: nothing provides libfoo.so.1 needed by bar-1.0-1.1.x86_64
+ Solution 1: do not install patch:openSUSE-2018-30-1.noarch</message>
+<prompt id="11">
+<text>Choose from above solutions by number or cancel</text>
+</prompt>
+</stream>
+`
+
+func TestNewDryRunReport(t *testing.T) {
+	stream, err := parseZypperXML(testDryRunXML)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report := newDryRunReport(stream)
+
+	if len(report.Patches) != 1 || report.Patches[0].Name != "openSUSE-2018-20" {
+		t.Fatalf("Unexpected patches: %+v", report.Patches)
+	}
+	if len(report.Packages.Added) != 1 || report.Packages.Added[0] != (packageChange{Name: "libcurl4", Arch: "x86_64", New: "7.60.0-11.1"}) {
+		t.Fatalf("Unexpected added packages: %+v", report.Packages.Added)
+	}
+	if len(report.Packages.Upgraded) != 1 || report.Packages.Upgraded[0].Old != "7.60.0-3.1" {
+		t.Fatalf("Unexpected upgraded packages: %+v", report.Packages.Upgraded)
+	}
+	if len(report.Packages.Removed) != 1 || report.Packages.Removed[0] != (packageChange{Name: "libcurl3", Arch: "x86_64", Old: "7.37.0-1.1"}) {
+		t.Fatalf("Unexpected removed packages: %+v", report.Packages.Removed)
+	}
+	if report.DownloadSize != 1258291 || report.SpaceUsageDiff != -3565158 {
+		t.Fatalf("Unexpected sizes: %v, %v", report.DownloadSize, report.SpaceUsageDiff)
+	}
+	if len(report.Licenses) != 1 || strings.Contains(report.Licenses[0], "Adobe") {
+		t.Fatalf("Unexpected licenses: %v", report.Licenses)
+	}
+	if len(report.Errors) != 1 || len(report.Problems) != 0 {
+		t.Fatalf("Unexpected errors or problems: %v, %v", report.Errors, report.Problems)
+	}
+
+	stream, _ = parseZypperXML(testDryRunProblemXML)
+	report = newDryRunReport(stream)
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "Solution 1") {
+		t.Fatalf("Unexpected problems: %v", report.Problems)
+	}
+}
+
+func TestSignedSize(t *testing.T) {
+	if res := signedSize(1500000); res != "+1.5MB" {
+		t.Fatalf("Unexpected size: %s", res)
+	}
+	if res := signedSize(-1500000); res != "-1.5MB" {
+		t.Fatalf("Unexpected size: %s", res)
+	}
+	if res := signedSize(0); res != "0B" {
+		t.Fatalf("Unexpected size: %s", res)
+	}
+}
+
+func TestPatchDryRun(t *testing.T) {
+	mock := &mockClient{logOutput: testDryRunXML}
+	stdout, logged := runCommand(mock, "patch", "--dry-run", "--cve", "CVE-2018-1000300", "opensuse:13.2")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+
+	cmd := strings.Join(mock.lastCmd, "")
+	if !strings.Contains(cmd, "--xmlout patch --dry-run") || !strings.Contains(cmd, "--cve") || strings.Contains(cmd, "dry-run --dry-run") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+	if mock.lastCommit.Reference != "" || mock.lastCommit.Config != nil {
+		t.Fatalf("Nothing should have been committed: %+v", mock.lastCommit)
+	}
+	if !strings.Contains(logged, "Removed container zypper-docker-private-opensuse:13.2") {
+		t.Fatalf("The helper container should have been removed: %s", logged)
+	}
+
+	for _, expected := range []string{
+		"Dry run of opensuse:13.2: nothing will be committed.",
+		"The following 1 patches would be installed:\n  openSUSE-2018-20 Security update for curl",
+		"1 added, 1 removed, 1 upgraded, 0 downgraded.",
+		"Download size: 1.258MB. Installed size change: -3.565MB.",
+		"you must agree to terms of the following license agreement:",
+		"Aborting installation due to the need for license confirmation.",
+	} {
+		if !strings.Contains(stdout, expected) {
+			t.Fatalf("Expected '%s' in:\n%s", expected, stdout)
+		}
+	}
+	if strings.Contains(stdout, "Adobe") {
+		t.Fatalf("The license text should not be printed:\n%s", stdout)
+	}
+}
+
+func TestPatchDryRunFailure(t *testing.T) {
+	mock := &mockClient{logOutput: testDryRunProblemXML, commandFail: true, commandExit: zypperExitErrZyp}
+	stdout, logged := runCommand(mock, "patch", "--dry-run", "opensuse:13.2", "new:patched")
+
+	if !strings.Contains(stdout, "Dependency problems:\n  Problem: nothing provides libfoo.so.1") {
+		t.Fatalf("Unexpected output:\n%s", stdout)
+	}
+	if !strings.Contains(logged, "Could not execute command 'zypper patch' successfully in image 'opensuse:13.2'") ||
+		!strings.Contains(logged, "Removed container zypper-docker-private-opensuse:13.2") {
+		t.Fatalf("Unexpected log: %s", logged)
+	}
+	if mock.lastCommit.Reference != "" {
+		t.Fatalf("Nothing should have been committed: %+v", mock.lastCommit)
+	}
+
+	// Without --dry-run the new image is mandatory.
+	_, logged = runCommand(&mockClient{}, "patch", "opensuse:13.2")
+	if lastCode != 1 || !strings.Contains(logged, "expected 2 arguments, 1 given") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// defaultDockerSocket is the socket used by the Docker daemon by default.
+var defaultDockerSocket = "/var/run/docker.sock"
+
+// dockerEndpoint describes how to connect to a Docker daemon. An empty host
+// means that the environment variables of the docker CLI (e.g. DOCKER_HOST)
+// are to be used.
+type dockerEndpoint struct {
+	Host string
+
+	// Whether TLS has to be used, whether the certificate of the daemon has
+	// to be verified, and the paths of the certificates to be used.
+	TLS       bool
+	TLSVerify bool
+	CACert    string
+	Cert      string
+	Key       string
+}
+
+// resolveDockerEndpoint returns the endpoint of the Docker daemon to be used.
+// The following sources are checked in this specific order:
+//  1. The `--host` global flag, together with the TLS global flags.
+//  2. The docker CLI context given by the `--context` global flag.
+//  3. The DOCKER_HOST environment variable.
+//  4. The docker CLI context given by the DOCKER_CONTEXT environment variable
+//     or, if not set, the current context of the docker CLI configuration.
+//  5. The socket of a rootless daemon inside of $XDG_RUNTIME_DIR, but only if
+//     the default socket does not exist.
+// If none of them applies, then the environment variables are used, falling
+// back to the default socket.
+func resolveDockerEndpoint(ctx *cli.Context) (*dockerEndpoint, error) {
+	var host, name string
+	if ctx != nil {
+		host, name = ctx.GlobalString("host"), ctx.GlobalString("context")
+	}
+
+	switch {
+	case host != "" && name != "":
+		return nil, fmt.Errorf("conflicting options: either specify --host or --context, not both")
+	case host != "":
+		return tlsEndpoint(ctx, host)
+	case name != "":
+		return readDockerContext(name)
+	case os.Getenv("DOCKER_HOST") != "":
+		return &dockerEndpoint{}, nil
+	}
+
+	if name = currentDockerContext(); name != "" && name != "default" {
+		return readDockerContext(name)
+	}
+
+	if _, err := os.Stat(defaultDockerSocket); os.IsNotExist(err) {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+			socket := filepath.Join(dir, "docker.sock")
+			if _, err := os.Stat(socket); err == nil {
+				return &dockerEndpoint{Host: "unix://" + socket}, nil
+			}
+		}
+	}
+	return &dockerEndpoint{}, nil
+}
+
+// tlsEndpoint returns the endpoint for the given host, using the TLS options
+// given through the global flags. As it happens with the docker CLI, the
+// certificates default to the ones inside of the configuration directory.
+func tlsEndpoint(ctx *cli.Context, host string) (*dockerEndpoint, error) {
+	ep := &dockerEndpoint{
+		Host:      host,
+		TLSVerify: ctx.GlobalBool("tlsverify"),
+		CACert:    ctx.GlobalString("tlscacert"),
+		Cert:      ctx.GlobalString("tlscert"),
+		Key:       ctx.GlobalString("tlskey"),
+	}
+	ep.TLS = ep.TLSVerify || ep.CACert != "" || ep.Cert != "" || ep.Key != ""
+	if !ep.TLS {
+		return ep, nil
+	}
+
+	defaults := map[*string]string{&ep.CACert: "ca.pem", &ep.Cert: "cert.pem", &ep.Key: "key.pem"}
+	for value, name := range defaults {
+		if *value == "" {
+			if path := filepath.Join(dockerConfigDir(), name); fileExists(path) {
+				*value = path
+			}
+		}
+	}
+	return ep, nil
+}
+
+// dockerConfigDir returns the directory containing the configuration of the
+// docker CLI.
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker")
+}
+
+// currentDockerContext returns the name of the docker CLI context to be used
+// when none has been given explicitly. An empty string is returned if there is
+// none.
+func currentDockerContext() string {
+	if name := os.Getenv("DOCKER_CONTEXT"); name != "" {
+		return name
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if err != nil {
+		return ""
+	}
+	config := struct {
+		CurrentContext string `json:"currentContext"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return ""
+	}
+	return config.CurrentContext
+}
+
+// readDockerContext returns the endpoint of the docker CLI context with the
+// given name. The metadata of the context is read from the
+// "contexts/meta/<digest>/meta.json" file inside of the configuration
+// directory, and its TLS material (if any) from "contexts/tls/<digest>/docker".
+func readDockerContext(name string) (*dockerEndpoint, error) {
+	if name == "default" {
+		return &dockerEndpoint{}, nil
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	digest := hex.EncodeToString(sum[:])
+	contexts := filepath.Join(dockerConfigDir(), "contexts")
+
+	data, err := ioutil.ReadFile(filepath.Join(contexts, "meta", digest, "meta.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("context '%s' does not exist", name)
+		}
+		return nil, err
+	}
+
+	meta := struct {
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("could not parse the metadata of context '%s': %v", name, err)
+	}
+	docker, ok := meta.Endpoints["docker"]
+	if !ok || docker.Host == "" {
+		return nil, fmt.Errorf("context '%s' has no docker endpoint", name)
+	}
+	if strings.HasPrefix(docker.Host, "ssh://") {
+		return nil, fmt.Errorf("context '%s' uses an SSH endpoint, which is not supported", name)
+	}
+
+	ep := &dockerEndpoint{Host: docker.Host, TLSVerify: !docker.SkipTLSVerify}
+	tls := filepath.Join(contexts, "tls", digest, "docker")
+	for value, file := range map[*string]string{&ep.CACert: "ca.pem", &ep.Cert: "cert.pem", &ep.Key: "key.pem"} {
+		if path := filepath.Join(tls, file); fileExists(path) {
+			*value = path
+			ep.TLS = true
+		}
+	}
+	return ep, nil
+}
+
+// newDockerClient returns a client for the given endpoint. The environment
+// variables of the docker CLI are always taken into account, but the endpoint
+// has precedence over them. The API version is negotiated with the daemon,
+// unless it has been set explicitly through DOCKER_API_VERSION.
+func newDockerClient(ep *dockerEndpoint) (*client.Client, error) {
+	ops := []func(*client.Client) error{client.FromEnv}
+
+	if ep.TLS {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             ep.CACert,
+			CertFile:           ep.Cert,
+			KeyFile:            ep.Key,
+			InsecureSkipVerify: !ep.TLSVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsc},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	if ep.Host != "" {
+		ops = append(ops, client.WithHost(ep.Host))
+	}
+
+	dc, err := client.NewClientWithOpts(ops...)
+	if err != nil {
+		return nil, err
+	}
+	dc.NegotiateAPIVersion(context.Background())
+	return dc, nil
+}
+
+// fileExists returns whether the given path exists and is a regular file.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
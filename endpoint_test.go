@@ -0,0 +1,222 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+)
+
+// endpointContext returns a context in which the connection global flags
+// have been set with the given arguments.
+func endpointContext(args []string) *cli.Context {
+	globals := flag.NewFlagSet("global", 0)
+	globals.String("host", "", "doc")
+	globals.String("context", "", "doc")
+	globals.Bool("tlsverify", false, "doc")
+	globals.String("tlscacert", "", "doc")
+	globals.String("tlscert", "", "doc")
+	globals.String("tlskey", "", "doc")
+	_ = globals.Parse(args)
+	return cli.NewContext(nil, flag.NewFlagSet("test", 0), cli.NewContext(nil, globals, nil))
+}
+
+// setupDockerConfig creates a temporary docker CLI configuration directory
+// and clears all the environment variables affecting the endpoint. The
+// returned function restores the previous state.
+func setupDockerConfig(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "zypper-docker-config")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+
+	vars := []string{"DOCKER_CONFIG", "DOCKER_HOST", "DOCKER_CONTEXT", "XDG_RUNTIME_DIR"}
+	old := map[string]string{}
+	for _, v := range vars {
+		old[v] = os.Getenv(v)
+		_ = os.Unsetenv(v)
+	}
+	_ = os.Setenv("DOCKER_CONFIG", dir)
+	oldSocket := defaultDockerSocket
+
+	return dir, func() {
+		for _, v := range vars {
+			_ = os.Setenv(v, old[v])
+		}
+		defaultDockerSocket = oldSocket
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// writeDockerContext writes the metadata of a docker CLI context into the
+// given configuration directory. TLS material is written if requested.
+func writeDockerContext(t *testing.T, dir, name, meta string, tls bool) {
+	sum := sha256.Sum256([]byte(name))
+	digest := hex.EncodeToString(sum[:])
+
+	metaDir := filepath.Join(dir, "contexts", "meta", digest)
+	if err := os.MkdirAll(metaDir, 0755); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(meta), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	if tls {
+		tlsDir := filepath.Join(dir, "contexts", "tls", digest, "docker")
+		if err := os.MkdirAll(tlsDir, 0755); err != nil {
+			t.Fatalf("Could not create directory: %v", err)
+		}
+		for _, file := range []string{"ca.pem", "cert.pem", "key.pem"} {
+			if err := ioutil.WriteFile(filepath.Join(tlsDir, file), []byte("pem"), 0644); err != nil {
+				t.Fatalf("Could not write file: %v", err)
+			}
+		}
+	}
+}
+
+func TestResolveDockerEndpointHost(t *testing.T) {
+	dir, restore := setupDockerConfig(t)
+	defer restore()
+
+	ep, err := resolveDockerEndpoint(endpointContext([]string{"--host", "tcp://1.2.3.4:2375"}))
+	if err != nil || ep.Host != "tcp://1.2.3.4:2375" || ep.TLS {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+
+	// TLS certificates default to the ones in the configuration directory.
+	_ = ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte("pem"), 0644)
+	ep, err = resolveDockerEndpoint(endpointContext([]string{"--host", "tcp://1.2.3.4:2376",
+		"--tlsverify", "--tlscert", "/path/cert.pem"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !ep.TLS || !ep.TLSVerify || ep.CACert != filepath.Join(dir, "ca.pem") ||
+		ep.Cert != "/path/cert.pem" || ep.Key != "" {
+		t.Fatalf("Unexpected endpoint: %+v", ep)
+	}
+
+	_, err = resolveDockerEndpoint(endpointContext([]string{"--host", "tcp://1.2.3.4:2375", "--context", "remote"}))
+	if err == nil || !strings.Contains(err.Error(), "conflicting options") {
+		t.Fatalf("Expected a conflict, got: %v", err)
+	}
+}
+
+func TestResolveDockerEndpointContext(t *testing.T) {
+	dir, restore := setupDockerConfig(t)
+	defer restore()
+
+	writeDockerContext(t, dir, "remote",
+		`{"Name":"remote","Metadata":{},"Endpoints":{"docker":{"Host":"tcp://10.0.0.1:2376","SkipTLSVerify":false}}}`, true)
+	writeDockerContext(t, dir, "insecure",
+		`{"Name":"insecure","Metadata":{},"Endpoints":{"docker":{"Host":"tcp://10.0.0.2:2375","SkipTLSVerify":true}}}`, false)
+	writeDockerContext(t, dir, "ssh",
+		`{"Name":"ssh","Metadata":{},"Endpoints":{"docker":{"Host":"ssh://user@host"}}}`, false)
+
+	ep, err := resolveDockerEndpoint(endpointContext([]string{"--context", "remote"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tlsDir := filepath.Dir(ep.CACert)
+	if ep.Host != "tcp://10.0.0.1:2376" || !ep.TLS || !ep.TLSVerify ||
+		ep.Cert != filepath.Join(tlsDir, "cert.pem") || ep.Key != filepath.Join(tlsDir, "key.pem") {
+		t.Fatalf("Unexpected endpoint: %+v", ep)
+	}
+
+	// The --context flag has precedence over DOCKER_HOST.
+	_ = os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2375")
+	ep, err = resolveDockerEndpoint(endpointContext([]string{"--context", "insecure"}))
+	if err != nil || ep.Host != "tcp://10.0.0.2:2375" || ep.TLS {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+
+	// DOCKER_HOST has precedence over DOCKER_CONTEXT.
+	_ = os.Setenv("DOCKER_CONTEXT", "remote")
+	ep, err = resolveDockerEndpoint(endpointContext([]string{}))
+	if err != nil || ep.Host != "" {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+	_ = os.Unsetenv("DOCKER_HOST")
+	ep, err = resolveDockerEndpoint(endpointContext([]string{}))
+	if err != nil || ep.Host != "tcp://10.0.0.1:2376" {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+
+	// The current context of the docker CLI is used last.
+	_ = os.Unsetenv("DOCKER_CONTEXT")
+	_ = ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"currentContext":"insecure"}`), 0644)
+	ep, err = resolveDockerEndpoint(nil)
+	if err != nil || ep.Host != "tcp://10.0.0.2:2375" {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+
+	for _, name := range []string{"ssh", "unknown"} {
+		if _, err = resolveDockerEndpoint(endpointContext([]string{"--context", name})); err == nil {
+			t.Fatalf("Expected context '%s' to fail", name)
+		}
+	}
+	if ep, err = resolveDockerEndpoint(endpointContext([]string{"--context", "default"})); err != nil || ep.Host != "" {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+}
+
+func TestResolveDockerEndpointRootless(t *testing.T) {
+	dir, restore := setupDockerConfig(t)
+	defer restore()
+
+	socket := filepath.Join(dir, "docker.sock")
+	_ = ioutil.WriteFile(socket, []byte{}, 0600)
+	_ = os.Setenv("XDG_RUNTIME_DIR", dir)
+
+	// The default socket exists, so it's preferred.
+	defaultDockerSocket = socket
+	ep, err := resolveDockerEndpoint(nil)
+	if err != nil || ep.Host != "" {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+
+	defaultDockerSocket = filepath.Join(dir, "does-not-exist.sock")
+	ep, err = resolveDockerEndpoint(nil)
+	if err != nil || ep.Host != "unix://"+socket {
+		t.Fatalf("Unexpected endpoint %+v: %v", ep, err)
+	}
+}
+
+func TestNewDockerClient(t *testing.T) {
+	_, restore := setupDockerConfig(t)
+	defer restore()
+
+	dc, err := newDockerClient(&dockerEndpoint{Host: "tcp://127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if dc.DaemonHost() != "tcp://127.0.0.1:1" {
+		t.Fatalf("Unexpected host: %v", dc.DaemonHost())
+	}
+
+	_, err = newDockerClient(&dockerEndpoint{Host: "tcp://127.0.0.1:1", TLS: true, TLSVerify: true,
+		CACert: "/does/not/exist/ca.pem"})
+	if err == nil {
+		t.Fatal("Expected an error because of the missing certificate")
+	}
+}
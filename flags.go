@@ -75,6 +75,26 @@ func newApp() *cli.App {
 			Name:  "f, force",
 			Usage: "Ignore all the local caches",
 		},
+		cli.StringFlag{
+			Name:  "config",
+			Value: "",
+			Usage: "Configuration file providing default values for flags (default \"~/.config/zypper-docker/config.json\")",
+		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Value: "",
+			Usage: "Directory in which cache files are stored (by default $XDG_CACHE_HOME, $HOME/.cache or /tmp)",
+		},
+		cli.DurationFlag{
+			Name:  "cache-ttl",
+			Value: 0,
+			Usage: "Inspect images again once their cached classification is older than the given duration (e.g. \"72h\"). Zero means that it never expires",
+		},
+		cli.DurationFlag{
+			Name:  "scan-ttl",
+			Value: 0,
+			Usage: "Reuse the results of listing patches and updates for an image for the given duration (e.g. \"6h\"), unless its repositories have changed. Zero (the default) disables it",
+		},
 		cli.BoolFlag{
 			Name:  "d, debug",
 			Usage: "Show all the logged messages on stdout",
@@ -83,6 +103,35 @@ func newApp() *cli.App {
 			Name:  "add-host",
 			Usage: "Add a custom host-to-IP mapping (host:ip)",
 		},
+		cli.StringFlag{
+			Name:  "H, host",
+			Value: "",
+			Usage: "Daemon socket to connect to (e.g. \"tcp://192.168.1.10:2376\")",
+		},
+		cli.BoolFlag{
+			Name:  "tlsverify",
+			Usage: "Use TLS and verify the remote daemon",
+		},
+		cli.StringFlag{
+			Name:  "tlscacert",
+			Value: "",
+			Usage: "Trust certs signed only by this CA (default \"~/.docker/ca.pem\")",
+		},
+		cli.StringFlag{
+			Name:  "tlscert",
+			Value: "",
+			Usage: "Path to TLS certificate file (default \"~/.docker/cert.pem\")",
+		},
+		cli.StringFlag{
+			Name:  "tlskey",
+			Value: "",
+			Usage: "Path to TLS key file (default \"~/.docker/key.pem\")",
+		},
+		cli.StringFlag{
+			Name:  "context",
+			Value: "",
+			Usage: "Name of the docker CLI context to use (overrides DOCKER_HOST and the current context of the docker CLI)",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -90,6 +139,34 @@ func newApp() *cli.App {
 			Usage:     "List all the images based on either OpenSUSE or SLES",
 			Action:    getCmd("images", imagesCmd),
 			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Pretty-print images using a Go template (e.g. '{{.Repository}}:{{.Tag}} {{.ID}}'), or \"json\" to print a JSON document",
+				},
+				cli.BoolFlag{
+					Name:  "q, quiet",
+					Usage: "Only show image IDs",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter",
+					Usage: "Filter output based on conditions provided (e.g. \"reference=opensuse/*\", \"label=key=value\", \"before=<image>\", \"since=<image>\", \"dangling=false\", \"outdated=true\" or \"os=sles:15\")",
+				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "Also show the number of needed security and total patches for each image. Note that this spawns a container for each image",
+				},
+				cli.BoolFlag{
+					Name:  "provenance",
+					Usage: "Also show the base image, the operation and the number of applied patches and fixed CVEs of the images produced by zypper-docker",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: 4,
+					Usage: "Maximum number of images to be inspected or checked at the same time",
+				},
+			},
 		},
 		{
 			Name:    "list-updates",
@@ -101,6 +178,13 @@ func newApp() *cli.App {
 
 Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to use.
 If the tag has not been provided, then "latest" is the one that will be used.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print the updates in the given format. Only \"json\" is supported, the output of zypper is printed otherwise.",
+				},
+			},
 		},
 		{
 			Name:    "list-updates-container",
@@ -117,6 +201,11 @@ to be used.`,
 					Name:  "base",
 					Usage: "Analyze the base image of the container for updates.",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print the updates in the given format. Only \"json\" is supported, the output of zypper is printed otherwise.",
+				},
 			},
 		},
 		{
@@ -130,7 +219,9 @@ to be used.`,
 Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to
 update. Since zypper-docker does not overwrite images, <new-image> is the name
 of the image that will be created on this operation. This new image will be the
-same as the old one plus the applied updates.
+same as the old one plus the applied updates. <new-image> can be omitted
+when --dry-run is given. If --replace is given, <new-image> can be an existing
+image, even <image> itself.
 
 If the tag has not been provided on either <image> or <new-image>, then
 "latest" is the one that will be used.`,
@@ -157,6 +248,82 @@ If the tag has not been provided on either <image> or <new-image>, then
 					Value: "[zypper-docker] update",
 					Usage: "Commit message to associated with the new layer",
 				},
+				cli.StringFlag{
+					Name:  "sbom",
+					Value: "",
+					Usage: "Write the SBOM of the new image into the given file (\"-\" for the standard output)",
+				},
+				cli.StringFlag{
+					Name:  "sbom-format",
+					Value: "spdx",
+					Usage: "Format of the SBOM given through --sbom: either \"spdx\" or \"cyclonedx\"",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Report what would be installed without committing anything",
+				},
+				cli.BoolFlag{
+					Name:  "replace",
+					Usage: "Allow <new-image> to be an existing image (e.g. <image> itself), which is kept under a backup tag",
+				},
+				cli.StringFlag{
+					Name:  "backup-tag",
+					Value: defaultBackupTag,
+					Usage: "Template of the tag given to the image replaced through --replace. Available fields: .Repository, .Tag, .Operation, .Date, .Time and .ID",
+				},
+			},
+		},
+		{
+			Name:   "update-all",
+			Usage:  "Install the available updates for all the SUSE images",
+			Action: getCmd("update-all", updateAllCmd),
+			ArgsUsage: ` 
+
+All the openSUSE/SUSE Linux Enterprise images matching the given filters are
+updated. The new images are named after the given target template, and images
+without any pending update are skipped.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "l, auto-agree-with-licenses",
+					Usage: "Automatically say yes to third party license confirmation prompt. By using this option, you choose to agree with licenses of all third-party software this command will install.",
+				},
+				cli.BoolFlag{
+					Name:  "no-recommends",
+					Usage: "By default, zypper installs also packages recommended by the requested ones. This option causes the recommended packages to be ignored and only the required ones to be installed.",
+				},
+				cli.BoolFlag{
+					Name:  "replacefiles",
+					Usage: "Install the packages even if they replace files from other, already installed, packages. Default is to treat file conflicts as an error.",
+				},
+				cli.StringFlag{
+					Name:  "author",
+					Value: defaultCommitAuthor(),
+					Usage: "Commit author to associate with the new layer (e.g., \"John Doe <john.doe@example.com>\")",
+				},
+				cli.StringFlag{
+					Name:  "message",
+					Value: "[zypper-docker] update",
+					Usage: "Commit message to associated with the new layers",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter",
+					Usage: "Select the images based on the conditions provided, as the images command does (e.g. \"reference=opensuse/*\", \"label=key=value\" or \"os=sles:15\")",
+				},
+				cli.StringFlag{
+					Name:  "target",
+					Value: "{{.Repository}}:{{.Tag}}-updated",
+					Usage: "Template of the names of the new images. Available fields: .Repository, .Tag, .ID, .Operation and .Date",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: 2,
+					Usage: "Maximum number of images to be updated at the same time",
+				},
+				cli.StringFlag{
+					Name:  "log-dir",
+					Value: "",
+					Usage: "Directory in which the output of zypper is written for each image. A temporary directory is created by default",
+				},
 			},
 		},
 		{
@@ -200,6 +367,11 @@ If the tag has not been provided, then "latest" is the one that will be used.`,
 					Value: "",
 					Usage: "List only patches with this severity.",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print the patches in the given format. Only \"json\" is supported, the output of zypper is printed otherwise.",
+				},
 			},
 		},
 		{
@@ -242,6 +414,11 @@ to be used.`,
 					Value: "",
 					Usage: "List only patches with this category.",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print the patches in the given format. Only \"json\" is supported, the output of zypper is printed otherwise.",
+				},
 			},
 		},
 		{
@@ -253,7 +430,9 @@ to be used.`,
 Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to
 patch. Since zypper-docker does not overwrite images, <new-image> is the name
 of the image that will be created on this operation. This new image will be the
-same as the old one plus the applied patches.
+same as the old one plus the applied patches. <new-image> can be omitted
+when --dry-run is given. If --replace is given, <new-image> can be an existing
+image, even <image> itself.
 
 If the tag has not been provided on either <image> or <new-image>, then
 "latest" is the one that will be used.`,
@@ -300,6 +479,102 @@ If the tag has not been provided on either <image> or <new-image>, then
 					Value: "[zypper-docker] patch",
 					Usage: "Commit message to associated with the new layer",
 				},
+				cli.StringFlag{
+					Name:  "sbom",
+					Value: "",
+					Usage: "Write the SBOM of the new image into the given file (\"-\" for the standard output)",
+				},
+				cli.StringFlag{
+					Name:  "sbom-format",
+					Value: "spdx",
+					Usage: "Format of the SBOM given through --sbom: either \"spdx\" or \"cyclonedx\"",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Report what would be installed without committing anything",
+				},
+				cli.BoolFlag{
+					Name:  "replace",
+					Usage: "Allow <new-image> to be an existing image (e.g. <image> itself), which is kept under a backup tag",
+				},
+				cli.StringFlag{
+					Name:  "backup-tag",
+					Value: defaultBackupTag,
+					Usage: "Template of the tag given to the image replaced through --replace. Available fields: .Repository, .Tag, .Operation, .Date, .Time and .ID",
+				},
+			},
+		},
+		{
+			Name:   "patch-all",
+			Usage:  "Install the available patches for all the SUSE images",
+			Action: getCmd("patch-all", patchAllCmd),
+			ArgsUsage: ` 
+
+All the openSUSE/SUSE Linux Enterprise images matching the given filters are
+patched. The new images are named after the given target template, and images
+without any needed patch are skipped.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bugzilla",
+					Value: "",
+					Usage: "Install available needed patches for all Bugzilla issues, or issues whose number matches the given string (--bugzilla=#).",
+				},
+				cli.StringFlag{
+					Name:  "cve",
+					Value: "",
+					Usage: "Install available needed patches for all CVE issues, or issues whose number matches the given string (--cve=#).",
+				},
+				cli.StringFlag{
+					Name:  "date",
+					Value: "",
+					Usage: "Install patches issued up to, but not including, the specified date (YYYY-MM-DD).",
+				},
+				cli.StringFlag{
+					Name:  "g, category",
+					Value: "",
+					Usage: "Install only patches with this category.",
+				},
+				cli.BoolFlag{
+					Name:  "l, auto-agree-with-licenses",
+					Usage: "Automatically say yes to third party license confirmation prompt. By using this option, you choose to agree with licenses of all third-party software this command will install.",
+				},
+				cli.BoolFlag{
+					Name:  "no-recommends",
+					Usage: "By default, zypper installs also packages recommended by the requested ones. This option causes the recommended packages to be ignored and only the required ones to be installed.",
+				},
+				cli.BoolFlag{
+					Name:  "replacefiles",
+					Usage: "Install the packages even if they replace files from other, already installed, packages. Default is to treat file conflicts as an error.",
+				},
+				cli.StringFlag{
+					Name:  "author",
+					Value: defaultCommitAuthor(),
+					Usage: "Commit author to associate with the new layer (e.g., \"John Doe <john.doe@example.com>\")",
+				},
+				cli.StringFlag{
+					Name:  "message",
+					Value: "[zypper-docker] patch",
+					Usage: "Commit message to associated with the new layers",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter",
+					Usage: "Select the images based on the conditions provided, as the images command does (e.g. \"reference=opensuse/*\", \"label=key=value\" or \"os=sles:15\")",
+				},
+				cli.StringFlag{
+					Name:  "target",
+					Value: "{{.Repository}}:{{.Tag}}-patched",
+					Usage: "Template of the names of the new images. Available fields: .Repository, .Tag, .ID, .Operation and .Date",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: 2,
+					Usage: "Maximum number of images to be patched at the same time",
+				},
+				cli.StringFlag{
+					Name:  "log-dir",
+					Value: "",
+					Usage: "Directory in which the output of zypper is written for each image. A temporary directory is created by default",
+				},
 			},
 		},
 		{
@@ -312,6 +587,13 @@ If the tag has not been provided on either <image> or <new-image>, then
 
 Where <image> is the name of the openSUSE/SUSE Linux Enterprise image to use.
 If the tag has not been provided, then "latest" is the one that will be used.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print a summary of the needed patches in the given format: either \"json\" or \"short\" (a single line).",
+				},
+			},
 		},
 		{
 			Name:    "patch-check-container",
@@ -328,6 +610,11 @@ to be used.`,
 					Name:  "base",
 					Usage: "Execute a patch-check on the base image of the container.",
 				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print a summary of the needed patches in the given format: either \"json\" or \"short\" (a single line).",
+				},
 			},
 		},
 		{
@@ -335,6 +622,185 @@ to be used.`,
 			Usage:     "List all the containers that are outdated",
 			Action:    getCmd("ps", psCmd),
 			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "a, all",
+					Usage: "Analyze all the containers, not only the running ones",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter",
+					Usage: "Filter the analyzed containers based on the conditions provided (e.g. \"name=web\", \"label=key=value\", \"ancestor=opensuse:42.3\" or \"status=exited\")",
+				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "Check the images of the containers in an unknown state for needed patches. Each image is checked only once",
+				},
+				cli.IntFlag{
+					Name:  "parallel",
+					Value: 4,
+					Usage: "Maximum number of images to be checked at the same time",
+				},
+			},
+		},
+		{
+			Name:      "rollout",
+			Usage:     "Recreate the containers based on outdated images from their patched images",
+			Action:    getCmd("rollout", rolloutCmd),
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "a, all",
+					Usage: "Recreate all the containers, not only the running ones. Containers that are not running are not started",
+				},
+				cli.StringSliceFlag{
+					Name:  "filter",
+					Usage: "Filter the containers based on the conditions provided (e.g. \"name=web\", \"label=key=value\", \"ancestor=opensuse:42.3\" or \"status=exited\")",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "List the containers that would be recreated, without touching them",
+				},
+				cli.BoolFlag{
+					Name:  "keep",
+					Usage: "Keep the outdated containers, stopped and renamed with the \"-outdated\" suffix, instead of removing them",
+				},
+				cli.IntFlag{
+					Name:  "t, time",
+					Value: 10,
+					Usage: "Seconds to wait for each container to stop before killing it",
+				},
+			},
+		},
+		{
+			Name:   "packages",
+			Usage:  "List the packages installed in the given image",
+			Action: getCmd("packages", packagesCmd),
+			ArgsUsage: `<image>
+
+Where <image> is the name of the openSUSE/SUSE Linux Enterprise image whose
+installed packages are to be listed.`,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "name",
+					Usage: "List only the packages whose name matches the given shell pattern (e.g. \"libcurl*\"). It can be given multiple times.",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print the packages in the given format: either \"json\" or \"table\" (default).",
+				},
+			},
+		},
+		{
+			Name:   "packages-container",
+			Usage:  "List the packages installed in the given container",
+			Action: getCmd("packages-container", packagesContainerCmd),
+			UsageText: `zypper-docker packages-container [command options] <container-id>
+
+Where <container-id> is either the container ID or the name of the container
+to be used.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "base",
+					Usage: "List the packages of the base image of the container.",
+				},
+				cli.StringSliceFlag{
+					Name:  "name",
+					Usage: "List only the packages whose name matches the given shell pattern (e.g. \"libcurl*\"). It can be given multiple times.",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print the packages in the given format: either \"json\" or \"table\" (default).",
+				},
+			},
+		},
+		{
+			Name:   "diff",
+			Usage:  "List the packages that differ between two images",
+			Action: getCmd("diff", diffCmd),
+			ArgsUsage: `<image> <new-image>
+
+Where both <image> and <new-image> are openSUSE/SUSE Linux Enterprise images.
+The packages of <new-image> which are added, removed, upgraded or downgraded
+with respect to <image> are listed.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "",
+					Usage: "Print the differences in the given format. Only \"json\" is supported, a table is printed otherwise.",
+				},
+			},
+		},
+		{
+			Name:   "sbom",
+			Usage:  "Generate the Software Bill of Materials of an image",
+			Action: getCmd("sbom", sbomCmd),
+			ArgsUsage: `<image>
+
+Where <image> is the name of the openSUSE/SUSE Linux Enterprise image whose
+installed packages are to be listed.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "spdx",
+					Usage: "Format of the SBOM: either \"spdx\" (SPDX 2.3 JSON) or \"cyclonedx\" (CycloneDX 1.5 JSON)",
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Value: "",
+					Usage: "Write the SBOM into the given file instead of the standard output",
+				},
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Manage the local cache",
+			Subcommands: []cli.Command{
+				{
+					Name:      "show",
+					Usage:     "Show the contents of the cache",
+					Action:    getCmd("cache show", cacheShowCmd),
+					ArgsUsage: " ",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "format",
+							Value: "",
+							Usage: "Use \"json\" to print a JSON document",
+						},
+					},
+				},
+				{
+					Name:      "prune",
+					Usage:     "Remove the entries of images that are no longer present in the Docker daemon",
+					Action:    getCmd("cache prune", cachePruneCmd),
+					ArgsUsage: " ",
+				},
+				{
+					Name:      "forget",
+					Usage:     "Remove the entries of the given image",
+					Action:    getCmd("cache forget", cacheForgetCmd),
+					ArgsUsage: "<image>",
+				},
+				{
+					Name:      "clear",
+					Usage:     "Remove all the entries, including the ones of outdated images",
+					Action:    getCmd("cache clear", cacheClearCmd),
+					ArgsUsage: " ",
+				},
+				{
+					Name:      "export",
+					Usage:     "Write the cache into the given file (or the standard output)",
+					Action:    getCmd("cache export", cacheExportCmd),
+					ArgsUsage: "[file]",
+				},
+				{
+					Name:      "import",
+					Usage:     "Merge the cache exported into the given file (or \"-\" for the standard input) into the current one",
+					Action:    getCmd("cache import", cacheImportCmd),
+					ArgsUsage: "<file>",
+				},
+			},
 		},
 	}
 	return app
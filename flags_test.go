@@ -25,10 +25,10 @@ func TestVersion(t *testing.T) {
 func TestNewApp(t *testing.T) {
 	app := newApp()
 
-	if len(app.Flags) != 5 {
+	if len(app.Flags) != 15 {
 		t.Fatal("Wrong number of global flags")
 	}
-	if len(app.Commands) != 10 {
+	if len(app.Commands) != 18 {
 		t.Fatal("Wrong number of subcommands")
 	}
 }
@@ -17,20 +17,26 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
-	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/pkg/stringid"
-	"github.com/docker/go-units"
+	"github.com/docker/docker/api/types/filters"
 )
 
+// formatJSON is the value to be given to the `--format` flag in order to get a
+// JSON document instead of the human readable output.
+const formatJSON = "json"
+
 var specialFlags = []string{
 	"--bugzilla",
 	"--cve",
@@ -100,7 +106,15 @@ func cmdWithFlags(cmd string, ctx *cli.Context, boolFlags, toIgnore []string) st
 			continue
 		}
 
-		if value := ctx.String(name); ctx.IsSet(name) {
+		// Flags are forwarded when given explicitly, but also when their
+		// default has been changed through the configuration file.
+		value := ctx.String(name)
+		set := ctx.IsSet(name) || (value != "" && hasConfiguredDefault(ctx, name))
+		if arrayIncludeString(boolFlags, name) {
+			set = ctx.Bool(name)
+		}
+
+		if set {
 			var dash string
 			if len(name) == 1 {
 				dash = "-"
@@ -249,7 +263,7 @@ func commandInContainer(f commandFunc, ctx *cli.Context) (string, error) {
 	}
 	// If the base flag is used the source image of the container will be analyzed
 	// instead
-	if ctx.IsSet("base") {
+	if ctx.Bool("base") {
 		logAndPrintf("Base image %s of container %s will be analyzed. Manually installed packages won't be taken into account.\n", container.Image, containerID)
 		err = f(container.Image, ctx)
 		image = container.Image
@@ -289,57 +303,201 @@ func exitOnError(image, cmd string, err error) {
 	exitWithCode(1)
 }
 
+// operationBoolFlags contains the boolean flags of the patch and the update
+// commands which are forwarded to zypper.
+var operationBoolFlags = []string{"l", "auto-agree-with-licenses", "no-recommends",
+	"replacefiles"}
+
+// operationCommand returns the zypper command that applies the given
+// operation (either "patch" or "up") with the flags of the given context,
+// except for the ones to be ignored. It also returns the filters, which are
+// the forwarded flags that are not boolean. When `listPatches` is true, the
+// command also lists the patches matching these filters before applying them
+// (see `patchesListCommand`).
+func operationCommand(zypperCmd string, ctx *cli.Context, toIgnore []string, listPatches bool) (string, string) {
+	ignored := append(append([]string{}, toIgnore...), operationBoolFlags...)
+	filters := cmdWithFlags("", ctx, operationBoolFlags, ignored)
+
+	cmd := formatZypperCommand("ref")
+	if listPatches {
+		cmd += " && " + patchesListCommand(filters)
+	}
+	apply := formatZypperCommand(fmt.Sprintf("-n %v", zypperCmd))
+	cmd += " && " + cmdWithFlags(apply, ctx, operationBoolFlags, toIgnore)
+	cmd += " && " + formatZypperCommand("clean -a")
+	return cmd, filters
+}
+
+// forEachParallel calls f for each index from 0 to n-1, running up to
+// `parallel` calls at the same time. It stops as soon as the operation is
+// interrupted by a signal, and it returns whether this happened.
+func forEachParallel(n, parallel int, f func(i int)) bool {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+
+	interrupted := false
+	for i := 0; i < n && !interrupted; i++ {
+		// Check for interruptions first, otherwise a pending signal might be
+		// ignored in favor of an idle worker.
+		select {
+		case <-killChannel:
+			interrupted = true
+			continue
+		default:
+		}
+
+		select {
+		case <-killChannel:
+			interrupted = true
+		case jobs <- i:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return interrupted
+}
+
 // updatePatchCmd executes an update/patch command depending on the argument
 // zypperCmd.
 func updatePatchCmd(zypperCmd string, ctx *cli.Context) {
-	if len(ctx.Args()) != 2 {
+	// The name of the new image is optional in dry-run mode.
+	if len(ctx.Args()) != 2 && (!ctx.Bool("dry-run") || len(ctx.Args()) != 1) {
 		logAndFatalf("Wrong invocation: expected 2 arguments, %d given.\n", len(ctx.Args()))
 		return
 	}
 
-	img := ctx.Args()[0]
-	repo, tag, err := parseImageName(ctx.Args()[1])
-	if err != nil {
-		logAndFatalf("%v\n", err)
-		return
+	operation := "patch"
+	if zypperCmd == "up" {
+		operation = "update"
 	}
-	if err = preventImageOverwrite(repo, tag); err != nil {
-		logAndFatalf("%v\n", err)
-		return
+
+	img := ctx.Args()[0]
+	var repo, tag string
+	var backup *imageBackup
+	if len(ctx.Args()) == 2 {
+		var err error
+		if repo, tag, err = parseImageName(ctx.Args()[1]); err != nil {
+			logAndFatalf("%v\n", err)
+			return
+		}
+		// With --replace the image currently referenced by the new name is
+		// backed up instead of refusing to overwrite it.
+		if ctx.Bool("replace") {
+			backup, err = newImageBackup(repo, tag, ctx.String("backup-tag"), operation)
+		} else {
+			err = preventImageOverwrite(repo, tag)
+		}
+		if err != nil {
+			logAndFatalf("%v\n", err)
+			return
+		}
 	}
 
 	comment := ctx.String("message")
 	author := ctx.String("author")
+	sbomFormat := ctx.String("sbom-format")
+	if sbomFormat != "" && sbomFormat != formatSPDX && sbomFormat != formatCycloneDX {
+		logAndFatalf("Error: unknown SBOM format '%s'. Accepted values: %s, %s.\n",
+			sbomFormat, formatSPDX, formatCycloneDX)
+		return
+	}
+
+	toIgnore := []string{"author", "message", "sbom", "sbom-format", "dry-run",
+		"replace", "backup-tag"}
+
+	base, _, err := getDockerClient().ImageInspectWithRaw(context.Background(), img)
+	if err != nil {
+		logAndFatalf("Cannot proceed safely: could not inspect image '%s': %v\n", img, err)
+		return
+	}
 
-	boolFlags := []string{"l", "auto-agree-with-licenses", "no-recommends",
-		"replacefiles"}
-	toIgnore := []string{"author", "message"}
+	if ctx.Bool("dry-run") {
+		cmd := formatZypperCommand("--quiet ref", fmt.Sprintf("--xmlout %v --dry-run", zypperCmd))
+		cmd = cmdWithFlags(cmd, ctx, operationBoolFlags, toIgnore)
+		exitOnError(img, "zypper "+zypperCmd, dryRun(img, cmd))
+		return
+	}
 
-	cmd := formatZypperCommand("ref", fmt.Sprintf("-n %v", zypperCmd))
-	clean := formatZypperCommand("clean -a")
-	cmd = cmdWithFlags(cmd, ctx, boolFlags, toIgnore)
-	cmd += " && " + clean
+	// The patches are recorded as they are listed by the patch command itself.
+	// The ones of updates are unknown.
+	cmd, filters := operationCommand(zypperCmd, ctx, toIgnore, zypperCmd == "patch")
+	prov := newProvenance(base.ID, img, base.RepoDigests, operation, filters)
+	output := newPatchesWriter(os.Stdout)
+
+	// The new image only takes over the reference when it's committed, so the
+	// backup reference is created right before that, once the container has
+	// finished successfully. On failure, the backup reference is removed and
+	// the original one is restored just in case.
+	var backupErr error
+	beforeCommit := func() (map[string]string, error) {
+		if backup != nil {
+			if backupErr = backup.create(); backupErr != nil {
+				return nil, backupErr
+			}
+		}
+		if patches := output.patches(); patches != nil {
+			prov.setPatches(patches)
+		}
+		return prov.labels(), nil
+	}
 
-	newImgID, err := runCommandAndCommitToImage(
+	newImgID, err := runCommandAndCommitToImageOutput(
 		img,
 		repo,
 		tag,
 		cmd,
 		comment,
-		author)
-	if err != nil {
+		author,
+		beforeCommit,
+		output)
+	if backupErr != nil {
+		logAndFatalf("Could not back up %s as %s: %v\n", backup.Reference, backup.Backup, backupErr)
+		return
+	} else if err != nil {
+		if backup != nil && backup.created {
+			if restoreErr := backup.restore(); restoreErr != nil {
+				log.Printf("Could not restore %s: %v\n", backup.Reference, restoreErr)
+			}
+		}
 		logAndFatalf("Could not commit to the new image: %v\n", err)
 		return
 	}
 
 	logAndPrintf("%s:%s successfully created\n", repo, tag)
+	if backup != nil {
+		logAndPrintf("The previous %s has been kept as %s\n", backup.Reference, backup.Backup)
+	}
 
+	// The ID of the base image is used, since its name might now point to
+	// the new image.
 	cache := getCacheFile()
-	if err := cache.updateCacheAfterUpdate(img, newImgID); err != nil {
+	if err := cache.updateCacheAfterUpdate(base.ID, newImgID); err != nil {
 		log.Println("Cannot add image details to zypper-docker cache")
 		log.Println("This will break the \"zypper-docker ps\" feature")
 		log.Println(err)
 	}
+
+	if output := ctx.String("sbom"); output != "" {
+		name := fmt.Sprintf("%s:%s", repo, tag)
+		if err := writeSBOM(name, sbomFormat, output); err != nil {
+			logAndFatalf("Could not generate the SBOM of %s: %v.\n", name, err)
+			return
+		}
+	}
 }
 
 // joinAsArray joins the given array of commands so it's compatible to what is
@@ -351,7 +509,10 @@ func joinAsArray(cmds []string, emptyArray bool) string {
 
 	str := "["
 	for i, v := range cmds {
-		str += "\"" + v + "\""
+		// Quote each element as a JSON string, so quotes and backslashes in
+		// the command are preserved.
+		quoted, _ := json.Marshal(v)
+		str += string(quoted)
 		if i < len(cmds)-1 {
 			str += ", "
 		}
@@ -398,21 +559,110 @@ func removeDuplicates(elements []string) []string {
 	return res
 }
 
-// format and print given images to match `docker images` output
-func formatAndPrint(images []types.ImageSummary) {
+// format and print given images to match `docker images` output. If check is
+// set to true, then the number of needed security patches, the total number
+// of needed patches and whether the image is outdated are also printed. If
+// prov is set to true, then the base image, the operation and the number of
+// applied patches and fixed CVEs are printed for images produced by
+// zypper-docker.
+func formatAndPrint(images []imageInfo, check, prov bool) {
 	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
-	fmt.Fprintln(writer, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+	header := "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\tOS"
+	if check {
+		header += "\tSECURITY\tPATCHES\tOUTDATED"
+	}
+	if prov {
+		header += "\tBASE\tOPERATION\tAPPLIED\tCVES"
+	}
+	fmt.Fprintln(writer, header)
 
 	for _, img := range images {
-		for _, repoTag := range img.RepoTags {
-			repo := strings.Split(repoTag, ":")[0]
-			tag := strings.Split(repoTag, ":")[1]
-			truncID := stringid.TruncateID(img.ID)
-			createdSince := units.HumanDuration(time.Now().UTC().Sub(time.Unix(img.Created, 0))) + " ago"
-			hSize := units.HumanSize(float64(img.Size))
-
-			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", repo, tag, truncID, createdSince, hSize)
+		system := "-"
+		if img.OS != nil {
+			system = img.OS.String()
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s",
+			img.Repository, img.Tag, img.ID, img.CreatedSince, img.Size, system)
+		if check {
+			security, needed := "?", "?"
+			if img.Patches != nil {
+				security = strconv.Itoa(img.Patches.Security)
+				needed = strconv.Itoa(img.Patches.Needed)
+			}
+			outdated := "no"
+			if img.Outdated {
+				outdated = "yes"
+			}
+			fmt.Fprintf(writer, "\t%s\t%s\t%s", security, needed, outdated)
 		}
+		if prov {
+			base, operation, applied, cves := "-", "-", "-", "-"
+			if p := img.Provenance; p != nil {
+				base, operation = p.BaseName, p.Operation
+				if p.Patches != nil {
+					applied, cves = strconv.Itoa(len(p.Patches)), strconv.Itoa(len(p.CVEs))
+				}
+			}
+			fmt.Fprintf(writer, "\t%s\t%s\t%s\t%s", base, operation, applied, cves)
+		}
+		fmt.Fprintln(writer)
 	}
 	writer.Flush()
 }
+
+// parseFilters parses the given values of a `--filter` flag, which have the
+// "key=value" format. Filters whose key is included in `daemonKeys` are
+// returned as arguments to be forwarded to the Docker daemon, while the ones
+// whose key is included in `localKeys` are returned in a map, so they can be
+// evaluated by zypper-docker itself. An error is returned for malformed or
+// unknown filters.
+func parseFilters(values, daemonKeys, localKeys []string) (filters.Args, map[string]string, error) {
+	args := filters.NewArgs()
+	local := map[string]string{}
+
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return args, local, fmt.Errorf("bad format of filter '%s', expected 'key=value'", value)
+		}
+
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		switch {
+		case arrayIncludeString(daemonKeys, key):
+			args.Add(key, kv[1])
+		case arrayIncludeString(localKeys, key):
+			local[key] = kv[1]
+		default:
+			return args, local, fmt.Errorf("invalid filter '%s'", key)
+		}
+	}
+	return args, local, nil
+}
+
+// checkFormat exits with an error if the value of the `--format` flag is not
+// one of the allowed ones. An empty value is always accepted, since it stands
+// for the default output of the command. It returns whether the given format
+// is valid or not.
+func checkFormat(ctx *cli.Context, allowed ...string) bool {
+	format := ctx.String("format")
+	if format == "" || arrayIncludeString(allowed, format) {
+		return true
+	}
+	logAndFatalf("Error: unknown format '%s'. Accepted values: %s.\n",
+		format, strings.Join(allowed, ", "))
+	return false
+}
+
+// printJSON prints the given value as an indented JSON document to the
+// standard output.
+func printJSON(v interface{}) error {
+	return encodeJSON(os.Stdout, v)
+}
+
+// encodeJSON writes the given value as an indented JSON document into the
+// given writer.
+func encodeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -188,6 +188,42 @@ func TestCmdWithFlags(t *testing.T) {
 	}
 }
 
+func TestCmdWithFlagsDefaults(t *testing.T) {
+	cmd := cli.Command{
+		Name: "patch",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "cve"},
+			cli.StringFlag{Name: "date"},
+			cli.BoolFlag{Name: "l, auto-agree-with-licenses"},
+			cli.BoolFlag{Name: "no-recommends"},
+		},
+	}
+
+	// Defaults changed through the configuration file are not set, but they
+	// still have to be forwarded, unlike built-in defaults. Booleans are only
+	// forwarded when true.
+	configuredFlags = map[string]bool{flagEnvVar("patch", "cve"): true}
+	defer func() { configuredFlags = map[string]bool{} }()
+
+	set := flag.NewFlagSet("test", 0)
+	set.String("cve", "CVE-2018-1000", "doc")
+	set.String("date", "2018-01-01", "doc")
+	set.Bool("l", true, "doc")
+	set.Bool("no-recommends", true, "doc")
+	if err := set.Parse([]string{"--no-recommends=false"}); err != nil {
+		t.Fatal("cannot parse flags")
+	}
+
+	ctx := cli.NewContext(nil, set, nil)
+	ctx.Command = cmd
+
+	actual := cmdWithFlags("patch", ctx, []string{"l", "no-recommends"}, []string{})
+	expected := "patch --cve=CVE-2018-1000 -l"
+	if expected != actual {
+		t.Fatalf("Expected '%s', got '%s'", expected, actual)
+	}
+}
+
 func TestSanitizeStringSpecialFlagUsedAsBool(t *testing.T) {
 	input := []string{"zypper-docker", "lp", "--bugzilla", "image"}
 	expected := []string{"zypper-docker", "lp", "--bugzilla", "", "image"}
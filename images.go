@@ -16,34 +16,272 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/go-units"
 )
 
-// Print all the images based on SUSE. It will print in a format that is as
-// close to the `docker` command as possible.
-func printImages(images []types.ImageSummary) {
-	suseImages := make([]types.ImageSummary, 0, len(images))
+// imageInfo describes an entry as listed by the images command. Images with
+// multiple tags produce one entry per tag. The exported fields are the ones
+// available to the template given through the `--format` flag, and they are
+// also the ones printed when the JSON format has been requested.
+type imageInfo struct {
+	// The ID of the image, truncated as the docker CLI does.
+	ID string `json:"id"`
+
+	// The full ID of the image.
+	FullID string `json:"full_id"`
+
+	// The repository and the tag of this entry.
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+
+	// When the image was created, both as a timestamp and in a human
+	// readable form (e.g. "3 days ago").
+	CreatedAt    time.Time `json:"created_at"`
+	CreatedSince string    `json:"created_since"`
+
+	// The size of the image in a human readable form (e.g. "254.5 MB").
+	Size string `json:"size"`
+
+	// Whether the image is based on either openSUSE or SLE.
+	SUSE bool `json:"suse"`
+
+	// The operating system of the image, if known.
+	OS *osRelease `json:"os,omitempty"`
+
+	// Whether the image has already been patched or updated with
+	// zypper-docker, so a newer image exists.
+	Outdated bool `json:"outdated"`
+
+	// How the image has been produced, if it has been patched or updated
+	// by zypper-docker.
+	Provenance *provenance `json:"provenance,omitempty"`
+
+	// The summary of the patches needed by the image. This is only set when
+	// the `--check` flag has been given and the check was successful.
+	Patches *patchSummary `json:"patches,omitempty"`
+}
+
+// newImageInfos returns an entry for each tag of the given image.
+func newImageInfos(img types.ImageSummary, cache *cachedData) []imageInfo {
+	infos := []imageInfo{}
+	created := time.Unix(img.Created, 0).UTC()
+
+	for _, repoTag := range img.RepoTags {
+		repo, tag := repoTag, ""
+		if idx := strings.LastIndex(repoTag, ":"); idx > strings.LastIndex(repoTag, "/") {
+			repo, tag = repoTag[:idx], repoTag[idx+1:]
+		}
+
+		infos = append(infos, imageInfo{
+			ID:           stringid.TruncateID(img.ID),
+			FullID:       img.ID,
+			Repository:   repo,
+			Tag:          tag,
+			CreatedAt:    created,
+			CreatedSince: units.HumanDuration(time.Now().UTC().Sub(created)) + " ago",
+			Size:         units.HumanSize(float64(img.Size)),
+			SUSE:         true,
+			OS:           cache.imageOS(img.ID),
+			Outdated:     cache.isImageOutdated(img.ID),
+			Provenance:   parseProvenance(img.Labels),
+		})
+	}
+	return infos
+}
+
+// daemonImageFilters contains the filters of the images command that are
+// forwarded to the Docker daemon.
+var daemonImageFilters = []string{"reference", "label", "before", "since", "dangling"}
+
+// localImageFilters contains the filters of the images command that are
+// evaluated by zypper-docker itself.
+var localImageFilters = []string{"outdated", "os"}
+
+// parseImageFilters parses the given values of the `--filter` flag of the
+// images command. It returns the filters to be forwarded to the Docker daemon
+// and the ones to be evaluated locally.
+func parseImageFilters(values []string) (filters.Args, map[string]string, error) {
+	args, local, err := parseFilters(values, daemonImageFilters, localImageFilters)
+	if err != nil {
+		return args, local, err
+	}
+
+	if value, ok := local["outdated"]; ok {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return args, local, fmt.Errorf("invalid value '%s' for the '%s' filter", value, "outdated")
+		}
+	}
+	return args, local, nil
+}
+
+// matchesLocalFilters returns whether the given image passes the filters that
+// are evaluated locally. This only relies on the data available without
+// spawning any container.
+func matchesLocalFilters(img types.ImageSummary, local map[string]string, cache *cachedData) bool {
+	if value, ok := local["outdated"]; ok {
+		outdated, _ := strconv.ParseBool(value)
+		if cache.isImageOutdated(img.ID) != outdated {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesOSFilter returns whether the operating system of the given image
+// matches the `os` filter (if given). Since the operating system is only known
+// once the image has been inspected, this has to be evaluated afterwards.
+func matchesOSFilter(img types.ImageSummary, local map[string]string, cache *cachedData) bool {
+	value, ok := local["os"]
+	if !ok {
+		return true
+	}
+	system := cache.imageOS(img.ID)
+	return system != nil && system.matches(value)
+}
+
+// Print all the images based on SUSE. By default it will print in a format
+// that is as close to the `docker` command as possible, but the output can be
+// changed through the `--format` and the `--quiet` flags. Images not matching
+// the given local filters are skipped before checking whether they are based
+// on SUSE or not.
+func printImages(images []types.ImageSummary, local map[string]string, ctx *cli.Context) error {
 	cache := getCacheFile()
-	counter := 0
 
+	candidates := []types.ImageSummary{}
 	for _, img := range images {
-		select {
-		case <-killChannel:
-			return
-		default:
-			fmt.Printf("Inspecting image %d/%d\r", (counter + 1), len(images))
-			if cache.isSUSE(img.ID) {
-				suseImages = append(suseImages, img)
-			}
+		if matchesLocalFilters(img, local, cache) {
+			candidates = append(candidates, img)
 		}
-		counter++
 	}
-	formatAndPrint(suseImages)
+
+	suse, interrupted := inspectImages(candidates, ctx.Int("parallel"), cache)
 	cache.flush()
+	if interrupted {
+		return nil
+	}
+
+	infos := []imageInfo{}
+	for i, img := range candidates {
+		if suse[i] && matchesOSFilter(img, local, cache) {
+			infos = append(infos, newImageInfos(img, cache)...)
+		}
+	}
+
+	if ctx.Bool("check") {
+		checkImagePatches(infos, ctx.Int("parallel"))
+	}
+
+	switch format := ctx.String("format"); {
+	case ctx.Bool("quiet"):
+		printImageIDs(infos)
+	case format == formatJSON:
+		return printJSON(infos)
+	case format != "":
+		return printImageTemplate(infos, format)
+	default:
+		formatAndPrint(infos, ctx.Bool("check"), ctx.Bool("provenance"))
+	}
+	return nil
+}
+
+// checkImagePatches fetches the summary of the needed patches for each one of
+// the given images. Images with multiple tags are only checked once, and up to
+// `parallel` images are checked at the same time. If the check fails for an
+// image, the error is logged and its summary is left empty.
+func checkImagePatches(infos []imageInfo, parallel int) {
+	ids := []string{}
+	for _, info := range infos {
+		if !arrayIncludeString(ids, info.FullID) {
+			ids = append(ids, info.FullID)
+		}
+	}
+
+	summaries := make([]*patchSummary, len(ids))
+	report := newProgress("Checking patches", len(ids))
+	forEachParallel(len(ids), parallel, func(i int) {
+		summary, err := fetchPatchSummary(ids[i], "")
+		if err != nil {
+			log.Printf("Could not check patches of image %s: %v", ids[i], err)
+		}
+		summaries[i] = summary
+		report.increment()
+	})
+	report.finish()
+
+	for i := range infos {
+		for j, id := range ids {
+			if infos[i].FullID == id {
+				infos[i].Patches = summaries[j]
+			}
+		}
+	}
+}
+
+// inspectImages checks which ones of the given images are based on SUSE. Up
+// to `parallel` images are inspected at the same time. It returns whether each
+// image is based on SUSE or not (in the same order as the given images), and
+// whether the operation has been interrupted.
+func inspectImages(images []types.ImageSummary, parallel int, cache *cachedData) ([]bool, bool) {
+	suse := make([]bool, len(images))
+	report := newProgress("Inspecting images", len(images))
+	defer report.finish()
+
+	interrupted := forEachParallel(len(images), parallel, func(i int) {
+		suse[i] = cache.isSUSE(images[i].ID)
+		report.increment()
+	})
+	return suse, interrupted
+}
+
+// printImageIDs prints the IDs of the given images, skipping duplicates.
+func printImageIDs(infos []imageInfo) {
+	seen := []string{}
+	for _, info := range infos {
+		if !arrayIncludeString(seen, info.ID) {
+			seen = append(seen, info.ID)
+			fmt.Println(info.ID)
+		}
+	}
+}
+
+// printImageTemplate prints each one of the given images by executing the
+// given Go template on it.
+func printImageTemplate(infos []imageInfo, format string) error {
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+
+	tmpl, err := template.New("images").Funcs(funcs).Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid format: %v", err)
+	}
+
+	for _, info := range infos {
+		if err := tmpl.Execute(os.Stdout, info); err != nil {
+			return fmt.Errorf("could not execute the given format: %v", err)
+		}
+		fmt.Println()
+	}
+	return nil
 }
 
 // The images command prints all the images that are based on SUSE.
@@ -56,10 +294,21 @@ func imagesCmd(ctx *cli.Context) {
 		cd.reset()
 	}
 
-	if imgs, err := client.ImageList(context.Background(), types.ImageListOptions{}); err != nil {
+	args, local, err := parseImageFilters(ctx.StringSlice("filter"))
+	if err != nil {
+		logAndFatalf("Error: %v.\n", err)
+		return
+	}
+	if ctx.IsSet("parallel") && ctx.Int("parallel") < 1 {
+		logAndFatalf("Error: the value of --parallel has to be greater than 0.\n")
+		return
+	}
+
+	if imgs, err := client.ImageList(context.Background(), types.ImageListOptions{Filters: args}); err != nil {
 		logAndFatalf("Cannot proceed safely: %v.", err)
+	} else if err = printImages(imgs, local, ctx); err != nil {
+		logAndFatalf("Error: %v.\n", err)
 	} else {
-		printImages(imgs)
 		exitWithCode(0)
 	}
 }
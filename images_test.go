@@ -16,13 +16,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"flag"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/api/types"
 	"github.com/mssola/capture"
 )
 
@@ -36,11 +42,12 @@ func TestMain(m *testing.M) {
 	defer func() {
 		_ = os.Setenv("HOME", home)
 		syscall.Umask(umask)
-		_ = os.Remove(filepath.Join(test, ".cache", cacheName))
+		_ = os.RemoveAll(filepath.Join(test, ".cache", "zypper-docker"))
 		os.Exit(status)
 	}()
 
 	_ = os.Setenv("HOME", test)
+	safeClient.client = &mockClient{}
 
 	status = m.Run()
 }
@@ -84,8 +91,8 @@ func TestImagesListUsingCache(t *testing.T) {
 
 	// Dump some dummy value.
 	cd := getCacheFile()
-	cd.Suse = []string{"1"}
-	cd.Other = []string{"3"}
+	cd.Images["1"] = &cachedImage{SUSE: true, CheckedAt: time.Now().UTC()}
+	cd.Images["3"] = &cachedImage{SUSE: false, CheckedAt: time.Now().UTC()}
 	cd.flush()
 
 	buffer := bytes.NewBuffer([]byte{})
@@ -112,12 +119,12 @@ func TestImagesForce(t *testing.T) {
 
 	// Dump some dummy value.
 	cd := getCacheFile()
-	cd.Suse = []string{"1234"}
+	cd.Images["1234"] = &cachedImage{SUSE: true, CheckedAt: time.Now().UTC()}
 	cd.flush()
 
 	// Check that they are really written there.
 	cd = getCacheFile()
-	if cd.Suse[0] != "1234" {
+	if exists, suse := cd.idExists("1234"); !exists || !suse {
 		t.Fatal("Unexpected value")
 	}
 
@@ -128,17 +135,11 @@ func TestImagesForce(t *testing.T) {
 	if !cd.Valid {
 		t.Fatal("It should be valid")
 	}
-	if len(cd.Suse) != 4 {
-		t.Fatalf("Expected 4 SUSE images, got %v", len(cd.Suse))
+	if suse := cachedIDs(cd, true); !reflect.DeepEqual(suse, []string{"1", "2", "4", "5"}) {
+		t.Fatalf("Unexpected SUSE images: %v", suse)
 	}
-
-	for i, v := range []string{"1", "2", "4", "5"} {
-		if cd.Suse[i] != v {
-			t.Fatal("Unexpected value")
-		}
-	}
-	if len(cd.Other) != 1 || cd.Other[0] != "3" {
-		t.Fatal("Unexpected value")
+	if other := cachedIDs(cd, false); !reflect.DeepEqual(other, []string{"3"}) {
+		t.Fatalf("Unexpected other images: %v", other)
 	}
 	if exitInvocations != 1 && lastCode != 0 {
 		t.Fatal("Wrong exit code")
@@ -213,3 +214,219 @@ func TestCheckImageExists(t *testing.T) {
 		}
 	}
 }
+
+func imagesWithFlags(args []string) []byte {
+	return imagesWithClientAndFlags(&mockClient{waitSleep: 100 * time.Millisecond}, args)
+}
+
+func imagesWithClientAndFlags(client *mockClient, args []string) []byte {
+	safeClient.client = client
+	setupTestExitStatus()
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+
+	ctx := testContextWithFlags(args, func(set *flag.FlagSet) {
+		set.String("format", "", "doc")
+		set.Bool("quiet", false, "doc")
+		set.Var(&cli.StringSlice{}, "filter", "doc")
+		set.Bool("check", false, "doc")
+		set.Bool("provenance", false, "doc")
+		set.Int("parallel", 0, "doc")
+	})
+	res := capture.All(func() { imagesCmd(ctx) })
+	return res.Stdout
+}
+
+func TestImagesFormatTemplate(t *testing.T) {
+	stdout := imagesWithFlags([]string{"--format", "{{.Repository}}:{{.Tag}} {{.ID}} {{.Outdated}}"})
+
+	testReaderData(t, bytes.NewBuffer(stdout), []string{
+		"opensuse:latest 1 false",
+		"opensuse:tag 1 false",
+		"opensuse:13.2 2 false",
+		"busybox:latest 5 false",
+	})
+	if exitInvocations != 1 && lastCode != 0 {
+		t.Fatal("Wrong exit code")
+	}
+}
+
+func TestImagesFormatInvalidTemplate(t *testing.T) {
+	imagesWithFlags([]string{"--format", "{{.Repository"})
+
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v", lastCode)
+	}
+}
+
+func TestImagesFormatJSON(t *testing.T) {
+	stdout := imagesWithFlags([]string{"--format", "json"})
+
+	infos := []imageInfo{}
+	if err := json.Unmarshal(stdout, &infos); err != nil {
+		t.Fatalf("Could not decode the JSON output: %v\n%s", err, stdout)
+	}
+	if len(infos) != 4 {
+		t.Fatalf("Expected 4 entries, got %v", len(infos))
+	}
+	if infos[2].Repository != "opensuse" || infos[2].Tag != "13.2" || infos[2].FullID != "2" || !infos[2].SUSE {
+		t.Fatalf("Unexpected entry: %+v", infos[2])
+	}
+}
+
+func TestImagesQuiet(t *testing.T) {
+	stdout := imagesWithFlags([]string{"-quiet"})
+
+	testReaderData(t, bytes.NewBuffer(stdout), []string{"1", "2", "5"})
+}
+
+func TestImagesFilter(t *testing.T) {
+	cd := getCacheFile()
+	cd.Images["2"] = &cachedImage{Outdated: true}
+	cd.flush()
+	defer func() {
+		cd = getCacheFile()
+		for _, img := range cd.Images {
+			img.Outdated = false
+		}
+		file, _ := os.Create(cd.Path)
+		_ = json.NewEncoder(file).Encode(cd)
+		_ = file.Close()
+	}()
+
+	stdout := imagesWithFlags([]string{"--filter", "reference=opensuse*", "--filter", "outdated=true", "--quiet"})
+	testReaderData(t, bytes.NewBuffer(stdout), []string{"2"})
+
+	args := safeClient.client.(*mockClient).lastImageList.Filters
+	if !args.ExactMatch("reference", "opensuse*") || args.Include("outdated") {
+		t.Fatalf("Unexpected filters forwarded to the daemon: %v", args)
+	}
+
+	stdout = imagesWithFlags([]string{"--filter", "outdated=false", "--quiet"})
+	testReaderData(t, bytes.NewBuffer(stdout), []string{"1", "5"})
+}
+
+func TestImagesFilterErrors(t *testing.T) {
+	for _, filter := range []string{"outdated", "outdated=maybe", "foo=bar"} {
+		imagesWithFlags([]string{"--filter", filter})
+		if lastCode != 1 {
+			t.Fatalf("Expected filter '%s' to fail", filter)
+		}
+	}
+}
+
+func TestImagesOS(t *testing.T) {
+	// Make sure that all the images are inspected again.
+	getCacheFile().reset()
+
+	stdout := imagesWithFlags([]string{})
+	lines := strings.Split(string(stdout), "\n")
+	if !strings.Contains(lines[0], "SIZE                OS") {
+		t.Fatalf("Unexpected header: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], "opensuse-leap 15.0") {
+		t.Fatalf("Unexpected line: %s", lines[1])
+	}
+
+	stdout = imagesWithFlags([]string{"--filter", "os=opensuse-leap:15", "--format", "{{.ID}} {{.OS.ID}} {{.OS.VersionID}}"})
+	testReaderData(t, bytes.NewBuffer(stdout), []string{
+		"1 opensuse-leap 15.0",
+		"1 opensuse-leap 15.0",
+		"2 opensuse-leap 15.0",
+		"5 opensuse-leap 15.0",
+	})
+
+	stdout = imagesWithFlags([]string{"--filter", "os=sles", "--quiet"})
+	if len(stdout) != 0 {
+		t.Fatalf("Nothing should have been printed, got: %s", stdout)
+	}
+}
+
+func TestImagesProvenance(t *testing.T) {
+	prov := &provenance{
+		BaseID:    "sha256:1234",
+		BaseName:  "opensuse:42.3",
+		Version:   "2.0.0",
+		Operation: "patch",
+		CreatedAt: time.Now().UTC(),
+		Patches:   []string{"openSUSE-2018-10", "openSUSE-2018-20"},
+		CVEs:      []string{"CVE-2018-1000300"},
+	}
+	client := &mockClient{labels: prov.labels()}
+
+	stdout := imagesWithClientAndFlags(client, []string{"--provenance"})
+	lines := strings.Split(string(stdout), "\n")
+	if !strings.Contains(lines[0], "BASE") || !strings.Contains(lines[0], "CVES") {
+		t.Fatalf("Unexpected header: %s", lines[0])
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields[len(fields)-4:], " ") != "opensuse:42.3 patch 2 1" {
+		t.Fatalf("Unexpected line: %s", lines[1])
+	}
+
+	stdout = imagesWithClientAndFlags(client, []string{"--format",
+		"{{.Repository}}:{{.Tag}} {{.Provenance.Operation}} {{join .Provenance.Patches \",\"}}"})
+	testReaderData(t, bytes.NewBuffer(stdout), []string{
+		"opensuse:latest patch openSUSE-2018-10,openSUSE-2018-20",
+		"opensuse:tag patch openSUSE-2018-10,openSUSE-2018-20",
+		"opensuse:13.2 patch openSUSE-2018-10,openSUSE-2018-20",
+		"busybox:latest patch openSUSE-2018-10,openSUSE-2018-20",
+	})
+}
+
+func TestImagesCheck(t *testing.T) {
+	client := &mockClient{waitSleep: 100 * time.Millisecond, logOutput: testPatchesXML}
+
+	stdout := imagesWithClientAndFlags(client, []string{"--check"})
+	lines := strings.Split(string(stdout), "\n")
+	if !strings.Contains(lines[0], "SECURITY") || !strings.Contains(lines[0], "OUTDATED") {
+		t.Fatalf("Unexpected header: %s", lines[0])
+	}
+
+	stdout = imagesWithClientAndFlags(client, []string{"--check", "--format",
+		"{{.Repository}}:{{.Tag}} {{.Patches.Security}}/{{.Patches.Needed}} {{.Outdated}}"})
+	testReaderData(t, bytes.NewBuffer(stdout), []string{
+		"opensuse:latest 1/2 false",
+		"opensuse:tag 1/2 false",
+		"opensuse:13.2 1/2 false",
+		"busybox:latest 1/2 false",
+	})
+}
+
+func TestImagesParallel(t *testing.T) {
+	cd := getCacheFile()
+	cd.reset()
+
+	stdout := imagesWithFlags([]string{"--parallel", "3"})
+	testReaderData(t, bytes.NewBuffer(stdout), []string{
+		"REPOSITORY",
+		"opensuse            latest              1",
+		"opensuse            tag                 1",
+		"opensuse            13.2                2",
+		"busybox             latest              5",
+	})
+
+	cd = getCacheFile()
+	suse, other := cachedIDs(cd, true), cachedIDs(cd, false)
+	if len(suse) != 4 || !reflect.DeepEqual(other, []string{"3"}) {
+		t.Fatalf("Unexpected cache contents: %v %v", suse, other)
+	}
+
+	imagesWithFlags([]string{"--parallel", "0"})
+	if lastCode != 1 {
+		t.Fatalf("Expected to exit with 1, got %v", lastCode)
+	}
+}
+
+func TestInspectImagesInterrupted(t *testing.T) {
+	safeClient.client = &mockClient{}
+	killChannel = make(chan bool)
+	close(killChannel)
+	defer func() { killChannel = nil }()
+
+	cd := &cachedData{}
+	images := []types.ImageSummary{{ID: "1"}, {ID: "2"}}
+	if _, interrupted := inspectImages(images, 2, cd); !interrupted {
+		t.Fatal("It should have been interrupted")
+	}
+}
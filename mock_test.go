@@ -15,12 +15,16 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -29,6 +33,8 @@ import (
 )
 
 type mockClient struct {
+	sync.Mutex
+
 	createFail         bool
 	createWarnings     bool
 	removeFail         bool
@@ -48,15 +54,60 @@ type mockClient struct {
 	zypperBadVersion   bool
 	zypperGoodVersion  bool
 	suppressLog        bool
+	logOutput          string
+	logOutputs         map[string]string
+	infoFail           bool
+	copyFail           bool
+	osRelease          string
+	osReleaseLink      bool
+	labels             map[string]string
+	daemonID           string
+	imageConfig        *container.Config
+	lastCommit         types.ContainerCommitOptions
+	committedConfig    *container.Config
+	lastImageList      types.ImageListOptions
+	lastContainerList  types.ContainerListOptions
+	tagFail            bool
+	tagged             map[string]string
+	removedImages      []string
+	images             []types.ImageSummary
+	containers         map[string]types.ContainerJSON
+	startFailFor       string
+	stopFail           bool
+	renameFail         bool
+	connectFail        bool
+	actions            []string
+	onAction           func(action string)
+	lastConfig         *container.Config
+	lastHostConfig     *container.HostConfig
+	lastNetworking     *network.NetworkingConfig
+}
+
+// record keeps track of the given action on containers, so tests can check
+// the order in which they have been performed. The `onAction` hook, if any,
+// is called afterwards.
+func (mc *mockClient) record(format string, args ...interface{}) {
+	action := fmt.Sprintf(format, args...)
+	mc.Lock()
+	mc.actions = append(mc.actions, action)
+	mc.Unlock()
+
+	if mc.onAction != nil {
+		mc.onAction(action)
+	}
 }
 
 func (mc *mockClient) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	mc.lastImageList = options
 	if mc.listFail {
 		return nil, errors.New("List Failed")
 	}
 	if mc.listEmpty {
 		return nil, nil
 	}
+	if mc.images != nil {
+		return mc.images, nil
+	}
 
 	// Let's return some more or less realistic images.
 	if mc.listReturnOneImage {
@@ -67,19 +118,19 @@ func (mc *mockClient) ImageList(ctx context.Context, options types.ImageListOpti
 				Size:        254515796, // 254.5 MB
 				VirtualSize: 254515796,
 				RepoTags:    []string{"opensuse:13.2"},
-				Created:     time.Now().UnixNano(),
+				Created:     time.Now().Unix(),
 			},
 		}, nil
 	}
 
-	return []types.ImageSummary{
+	images := []types.ImageSummary{
 		types.ImageSummary{
 			ID:          "1",
 			ParentID:    "0",       // Not used
 			Size:        254515796, // 254.5 MB
 			VirtualSize: 254515796,
 			RepoTags:    []string{"opensuse:latest", "opensuse:tag"},
-			Created:     time.Now().UnixNano(),
+			Created:     time.Now().Unix(),
 		},
 		types.ImageSummary{
 			ID:          "2",
@@ -87,7 +138,7 @@ func (mc *mockClient) ImageList(ctx context.Context, options types.ImageListOpti
 			Size:        254515796, // 254.5 MB
 			VirtualSize: 254515796,
 			RepoTags:    []string{"opensuse:13.2"},
-			Created:     time.Now().UnixNano(),
+			Created:     time.Now().Unix(),
 		},
 		types.ImageSummary{
 			ID:          "3",
@@ -95,7 +146,7 @@ func (mc *mockClient) ImageList(ctx context.Context, options types.ImageListOpti
 			Size:        254515796, // 254.5 MB
 			VirtualSize: 254515796,
 			RepoTags:    []string{"ubuntu:latest"},
-			Created:     time.Now().UnixNano(),
+			Created:     time.Now().Unix(),
 		},
 		types.ImageSummary{
 			ID:          "4",
@@ -103,7 +154,7 @@ func (mc *mockClient) ImageList(ctx context.Context, options types.ImageListOpti
 			Size:        254515796, // 254.5 MB
 			VirtualSize: 254515796,
 			RepoTags:    []string{}, // Invalid image
-			Created:     time.Now().UnixNano(),
+			Created:     time.Now().Unix(),
 		},
 		types.ImageSummary{
 			ID:          "5",
@@ -111,9 +162,13 @@ func (mc *mockClient) ImageList(ctx context.Context, options types.ImageListOpti
 			Size:        254515796, // 254.5 MB
 			VirtualSize: 254515796,
 			RepoTags:    []string{"busybox:latest"}, // Invalid image
-			Created:     time.Now().UnixNano(),
+			Created:     time.Now().Unix(),
 		},
-	}, nil
+	}
+	for i := range images {
+		images[i].Labels = mc.labels
+	}
+	return images, nil
 }
 
 func (mc *mockClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
@@ -134,8 +189,15 @@ func (mc *mockClient) ContainerCreate(ctx context.Context, config *container.Con
 	if !mc.suppressLog {
 		name = fmt.Sprintf("zypper-docker-private-%s", config.Image)
 	}
+	if containerName != "" {
+		name = "new-" + containerName
+		mc.record("create %s", containerName)
+	}
 
+	mc.Lock()
 	mc.lastCmd = config.Cmd
+	mc.lastConfig, mc.lastHostConfig, mc.lastNetworking = config, hostConfig, networkingConfig
+	mc.Unlock()
 
 	return container.ContainerCreateCreatedBody{ID: name, Warnings: warnings}, nil
 }
@@ -148,6 +210,26 @@ func (mc *mockClient) ContainerStart(ctx context.Context, containerID string, op
 		// Ubuntu doesn't have zypper: fail.
 		return errors.New("Start failed")
 	}
+	if mc.startFailFor != "" && containerID == mc.startFailFor {
+		return errors.New("Start failed")
+	}
+	mc.record("start %s", containerID)
+	return nil
+}
+
+func (mc *mockClient) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	if mc.stopFail {
+		return errors.New("Stop failed")
+	}
+	mc.record("stop %s", containerID)
+	return nil
+}
+
+func (mc *mockClient) ContainerRename(ctx context.Context, containerID, newContainerName string) error {
+	if mc.renameFail {
+		return errors.New("Rename failed")
+	}
+	mc.record("rename %s %s", containerID, newContainerName)
 	return nil
 }
 
@@ -158,6 +240,7 @@ func (mc *mockClient) ContainerRemove(ctx context.Context, containerID string, o
 	if !mc.suppressLog {
 		log.Printf("Removed container %v", containerID)
 	}
+	mc.record("remove %s", containerID)
 	return nil
 }
 
@@ -196,7 +279,11 @@ func (mc *mockClient) ContainerLogs(ctx context.Context, container string, optio
 		return nil, fmt.Errorf("Fake log failure")
 	}
 	cb := &closingBuffer{bytes.NewBuffer([]byte{})}
-	if mc.zypperBadVersion {
+	if output, ok := mc.logOutputs[container]; ok {
+		_, err = cb.WriteString(output)
+	} else if mc.logOutput != "" {
+		_, err = cb.WriteString(mc.logOutput)
+	} else if mc.zypperBadVersion {
 		_, err = cb.WriteString("Unknown option '--severity'\n")
 	} else if mc.zypperGoodVersion {
 		_, err = cb.WriteString("Missing argument for --severity\n")
@@ -214,13 +301,140 @@ func (mc *mockClient) ContainerKill(ctx context.Context, containerID, signal str
 }
 
 func (mc *mockClient) ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error) {
+	mc.lastCommit = options
 	if mc.commitFail {
 		return types.IDResponse{ID: ""}, fmt.Errorf("Fake failure while committing container")
 	}
+	config, err := mc.commitConfig(options)
+	if err != nil {
+		return types.IDResponse{ID: ""}, err
+	}
+	mc.committedConfig = config
 	return types.IDResponse{ID: "fake image ID"}, nil
 }
 
+// commitConfig returns the configuration that the Docker daemon gives to an
+// image committed with the given options: the changes are applied on top of
+// the given configuration, and then the user, the environment, the entrypoint
+// and the command are filled from the configuration of the container (the
+// last one created, on top of the one of its image) when they are empty.
+func (mc *mockClient) commitConfig(options types.ContainerCommitOptions) (*container.Config, error) {
+	config := &container.Config{}
+	if options.Config != nil {
+		*config = *options.Config
+	}
+	for _, change := range options.Changes {
+		parts := strings.SplitN(change, " ", 2)
+		switch parts[0] {
+		case "USER":
+			config.User = parts[1]
+		case "ENV":
+			env, err := parseEnvChange(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			config.Env = setEnv(config.Env, env)
+		case "ENTRYPOINT", "CMD":
+			var values []string
+			if parts[1] != "" {
+				if err := json.Unmarshal([]byte(parts[1]), &values); err != nil {
+					return nil, fmt.Errorf("invalid change %q: %v", change, err)
+				}
+			}
+			if parts[0] == "ENTRYPOINT" {
+				config.Entrypoint = values
+			} else if parts[1] != "" {
+				config.Cmd = values
+			}
+		default:
+			return nil, fmt.Errorf("unsupported change %q", change)
+		}
+	}
+
+	created := &container.Config{}
+	if mc.lastConfig != nil {
+		*created = *mc.lastConfig
+	}
+	if mc.imageConfig != nil {
+		if created.User == "" {
+			created.User = mc.imageConfig.User
+		}
+		created.Env = mergeEnv(created.Env, mc.imageConfig.Env)
+	}
+
+	if config.User == "" {
+		config.User = created.User
+	}
+	config.Env = mergeEnv(config.Env, created.Env)
+	if len(config.Entrypoint) == 0 {
+		if len(config.Cmd) == 0 {
+			config.Cmd = created.Cmd
+		}
+		if config.Entrypoint == nil {
+			config.Entrypoint = created.Entrypoint
+		}
+	}
+	return config, nil
+}
+
+// mergeEnv returns the given environment variables with the ones from
+// `other` whose name is not in there yet.
+func mergeEnv(env, other []string) []string {
+	if len(env) == 0 {
+		return other
+	}
+	res := append([]string{}, env...)
+	for _, o := range other {
+		found := false
+		for _, e := range env {
+			if strings.SplitN(e, "=", 2)[0] == strings.SplitN(o, "=", 2)[0] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// setEnv returns the given environment variables after setting the given
+// one, as the ENV directive does.
+func setEnv(env []string, variable string) []string {
+	name := strings.SplitN(variable, "=", 2)[0]
+	res := append([]string{}, env...)
+	for i, e := range res {
+		if strings.SplitN(e, "=", 2)[0] == name {
+			res[i] = variable
+			return res
+		}
+	}
+	return append(res, variable)
+}
+
+// parseEnvChange parses the `KEY="value"` argument of an ENV change.
+func parseEnvChange(arg string) (string, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || len(parts[1]) < 2 || parts[1][0] != '"' || parts[1][len(parts[1])-1] != '"' {
+		return "", fmt.Errorf("invalid ENV change %q", arg)
+	}
+
+	value := []byte{}
+	quoted := parts[1][1 : len(parts[1])-1]
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] == '\\' && i+1 < len(quoted) {
+			i++
+		} else if quoted[i] == '"' || quoted[i] == '$' {
+			return "", fmt.Errorf("unescaped %q in ENV change %q", quoted[i], arg)
+		}
+		value = append(value, quoted[i])
+	}
+	return parts[0] + "=" + string(value), nil
+}
+
 func (mc *mockClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	mc.lastContainerList = options
 	if mc.listFail {
 		return []types.Container{},
 			fmt.Errorf("Fake failure while listing containers")
@@ -267,19 +481,101 @@ func (mc *mockClient) ImageInspectWithRaw(ctx context.Context, imageID string) (
 	if mc.inspectFail {
 		return types.ImageInspect{}, []byte{}, errors.New("inspect fail")
 	}
-	return types.ImageInspect{ID: "1", Config: &container.Config{Image: "1"}}, []byte{}, nil
+	if mc.imageConfig != nil {
+		return types.ImageInspect{ID: "1", Config: mc.imageConfig}, []byte{}, nil
+	}
+	return types.ImageInspect{ID: "1", Config: &container.Config{Image: "1", Labels: mc.labels}}, []byte{}, nil
 }
 
 func (mc *mockClient) ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+	mc.removedImages = append(mc.removedImages, image)
 	if mc.removeFail {
 		return []types.ImageDeleteResponseItem{}, errors.New("remove fail")
 	}
 	return nil, nil
 }
 
+func (mc *mockClient) ImageTag(ctx context.Context, source, target string) error {
+	if mc.tagFail {
+		return errors.New("tag fail")
+	}
+	if mc.tagged == nil {
+		mc.tagged = map[string]string{}
+	}
+	mc.tagged[target] = source
+	return nil
+}
+
 func (mc *mockClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
 	if mc.inspectFail {
 		return types.ContainerJSON{}, errors.New("inspect fail")
 	}
+	if info, ok := mc.containers[containerID]; ok {
+		return info, nil
+	}
 	return types.ContainerJSON{Config: &container.Config{Image: "1"}}, nil
 }
+
+func (mc *mockClient) NetworkConnect(ctx context.Context, networkID, containerID string, config *network.EndpointSettings) error {
+	if mc.connectFail {
+		return errors.New("Connect failed")
+	}
+	mc.record("connect %s %s", networkID, containerID)
+	return nil
+}
+
+func (mc *mockClient) Info(ctx context.Context) (types.Info, error) {
+	if mc.infoFail {
+		return types.Info{}, errors.New("info fail")
+	}
+	if mc.daemonID == "" {
+		return types.Info{ID: "MOCK:DAEM:ON00"}, nil
+	}
+	return types.Info{ID: mc.daemonID}, nil
+}
+
+// Contents of the os-release files returned by the mock.
+const (
+	leapOSRelease = `NAME="openSUSE Leap"
+VERSION="15.0"
+ID="opensuse-leap"
+ID_LIKE="suse opensuse"
+VERSION_ID="15.0"
+PRETTY_NAME="openSUSE Leap 15.0"
+`
+	ubuntuOSRelease = `NAME="Ubuntu"
+VERSION="18.04.1 LTS (Bionic Beaver)"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 18.04.1 LTS"
+VERSION_ID="18.04"
+`
+)
+
+func (mc *mockClient) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	if mc.copyFail {
+		return nil, types.ContainerPathStat{}, errors.New("copy fail")
+	}
+
+	buf := &closingBuffer{bytes.NewBuffer([]byte{})}
+	tw := tar.NewWriter(buf)
+	if mc.osReleaseLink && srcPath == "/etc/os-release" {
+		_ = tw.WriteHeader(&tar.Header{Name: "os-release", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib/os-release"})
+		_ = tw.Close()
+		return buf, types.ContainerPathStat{}, nil
+	}
+	if mc.osReleaseLink && srcPath != "/usr/lib/os-release" {
+		return nil, types.ContainerPathStat{}, errors.New("not found")
+	}
+
+	contents := leapOSRelease
+	if mc.osRelease != "" {
+		contents = mc.osRelease
+	} else if containerID == "zypper-docker-private-3" {
+		contents = ubuntuOSRelease
+	}
+	_ = tw.WriteHeader(&tar.Header{Name: "os-release", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+	_, _ = tw.Write([]byte(contents))
+	_ = tw.Close()
+	return buf, types.ContainerPathStat{}, nil
+}
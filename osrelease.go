@@ -0,0 +1,182 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// osRelease identifies the operating system of an image, as given by its
+// os-release file.
+type osRelease struct {
+	// The ID and VERSION_ID fields (e.g. "sles" and "15.5").
+	ID        string `json:"id"`
+	VersionID string `json:"version_id,omitempty"`
+
+	// The ID_LIKE field (e.g. "suse opensuse").
+	IDLike string `json:"id_like,omitempty"`
+
+	// The VARIANT_ID field or, if it is not set, the type of image as given
+	// by the labels of SUSE BCI images (e.g. "sle-bci").
+	Variant string `json:"variant,omitempty"`
+}
+
+// newOSRelease returns the operating system described by the given fields of
+// an os-release file, or nil if they don't identify one.
+func newOSRelease(fields map[string]string) *osRelease {
+	if fields["ID"] == "" {
+		return nil
+	}
+	return &osRelease{
+		ID:        fields["ID"],
+		VersionID: fields["VERSION_ID"],
+		IDLike:    fields["ID_LIKE"],
+		Variant:   fields["VARIANT_ID"],
+	}
+}
+
+// String returns the ID and the version of the operating system, followed by
+// the variant if known (e.g. "sles 15.5 (sle-bci)").
+func (or *osRelease) String() string {
+	str := strings.TrimSpace(or.ID + " " + or.VersionID)
+	if or.Variant != "" {
+		str += " (" + or.Variant + ")"
+	}
+	return str
+}
+
+// isSUSE returns whether this operating system is either openSUSE or SLE (or
+// a derivative of them).
+func (or *osRelease) isSUSE() bool {
+	for _, id := range append([]string{or.ID}, strings.Fields(or.IDLike)...) {
+		if strings.Contains(id, "suse") || id == "sles" || id == "sled" || strings.HasPrefix(id, "sle-") || strings.HasPrefix(id, "sl-") {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether this operating system matches the given value of
+// the `os` filter, which has the "<id>[:<version>]" format. The version
+// matches whole components, so "15" matches "15.5" but not "155".
+func (or *osRelease) matches(value string) bool {
+	id, version := value, ""
+	if idx := strings.Index(value, ":"); idx >= 0 {
+		id, version = value[:idx], value[idx+1:]
+	}
+
+	if id != or.ID {
+		return false
+	}
+	return version == "" || or.VersionID == version || strings.HasPrefix(or.VersionID, version+".")
+}
+
+// parseOSRelease parses the contents of an os-release file and returns its
+// fields. Quotes around values are removed.
+func parseOSRelease(r io.Reader) map[string]string {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fields[kv[0]] = strings.Trim(kv[1], "\"'")
+	}
+	return fields
+}
+
+// osReleasePaths are the locations of the os-release file, in order of
+// preference.
+var osReleasePaths = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// readOSRelease returns the fields of the os-release file of the given image.
+// The file is copied from a container that is created but never started, so
+// this works even for images without a shell.
+func readOSRelease(img string) (map[string]string, error) {
+	id, err := createContainer(img, []string{"true"})
+	if err != nil {
+		return nil, err
+	}
+	defer removeContainer(id)
+
+	for _, p := range osReleasePaths {
+		var fields map[string]string
+		if fields, err = copyOSRelease(id, p, 0); err == nil {
+			return fields, nil
+		}
+	}
+	return nil, err
+}
+
+// maxSymlinks is the maximum number of symbolic links to be followed when
+// copying a file from a container.
+const maxSymlinks = 8
+
+// copyOSRelease copies the os-release file in the given path from the given
+// container and parses it. Symbolic links are followed.
+func copyOSRelease(containerID, p string, links int) (map[string]string, error) {
+	client := getDockerClient()
+	rc, _, err := client.CopyFromContainer(context.Background(), containerID, p)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", p, err)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		if links >= maxSymlinks {
+			return nil, fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target := hdr.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		return copyOSRelease(containerID, target, links+1)
+	case tar.TypeReg, tar.TypeRegA:
+		return parseOSRelease(io.LimitReader(tr, 64*1024)), nil
+	}
+	return nil, fmt.Errorf("%s is not a regular file", p)
+}
+
+// bciVariant returns the type of image as given by the labels of SUSE BCI
+// images, or an empty string if the labels are not there.
+func bciVariant(labels map[string]string) string {
+	if kind := labels["com.suse.image-type"]; kind != "" {
+		return kind
+	}
+	for key := range labels {
+		if strings.HasPrefix(key, "com.suse.bci.") {
+			return "bci"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	fields := parseOSRelease(strings.NewReader(`# Comment
+NAME="SLES"
+VERSION='15-SP5'
+ID=sles
+
+VARIANT_ID="bci"
+BROKEN LINE
+`))
+	expected := map[string]string{"NAME": "SLES", "VERSION": "15-SP5", "ID": "sles", "VARIANT_ID": "bci"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("Expected %v, got %v", expected, fields)
+	}
+
+	if newOSRelease(map[string]string{"NAME": "Unknown"}) != nil {
+		t.Fatal("There is no operating system without an ID")
+	}
+}
+
+func TestOSReleaseIsSUSE(t *testing.T) {
+	cases := []struct {
+		id, like string
+		suse     bool
+	}{
+		{"sles", "", true},
+		{"sled", "", true},
+		{"opensuse-leap", "suse opensuse", true},
+		{"opensuse-tumbleweed", "opensuse suse", true},
+		{"sle-micro", "suse", true},
+		{"sl-micro", "suse", true},
+		{"custom", "sles", true},
+		{"ubuntu", "debian", false},
+		{"alpine", "", false},
+		{"slackware", "", false},
+	}
+
+	for _, c := range cases {
+		or := &osRelease{ID: c.id, IDLike: c.like}
+		if or.isSUSE() != c.suse {
+			t.Fatalf("Expected %v for %+v", c.suse, or)
+		}
+	}
+}
+
+func TestOSReleaseMatches(t *testing.T) {
+	or := &osRelease{ID: "sles", VersionID: "15.5"}
+
+	for _, value := range []string{"sles", "sles:15", "sles:15.5"} {
+		if !or.matches(value) {
+			t.Fatalf("%v should match", value)
+		}
+	}
+	for _, value := range []string{"opensuse-leap", "sles:1", "sles:15.4", "sles:15.5.1"} {
+		if or.matches(value) {
+			t.Fatalf("%v should not match", value)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+)
+
+// formatTable is the value to be given to the `--format` flag of the packages
+// commands in order to explicitly get the default table.
+const formatTable = "table"
+
+// packageList is the JSON document printed by the packages command.
+type packageList struct {
+	Packages []rpmPackage `json:"packages"`
+}
+
+// zypper-docker packages [flags] <image>
+func packagesCmd(ctx *cli.Context) {
+	image := ctx.Args().First()
+	err := listPackages(image, ctx)
+	exitOnError(image, "rpm -qa", err)
+}
+
+// zypper-docker packages-container [flags] <container>
+func packagesContainerCmd(ctx *cli.Context) {
+	image, err := commandInContainer(listPackages, ctx)
+	exitOnError(image, "rpm -qa", err)
+}
+
+// listPackages prints the packages installed in the given image which match
+// the patterns given through the `--name` flag.
+func listPackages(image string, ctx *cli.Context) error {
+	if image == "" {
+		logAndFatalf("Error: no image name specified.\n")
+		return nil
+	}
+	if !checkFormat(ctx, formatJSON, formatTable) {
+		return nil
+	}
+	patterns := ctx.StringSlice("name")
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logAndFatalf("Error: invalid name pattern '%s'.\n", pattern)
+			return nil
+		}
+	}
+
+	packages, err := fetchPackages(image)
+	if err != nil {
+		return err
+	}
+	packages = filterPackages(packages, patterns)
+
+	if ctx.String("format") == formatJSON {
+		return printJSON(packageList{Packages: packages})
+	}
+	printPackages(packages)
+	return nil
+}
+
+// filterPackages returns the packages whose name matches any of the given
+// shell patterns. All the packages are returned if no pattern is given.
+func filterPackages(packages []rpmPackage, patterns []string) []rpmPackage {
+	if len(patterns) == 0 {
+		return packages
+	}
+
+	filtered := []rpmPackage{}
+	for _, pkg := range packages {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, pkg.Name); matched {
+				filtered = append(filtered, pkg)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// printPackages prints the given packages as a table.
+func printPackages(packages []rpmPackage) {
+	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tVERSION\tARCH\tVENDOR\tINSTALLED")
+	for _, pkg := range packages {
+		installed := "-"
+		if !pkg.InstallTime.IsZero() {
+			installed = pkg.InstallTime.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", pkg.Name, pkg.evr(), pkg.Arch,
+			valueOrDash(pkg.Vendor), installed)
+	}
+	writer.Flush()
+}
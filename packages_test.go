@@ -0,0 +1,104 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFilterPackages(t *testing.T) {
+	packages, _ := parsePackages(testPackagesAfter)
+
+	if res := filterPackages(packages, nil); len(res) != len(packages) {
+		t.Fatalf("Expected all the packages, got: %+v", res)
+	}
+	res := filterPackages(packages, []string{"*curl*", "zlib"})
+	if len(res) != 3 || res[0].Name != "curl" || res[1].Name != "libcurl4" || res[2].Name != "zlib" {
+		t.Fatalf("Unexpected packages: %+v", res)
+	}
+	if res := filterPackages(packages, []string{"vim"}); len(res) != 0 {
+		t.Fatalf("Expected no packages, got: %+v", res)
+	}
+}
+
+func TestPackagesCommand(t *testing.T) {
+	client := &mockClient{logOutputs: map[string]string{"zypper-docker-private-opensuse:42.3": testPackagesBefore}}
+
+	stdout, logged := runCommand(client, "packages", "opensuse:42.3")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 7 || strings.Join(strings.Fields(lines[0]), " ") != "NAME VERSION ARCH VENDOR INSTALLED" {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+	if !strings.HasPrefix(strings.Join(strings.Fields(lines[1]), " "), "bash 4.4-9.3 x86_64 SUSE LLC <https://www.suse.com/> 2018-0") {
+		t.Fatalf("Unexpected line: %s", lines[1])
+	}
+	if cmd := strings.Join(client.lastCmd, ""); !strings.HasPrefix(cmd, "rpm -qa --qf") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+
+	stdout, _ = runCommand(client, "packages", "--format", "json", "--name", "kernel-*", "opensuse:42.3")
+	list := packageList{}
+	if err := json.Unmarshal([]byte(stdout), &list); err != nil {
+		t.Fatalf("Could not decode the packages: %v\n%s", err, stdout)
+	}
+	if len(list.Packages) != 2 || list.Packages[1].Release != "2.1" || list.Packages[1].InstallTime.Unix() != 1527811200 {
+		t.Fatalf("Unexpected packages: %+v", list.Packages)
+	}
+}
+
+func TestPackagesCommandErrors(t *testing.T) {
+	_, logged := runCommand(&mockClient{}, "packages")
+	if lastCode != 1 || !strings.Contains(logged, "no image name specified") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{}, "packages", "--format", "yaml", "opensuse:42.3")
+	if lastCode != 1 || !strings.Contains(logged, "unknown format 'yaml'") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{}, "packages", "--name", "[", "opensuse:42.3")
+	if lastCode != 1 || !strings.Contains(logged, "invalid name pattern '['") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{startFail: true}, "packages", "opensuse:42.3")
+	if lastCode != 1 || !strings.Contains(logged, "Could not execute command 'rpm -qa' successfully in image 'opensuse:42.3'") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+}
+
+func TestPackagesContainerCommand(t *testing.T) {
+	client := &mockClient{logOutputs: map[string]string{"zypper-docker-private-fake image ID": testPackagesAfter}}
+
+	stdout, logged := runCommand(client, "packages-container", "--name", "libcurl4", "suse")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+	if !strings.Contains(stdout, "Checking running container suse") || !strings.Contains(stdout, "libcurl4") ||
+		strings.Contains(stdout, "zlib") {
+		t.Fatalf("Unexpected output: %s", stdout)
+	}
+
+	_, logged = runCommand(&mockClient{inspectFail: true}, "packages-container", "suse")
+	if lastCode != 1 || !strings.Contains(logged, "container suse does not exist") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+}
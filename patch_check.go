@@ -14,7 +14,106 @@
 
 package main
 
-import "github.com/codegangsta/cli"
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// formatShort is the value to be given to the `--format` flag of the
+// patch-check command in order to get the summary in a single line.
+const formatShort = "short"
+
+// patchSummary holds the number of patches needed by an image, as printed by
+// the patch-check command when a format has been requested.
+type patchSummary struct {
+	Needed         int            `json:"needed"`
+	Security       int            `json:"security"`
+	Recommended    int            `json:"recommended"`
+	Optional       int            `json:"optional"`
+	Categories     map[string]int `json:"categories"`
+	Severities     map[string]int `json:"severities"`
+	PackageManager bool           `json:"package_manager"`
+}
+
+// newPatchSummary computes the summary of the needed patches from the given
+// list.
+func newPatchSummary(patches []patch) *patchSummary {
+	summary := &patchSummary{
+		Categories: map[string]int{},
+		Severities: map[string]int{},
+	}
+
+	for _, p := range patches {
+		if p.Status != "needed" {
+			continue
+		}
+
+		summary.Needed++
+		summary.Categories[p.Category]++
+		summary.Severities[p.Severity]++
+		switch p.Category {
+		case "security":
+			summary.Security++
+		case "recommended":
+			summary.Recommended++
+		case "optional":
+			summary.Optional++
+		}
+		if p.PackageManager {
+			summary.PackageManager = true
+		}
+	}
+	return summary
+}
+
+// exitCode returns the exit code that zypper's patch-check command would have
+// returned for this summary. Like zypper, optional patches are not taken into
+// account.
+func (ps *patchSummary) exitCode() int64 {
+	if ps.Security > 0 {
+		return zypperExitInfSecUpdateNeeded
+	}
+	if ps.Needed > ps.Optional {
+		return zypperExitInfUpdateNeeded
+	}
+	return zypperExitOK
+}
+
+// String returns the summary in a single line of "key=value" pairs.
+func (ps *patchSummary) String() string {
+	fields := []string{
+		fmt.Sprintf("needed=%d", ps.Needed),
+		fmt.Sprintf("security=%d", ps.Security),
+		fmt.Sprintf("recommended=%d", ps.Recommended),
+		fmt.Sprintf("optional=%d", ps.Optional),
+	}
+
+	severities := make([]string, 0, len(ps.Severities))
+	for severity := range ps.Severities {
+		severities = append(severities, severity)
+	}
+	sort.Strings(severities)
+	for _, severity := range severities {
+		fields = append(fields, fmt.Sprintf("severity.%s=%d", severity, ps.Severities[severity]))
+	}
+
+	fields = append(fields, fmt.Sprintf("package-manager=%v", ps.PackageManager))
+	return strings.Join(fields, " ")
+}
+
+// fetchPatchSummary returns the summary of the patches needed by the given
+// image. Optional patches are hidden by zypper unless requested, so they are
+// always listed. The given flags are appended to the listing command.
+func fetchPatchSummary(image, flags string) (*patchSummary, error) {
+	patches, err := fetchPatches(image, "lp --with-optional"+flags)
+	if patches == nil {
+		return nil, err
+	}
+	return newPatchSummary(patches), nil
+}
 
 // zypper-docker patch-check [flags] <image>
 func patchCheckCmd(ctx *cli.Context) {
@@ -30,10 +129,36 @@ func patchCheckContainerCmd(ctx *cli.Context) {
 }
 
 // patchCheck calls the `zypper pchk` command for the given image and the given
-// arguments.
+// arguments. If a format has been requested, then the summary of the needed
+// patches is printed instead, while keeping the exit code that zypper would
+// have used.
 func patchCheck(image string, ctx *cli.Context) error {
+	if !checkFormat(ctx, formatJSON, formatShort) {
+		return nil
+	}
+
+	if format := ctx.String("format"); format != "" {
+		flags := cmdWithFlags("", ctx, []string{}, []string{"base", "format"})
+		summary, err := fetchPatchSummary(image, flags)
+		if err != nil {
+			return err
+		}
+
+		if format == formatJSON {
+			if err = printJSON(summary); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println(summary)
+		}
+		exitCodeMutex.Lock()
+		zypperExitCode = summary.exitCode()
+		exitCodeMutex.Unlock()
+		return nil
+	}
+
 	err := runStreamedCommand(
 		image,
-		cmdWithFlags("pchk", ctx, []string{}, []string{"base"}), true)
+		cmdWithFlags("pchk", ctx, []string{}, []string{"base", "format"}), true)
 	return err
 }
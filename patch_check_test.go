@@ -14,7 +14,17 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
 
 // PATCH-CHECK
 
@@ -44,3 +54,98 @@ func TestPatchCheckContainerCommand(t *testing.T) {
 	}
 	cases.run(t, patchCheckContainerCmd, "zypper pchk", "")
 }
+
+// PATCH-CHECK SUMMARY
+
+func patchCheckFormat(t *testing.T, format string) string {
+	setupTestExitStatus()
+	zypperExitCode = 0
+	safeClient.client = &mockClient{logOutput: testPatchesXML}
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+
+	ctx := testContextWithFlags([]string{"--format", format, "opensuse:13.2"}, func(set *flag.FlagSet) {
+		set.String("format", "", "doc")
+	})
+	captured := capture.All(func() { patchCheckCmd(ctx) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, buffer.String())
+	}
+	if zypperExitCode != zypperExitInfSecUpdateNeeded {
+		t.Fatalf("Expected the exit code %v, got %v", zypperExitInfSecUpdateNeeded, zypperExitCode)
+	}
+	return string(captured.Stdout)
+}
+
+func TestPatchCheckJSON(t *testing.T) {
+	output := patchCheckFormat(t, "json")
+	defer func() { zypperExitCode = 0 }()
+
+	summary := patchSummary{}
+	if err := json.Unmarshal([]byte(output), &summary); err != nil {
+		t.Fatalf("Could not decode the JSON output: %v\n%s", err, output)
+	}
+	expected := patchSummary{
+		Needed:         2,
+		Security:       1,
+		Recommended:    1,
+		Categories:     map[string]int{"security": 1, "recommended": 1},
+		Severities:     map[string]int{"important": 1, "moderate": 1},
+		PackageManager: true,
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, summary)
+	}
+}
+
+func TestPatchCheckShort(t *testing.T) {
+	output := patchCheckFormat(t, "short")
+	defer func() { zypperExitCode = 0 }()
+
+	expected := "needed=2 security=1 recommended=1 optional=0 severity.important=1 severity.moderate=1 package-manager=true"
+	if strings.TrimSpace(output) != expected {
+		t.Fatalf("Expected %q, got %q", expected, output)
+	}
+}
+
+func TestPatchSummaryExitCode(t *testing.T) {
+	summary := newPatchSummary([]patch{})
+	if summary.exitCode() != zypperExitOK {
+		t.Fatalf("Unexpected exit code %v", summary.exitCode())
+	}
+
+	summary = newPatchSummary([]patch{{Status: "needed", Category: "recommended"}, {Status: "applied", Category: "security"}})
+	if summary.Needed != 1 || summary.exitCode() != zypperExitInfUpdateNeeded {
+		t.Fatalf("Unexpected summary %+v", summary)
+	}
+
+	// Optional patches are counted, but they don't change the exit code.
+	summary = newPatchSummary([]patch{{Status: "needed", Category: "optional"}})
+	if summary.Needed != 1 || summary.Optional != 1 || summary.exitCode() != zypperExitOK {
+		t.Fatalf("Unexpected summary %+v", summary)
+	}
+}
+
+func TestPatchCheckOptional(t *testing.T) {
+	defer func() { zypperExitCode = 0 }()
+
+	// Optional patches are only listed by zypper when requested.
+	xml := strings.Replace(testPatchesXML, `category="recommended"`, `category="optional"`, 1)
+	client := &mockClient{logOutput: xml}
+	stdout, logged := runCommand(client, "patch-check", "--format", "json", "opensuse:13.2")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+	if cmd := strings.Join(client.lastCmd, " "); !strings.Contains(cmd, "lp --with-optional") {
+		t.Fatalf("Optional patches were not requested: %v", cmd)
+	}
+
+	summary := patchSummary{}
+	if err := json.Unmarshal([]byte(stdout), &summary); err != nil {
+		t.Fatalf("Could not decode the JSON output: %v\n%s", err, stdout)
+	}
+	if summary.Needed != 2 || summary.Optional != 1 || summary.Categories["optional"] != 1 {
+		t.Fatalf("Unexpected summary: %+v", summary)
+	}
+}
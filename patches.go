@@ -17,10 +17,33 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 )
 
+// patch is the representation of a patch as printed by the list-patches
+// command when the JSON format has been requested.
+type patch struct {
+	Name           string    `json:"name"`
+	Edition        string    `json:"edition"`
+	Category       string    `json:"category"`
+	Severity       string    `json:"severity"`
+	Status         string    `json:"status"`
+	IssueDate      time.Time `json:"issue_date"`
+	CVEs           []string  `json:"cves"`
+	Bugzilla       []string  `json:"bugzilla"`
+	Summary        string    `json:"summary"`
+	PackageManager bool      `json:"package_manager"`
+}
+
+// patchList is the JSON document printed by the list-patches command.
+type patchList struct {
+	Patches []patch `json:"patches"`
+}
+
 // zypper-docker list-patches [flags] <image>
 func listPatchesCmd(ctx *cli.Context) {
 	imageID := ctx.Args().First()
@@ -41,6 +64,9 @@ func listPatches(image string, ctx *cli.Context) error {
 		logAndFatalf("Error: no image name specified.\n")
 		exitWithCode(1)
 	}
+	if !checkFormat(ctx, formatJSON) {
+		return nil
+	}
 
 	if severity := ctx.String("severity"); severity != "" {
 		if ok, err := supportsSeverityFlag(image); !ok {
@@ -55,12 +81,75 @@ func listPatches(image string, ctx *cli.Context) error {
 		}
 	}
 
+	if ctx.String("format") == formatJSON {
+		cmd := cmdWithFlags("lp", ctx, []string{}, []string{"base", "format"})
+		patches, err := fetchPatches(image, cmd)
+		if patches != nil {
+			if jsonErr := printJSON(patchList{Patches: patches}); jsonErr != nil {
+				return jsonErr
+			}
+		}
+		return err
+	}
+
 	err := runStreamedCommand(
 		image,
-		cmdWithFlags("lp", ctx, []string{}, []string{"base"}), true)
+		cmdWithFlags("lp", ctx, []string{}, []string{"base", "format"}), true)
 	return err
 }
 
+// fetchPatches runs the given `zypper lp` command (filters included) in XML
+// mode for the given image and returns the parsed list of patches, sorted by
+// name. As it happens with `runXMLCommand`, the returned error might be a
+// non-severe dockerError.
+func fetchPatches(image, cmd string) ([]patch, error) {
+	stream, err := runXMLCommand(image, cmd)
+	if stream == nil {
+		return nil, err
+	}
+	return streamPatches(stream), err
+}
+
+// streamPatches returns the patches listed in the given zypper XML stream,
+// sorted by name.
+func streamPatches(stream *zypperStream) []patch {
+	patches := []patch{}
+	for _, update := range stream.Updates {
+		if update.Kind != "patch" {
+			continue
+		}
+
+		p := patch{
+			Name:           update.Name,
+			Edition:        update.Edition,
+			Category:       update.Category,
+			Severity:       update.Severity,
+			Status:         update.Status,
+			CVEs:           []string{},
+			Bugzilla:       []string{},
+			Summary:        strings.TrimSpace(update.Summary),
+			PackageManager: update.PkgManager,
+		}
+		if update.IssueDate.Time > 0 {
+			p.IssueDate = time.Unix(update.IssueDate.Time, 0).UTC()
+		}
+		for _, issue := range update.Issues {
+			switch issue.Type {
+			case "cve":
+				p.CVEs = append(p.CVEs, issue.ID)
+			case "bugzilla":
+				p.Bugzilla = append(p.Bugzilla, issue.ID)
+			}
+		}
+		patches = append(patches, p)
+	}
+
+	sort.Slice(patches, func(i, j int) bool {
+		return patches[i].Name < patches[j].Name
+	})
+	return patches
+}
+
 // zypper-docker patch [flags] image
 func patchCmd(ctx *cli.Context) {
 	updatePatchCmd("patch", ctx)
@@ -14,7 +14,16 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mssola/capture"
+)
 
 // PATCH
 func TestPatchCommand(t *testing.T) {
@@ -50,3 +59,109 @@ func TestListPatchesContainerCommand(t *testing.T) {
 	}
 	cases.run(t, listPatchesContainerCmd, "zypper lp", "")
 }
+
+// LIST PATCHES JSON
+
+const testPatchesXML = `<?xml version='1.0'?>
+<stream>
+<update-status version="0.6">
+<update-list>
+<update name="openSUSE-2018-20" edition="1" arch="noarch" status="needed" category="security" severity="important" pkgmanager="false" restart="false" interactive="false" kind="patch">
+  <summary>Security update for curl  </summary>
+  <description>This update for curl fixes several issues.</description>
+  <license></license>
+  <source url="http://download.opensuse.org/update/leap/42.3/oss/" alias="repo-update"/>
+  <issue-date time="1527000000"/>
+  <issue-list>
+    <issue type="cve" id="CVE-2018-1000300"/>
+    <issue type="bugzilla" id="1092098"/>
+  </issue-list>
+</update>
+<update name="openSUSE-2018-10" edition="1" arch="noarch" status="needed" category="recommended" severity="moderate" pkgmanager="true" restart="false" interactive="false" kind="patch">
+  <summary>Recommended update for zypper</summary>
+  <description>This update for zypper fixes a crash.</description>
+  <license></license>
+  <source url="http://download.opensuse.org/update/leap/42.3/oss/" alias="repo-update"/>
+  <issue-date time="1526000000"/>
+  <issue-list>
+    <issue type="bugzilla" id="1090001"/>
+  </issue-list>
+</update>
+</update-list>
+<blocked-update-list>
+</blocked-update-list>
+</update-status>
+</stream>
+`
+
+func listPatchesJSON(t *testing.T, client *mockClient, args []string) (patchList, string) {
+	setupTestExitStatus()
+	safeClient.client = client
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+
+	ctx := testContextWithFlags(args, func(set *flag.FlagSet) {
+		set.String("format", "", "doc")
+	})
+	captured := capture.All(func() { listPatchesCmd(ctx) })
+
+	list := patchList{}
+	if lastCode == 0 {
+		if err := json.Unmarshal(captured.Stdout, &list); err != nil {
+			t.Fatalf("Could not decode the JSON output: %v\n%s", err, captured.Stdout)
+		}
+	}
+	return list, buffer.String()
+}
+
+func TestListPatchesJSON(t *testing.T) {
+	client := &mockClient{logOutput: testPatchesXML}
+	list, _ := listPatchesJSON(t, client, []string{"--format", "json", "opensuse:13.2"})
+
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v", lastCode)
+	}
+	if cmd := strings.Join(client.lastCmd, ""); !strings.HasSuffix(cmd, "zypper --xmlout lp") {
+		t.Fatalf("Wrong command: %s", cmd)
+	}
+	if len(list.Patches) != 2 {
+		t.Fatalf("Expected 2 patches, got %v", len(list.Patches))
+	}
+
+	// Patches are sorted by name.
+	recommended, security := list.Patches[0], list.Patches[1]
+	if recommended.Name != "openSUSE-2018-10" || !recommended.PackageManager {
+		t.Fatalf("Unexpected patch: %+v", recommended)
+	}
+	if len(recommended.CVEs) != 0 || len(recommended.Bugzilla) != 1 {
+		t.Fatalf("Unexpected issues: %+v", recommended)
+	}
+	if security.Category != "security" || security.Severity != "important" || security.Status != "needed" {
+		t.Fatalf("Unexpected patch: %+v", security)
+	}
+	if security.Summary != "Security update for curl" {
+		t.Fatalf("Unexpected summary: %q", security.Summary)
+	}
+	if security.IssueDate.Unix() != 1527000000 {
+		t.Fatalf("Unexpected issue date: %v", security.IssueDate)
+	}
+	if err := compareStringSlices(security.CVEs, []string{"CVE-2018-1000300"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compareStringSlices(security.Bugzilla, []string{"1092098"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListPatchesJSONErrors(t *testing.T) {
+	_, logged := listPatchesJSON(t, &mockClient{}, []string{"--format", "yaml", "opensuse:13.2"})
+	if lastCode != 1 || !strings.Contains(logged, "unknown format 'yaml'") {
+		t.Fatalf("Expected an unknown format error, got %v: %s", lastCode, logged)
+	}
+
+	_, logged = listPatchesJSON(t, &mockClient{}, []string{"--format", "json", "opensuse:13.2"})
+	if lastCode != 1 || !strings.Contains(logged, "could not find the XML output of zypper") {
+		t.Fatalf("Expected a parsing error, got %v: %s", lastCode, logged)
+	}
+}
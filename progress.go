@@ -0,0 +1,73 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// progress reports how many items of an operation have been processed so
+// far. It is safe to use it from multiple goroutines. The report is written to
+// the standard error and only if it is attached to a terminal, so it never
+// gets mixed with the actual output of a command.
+type progress struct {
+	sync.Mutex
+
+	label string
+	total int
+	done  int
+	out   io.Writer
+}
+
+// newProgress returns a new progress report for the given number of items.
+func newProgress(label string, total int) *progress {
+	p := &progress{label: label, total: total}
+	if isTerminal(os.Stderr.Fd()) {
+		p.out = os.Stderr
+	}
+	p.print()
+	return p
+}
+
+// increment marks one more item as processed.
+func (p *progress) increment() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.done++
+	p.print()
+}
+
+// finish clears the line used to report the progress.
+func (p *progress) finish() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.out != nil {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
+
+// print writes the current progress. The caller is responsible for holding
+// the lock when needed.
+func (p *progress) print() {
+	if p.out == nil || p.total == 0 {
+		return
+	}
+	fmt.Fprintf(p.out, "\r\033[K%s: %d/%d (%d%%)", p.label, p.done, p.total, p.done*100/p.total)
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Labels set on the images committed by the patch and update commands, so
+// it's possible to tell where they come from and what has been applied. The
+// digest and the name of the base image and the creation date follow the OCI
+// annotations, while the rest are specific to zypper-docker.
+const (
+	labelBaseDigest = "org.opencontainers.image.base.digest"
+	labelBaseName   = "org.opencontainers.image.base.name"
+	labelCreated    = "org.opencontainers.image.created"
+
+	labelPrefix    = "com.suse.zypper-docker."
+	labelBaseID    = labelPrefix + "base.id"
+	labelVersion   = labelPrefix + "version"
+	labelOperation = labelPrefix + "operation"
+	labelFilters   = labelPrefix + "filters"
+	labelPatches   = labelPrefix + "patches"
+	labelCVEs      = labelPrefix + "cves"
+)
+
+// provenance describes how an image has been produced by zypper-docker.
+type provenance struct {
+	// The ID and the reference of the image that has been patched or updated,
+	// and the digest of its manifest if it has been pushed or pulled.
+	BaseID     string `json:"base_id"`
+	BaseName   string `json:"base_name"`
+	BaseDigest string `json:"base_digest,omitempty"`
+
+	// The version of zypper-docker that produced the image.
+	Version string `json:"version"`
+
+	// The operation that produced the image: either "patch" or "update".
+	Operation string `json:"operation"`
+
+	// The filter flags given to zypper (e.g. "--category security").
+	Filters string `json:"filters,omitempty"`
+
+	// When the image was produced.
+	CreatedAt time.Time `json:"created_at"`
+
+	// The patches that were needed by the base image and have been applied,
+	// and the CVEs fixed by them. These are unknown for updates.
+	Patches []string `json:"patches"`
+	CVEs    []string `json:"cves"`
+}
+
+// newProvenance returns the provenance of an image produced by applying the
+// given operation with the given filters on the given base image, whose repo
+// digests are also given. The applied patches have to be set afterwards.
+func newProvenance(baseID, baseName string, repoDigests []string, operation, filters string) *provenance {
+	return &provenance{
+		BaseID:     baseID,
+		BaseName:   baseName,
+		BaseDigest: baseDigest(baseName, repoDigests),
+		Version:    version(),
+		Operation:  operation,
+		Filters:    strings.TrimSpace(filters),
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// baseDigest returns the manifest digest of the image with the given name out
+// of its given repo digests (e.g. "opensuse@sha256:..."). The digest of the
+// repository of the given name is preferred, since an image can be pushed to
+// many of them. An empty string is returned if the image has no repo digests,
+// as happens with images that have been built locally.
+func baseDigest(name string, repoDigests []string) string {
+	repo, _, _ := parseImageName(name)
+	digest := ""
+	for _, rd := range repoDigests {
+		parts := strings.SplitN(rd, "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] == repo {
+			return parts[1]
+		}
+		if digest == "" {
+			digest = parts[1]
+		}
+	}
+	return digest
+}
+
+// setPatches records the given patches, skipping the ones that are not
+// needed.
+func (p *provenance) setPatches(patches []patch) {
+	p.Patches, p.CVEs = []string{}, []string{}
+	for _, patch := range patches {
+		if patch.Status != "needed" {
+			continue
+		}
+		p.Patches = append(p.Patches, patch.Name)
+		p.CVEs = append(p.CVEs, patch.CVEs...)
+	}
+	p.CVEs = removeDuplicates(p.CVEs)
+	sort.Strings(p.CVEs)
+}
+
+// labels returns the labels to be set on the produced image.
+func (p *provenance) labels() map[string]string {
+	labels := map[string]string{
+		labelBaseID:    p.BaseID,
+		labelBaseName:  p.BaseName,
+		labelCreated:   p.CreatedAt.Format(time.RFC3339),
+		labelVersion:   p.Version,
+		labelOperation: p.Operation,
+		labelFilters:   p.Filters,
+	}
+	if p.BaseDigest != "" {
+		labels[labelBaseDigest] = p.BaseDigest
+	}
+	// Patches are only set if they are known.
+	if p.Patches != nil {
+		labels[labelPatches] = strings.Join(p.Patches, ",")
+		labels[labelCVEs] = strings.Join(p.CVEs, ",")
+	}
+	return labels
+}
+
+// parseProvenance returns the provenance described by the given labels, or
+// nil if the image has not been produced by zypper-docker.
+func parseProvenance(labels map[string]string) *provenance {
+	operation, ok := labels[labelOperation]
+	if !ok {
+		return nil
+	}
+
+	prov := &provenance{
+		BaseID:     labels[labelBaseID],
+		BaseName:   labels[labelBaseName],
+		BaseDigest: labels[labelBaseDigest],
+		Version:    labels[labelVersion],
+		Operation:  operation,
+		Filters:    labels[labelFilters],
+	}
+	if patches, ok := labels[labelPatches]; ok {
+		prov.Patches, prov.CVEs = splitLabel(patches), splitLabel(labels[labelCVEs])
+	}
+	if created, err := time.Parse(time.RFC3339, labels[labelCreated]); err == nil {
+		prov.CreatedAt = created
+	}
+	return prov
+}
+
+// splitLabel splits the given comma-separated label value.
+func splitLabel(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+// The patch command lists the patches it's about to apply in XML, between
+// these markers, from the same container that applies them. This way they
+// can be recorded without spawning an additional container.
+const (
+	patchesBeginMarker = "zypper-docker-patches-begin"
+	patchesEndMarker   = "zypper-docker-patches-end"
+)
+
+// patchesListCommand returns the shell command that lists between markers
+// the patches matching the given filters. Its exit code is always zero.
+func patchesListCommand(filters string) string {
+	return fmt.Sprintf("{ echo %s; %s; echo %s; }", patchesBeginMarker,
+		formatZypperCommand("--xmlout lp"+filters), patchesEndMarker)
+}
+
+// patchesWriter is a writer that forwards the output of the patch command to
+// another writer, except for the list of patches given between markers (see
+// `patchesListCommand`), which is kept instead.
+type patchesWriter struct {
+	dst io.Writer
+
+	line      []byte
+	midLine   bool
+	capturing bool
+	listing   bytes.Buffer
+	listed    []string
+}
+
+func newPatchesWriter(dst io.Writer) *patchesWriter {
+	return &patchesWriter{dst: dst}
+}
+
+// Write implements the io.Writer interface. The output is forwarded as soon
+// as possible, so the progress of zypper is still shown as it happens.
+func (w *patchesWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		w.line = append(w.line, b)
+		if b == '\n' {
+			if err := w.endLine(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// Partial lines cannot be markers once they don't match their beginning.
+	partial := bytes.TrimRight(w.line, "\r")
+	if !w.capturing && len(w.line) > 0 && (w.midLine || !bytes.HasPrefix([]byte(patchesBeginMarker), partial)) {
+		if _, err := w.dst.Write(w.line); err != nil {
+			return 0, err
+		}
+		w.line, w.midLine = w.line[:0], true
+	}
+	return len(p), nil
+}
+
+// endLine handles the line that has just been completed.
+func (w *patchesWriter) endLine() error {
+	text := strings.TrimRight(string(w.line), "\r\n")
+	line, midLine := w.line, w.midLine
+	w.line, w.midLine = nil, false
+
+	switch {
+	case !w.capturing && !midLine && text == patchesBeginMarker:
+		w.capturing = true
+		w.listing.Reset()
+	case w.capturing && text == patchesEndMarker:
+		// The command might be restarted, so every listing is kept.
+		w.capturing = false
+		w.listed = append(w.listed, w.listing.String())
+	case w.capturing:
+		w.listing.Write(line)
+	default:
+		_, err := w.dst.Write(line)
+		return err
+	}
+	return nil
+}
+
+// patches returns the patches that have been listed, or nil if they could
+// not be parsed. If the command has been restarted (e.g. after an update of
+// the package manager), the listings of all the runs are merged: a patch is
+// considered needed if any of them reported it as such.
+func (w *patchesWriter) patches() []patch {
+	if len(w.listed) == 0 {
+		return nil
+	}
+
+	merged := map[string]patch{}
+	for _, listing := range w.listed {
+		stream, err := parseZypperXML(listing)
+		if err != nil {
+			return nil
+		}
+		for _, p := range streamPatches(stream) {
+			if old, ok := merged[p.Name]; !ok || (old.Status != "needed" && p.Status == "needed") {
+				merged[p.Name] = p
+			}
+		}
+	}
+
+	patches := []patch{}
+	for _, p := range merged {
+		patches = append(patches, p)
+	}
+	sort.Slice(patches, func(i, j int) bool {
+		return patches[i].Name < patches[j].Name
+	})
+	return patches
+}
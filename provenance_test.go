@@ -0,0 +1,219 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProvenanceLabels(t *testing.T) {
+	prov := &provenance{
+		BaseID:     "sha256:1234",
+		BaseName:   "opensuse:42.3",
+		BaseDigest: "sha256:abcd",
+		Version:    "2.0.0",
+		Operation:  "patch",
+		Filters:    "--category security",
+		CreatedAt:  time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	prov.setPatches([]patch{
+		{Name: "openSUSE-2018-1", Status: "needed", CVEs: []string{"CVE-2018-2", "CVE-2018-1"}},
+		{Name: "openSUSE-2018-2", Status: "applied", CVEs: []string{"CVE-2018-3"}},
+		{Name: "openSUSE-2018-3", Status: "needed", CVEs: []string{"CVE-2018-1"}},
+	})
+
+	labels := prov.labels()
+	expected := map[string]string{
+		"org.opencontainers.image.base.digest": "sha256:abcd",
+		"com.suse.zypper-docker.base.id":       "sha256:1234",
+		"org.opencontainers.image.base.name":   "opensuse:42.3",
+		"org.opencontainers.image.created":     "2018-06-01T12:00:00Z",
+		"com.suse.zypper-docker.version":       "2.0.0",
+		"com.suse.zypper-docker.operation":     "patch",
+		"com.suse.zypper-docker.filters":       "--category security",
+		"com.suse.zypper-docker.patches":       "openSUSE-2018-1,openSUSE-2018-3",
+		"com.suse.zypper-docker.cves":          "CVE-2018-1,CVE-2018-2",
+	}
+	if len(labels) != len(expected) {
+		t.Fatalf("Unexpected labels: %v", labels)
+	}
+	for k, v := range expected {
+		if labels[k] != v {
+			t.Fatalf("Expected '%s' for %s, got '%s'", v, k, labels[k])
+		}
+	}
+
+	parsed := parseProvenance(labels)
+	if parsed == nil || parsed.BaseID != prov.BaseID || parsed.BaseName != prov.BaseName ||
+		parsed.BaseDigest != prov.BaseDigest || parsed.Operation != "patch" || parsed.Filters != prov.Filters || !parsed.CreatedAt.Equal(prov.CreatedAt) {
+		t.Fatalf("Unexpected provenance: %+v", parsed)
+	}
+	if err := compareStringSlices(parsed.Patches, prov.Patches); err != nil {
+		t.Fatal(err)
+	}
+	if err := compareStringSlices(parsed.CVEs, prov.CVEs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvenanceWithoutPatches(t *testing.T) {
+	prov := &provenance{Operation: "update"}
+	labels := prov.labels()
+	if _, ok := labels[labelPatches]; ok {
+		t.Fatal("Patches should not be set if they are unknown")
+	}
+	if _, ok := labels[labelBaseDigest]; ok {
+		t.Fatal("The base digest should not be set if it is unknown")
+	}
+
+	parsed := parseProvenance(labels)
+	if parsed == nil || parsed.Patches != nil || parsed.CVEs != nil {
+		t.Fatalf("Unexpected provenance: %+v", parsed)
+	}
+
+	if parseProvenance(map[string]string{"maintainer": "someone"}) != nil {
+		t.Fatal("Images not produced by zypper-docker have no provenance")
+	}
+}
+
+func TestBaseDigest(t *testing.T) {
+	digests := []string{"registry.example.com/opensuse@sha256:1111", "opensuse@sha256:2222"}
+
+	tests := []struct {
+		name, digests, expected string
+	}{
+		{"opensuse:42.3", "both", "sha256:2222"},
+		{"registry.example.com/opensuse:42.3", "both", "sha256:1111"},
+		{"local:latest", "both", "sha256:1111"},
+		{"opensuse:42.3", "none", ""},
+	}
+	for _, test := range tests {
+		var repoDigests []string
+		if test.digests == "both" {
+			repoDigests = digests
+		}
+		if digest := baseDigest(test.name, repoDigests); digest != test.expected {
+			t.Fatalf("Expected '%s' for %s, got '%s'", test.expected, test.name, digest)
+		}
+	}
+}
+
+func TestPatchesWriter(t *testing.T) {
+	buffer := bytes.NewBuffer([]byte{})
+	w := newPatchesWriter(buffer)
+
+	// The listing is captured even if it's written in pieces. The command
+	// is restarted after the update of the package manager, so the second
+	// listing only contains the patches that are left.
+	start := strings.Index(testPatchesXML, `<update name="openSUSE-2018-10"`)
+	end := strings.Index(testPatchesXML, "</update-list>")
+	left := testPatchesXML[:start] + testPatchesXML[end:]
+	output := "Loading\r" + patchesBeginMarker + "\r\n<stream></stream>\r\n" + patchesEndMarker +
+		"\r\nzypper-docker\r\n" + patchesBeginMarker + "\r\n" + testPatchesXML + "\r\n" +
+		patchesEndMarker + "\r\nRestarting\r\n" + patchesBeginMarker + "\r\n" + left + "\r\n" +
+		patchesEndMarker + "\r\nDone\r\n"
+	for i := 0; i < len(output); i += 7 {
+		end := i + 7
+		if end > len(output) {
+			end = len(output)
+		}
+		if _, err := w.Write([]byte(output[i:end])); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Markers in the middle of a line are forwarded.
+	expected := "Loading\r" + patchesBeginMarker + "\r\n<stream></stream>\r\n" + patchesEndMarker +
+		"\r\nzypper-docker\r\nRestarting\r\nDone\r\n"
+	if buffer.String() != expected {
+		t.Fatalf("Unexpected output: %q", buffer.String())
+	}
+
+	// The patches of both runs are recorded.
+	names := []string{}
+	for _, p := range w.patches() {
+		names = append(names, p.Name)
+	}
+	if err := compareStringSlices(names, []string{"openSUSE-2018-10", "openSUSE-2018-20"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if newPatchesWriter(buffer).patches() != nil {
+		t.Fatal("Patches should be unknown if they have not been listed")
+	}
+}
+
+func TestPatchProvenance(t *testing.T) {
+	// The patches are listed by the same container that applies them.
+	output := "Refreshing service\r\n" + patchesBeginMarker + "\r\n" + testPatchesXML +
+		"\r\n" + patchesEndMarker + "\r\nInstalling patches\r\n"
+	mock := &mockClient{logOutput: output}
+	stdout, logged := runCommand(mock, "patch", "--cve", "CVE-2018-1000300", "--author", "me", "--message", "msg",
+		"-l", "opensuse:13.2", "new:patched")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+
+	labels := mock.lastCommit.Config.Labels
+	prov := parseProvenance(labels)
+	if prov == nil {
+		t.Fatalf("No provenance was recorded: %v", labels)
+	}
+	if prov.BaseID != "1" || prov.BaseName != "opensuse:13.2" || prov.Operation != "patch" ||
+		prov.Filters != "--cve=CVE-2018-1000300" || prov.Version != version() {
+		t.Fatalf("Unexpected provenance: %+v", prov)
+	}
+	if err := compareStringSlices(prov.Patches, []string{"openSUSE-2018-10", "openSUSE-2018-20"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compareStringSlices(prov.CVEs, []string{"CVE-2018-1000300"}); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(prov.CreatedAt) > time.Minute {
+		t.Fatalf("Unexpected creation date: %v", prov.CreatedAt)
+	}
+
+	// The filters were also given to zypper, both when listing and applying
+	// the patches, and only the output of the latter is shown.
+	cmd := strings.Join(mock.lastCmd, "")
+	if !strings.Contains(cmd, "--xmlout lp --cve=CVE-2018-1000300;") ||
+		!strings.Contains(cmd, "-n patch --cve=CVE-2018-1000300 -l") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+	if !strings.Contains(stdout, "Refreshing service\r\nInstalling patches\r\n") ||
+		strings.Contains(stdout, "openSUSE-2018-10") || strings.Contains(stdout, patchesBeginMarker) {
+		t.Fatalf("Unexpected output: %q", stdout)
+	}
+}
+
+func TestUpdateProvenance(t *testing.T) {
+	mock := &mockClient{}
+	_, logged := runCommand(mock, "update", "opensuse:13.2", "new:updated")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+
+	// The patches are neither listed nor recorded for updates.
+	prov := parseProvenance(mock.lastCommit.Config.Labels)
+	if prov == nil || prov.Operation != "update" || prov.Patches != nil || prov.CVEs != nil {
+		t.Fatalf("Unexpected provenance: %+v", prov)
+	}
+	if cmd := strings.Join(mock.lastCmd, ""); strings.Contains(cmd, patchesBeginMarker) {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+}
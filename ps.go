@@ -17,17 +17,37 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 
 	"github.com/codegangsta/cli"
 	"github.com/docker/docker/api/types"
 )
 
+// containerFilters contains the filters of the ps command, which are all
+// forwarded to the Docker daemon.
+var containerFilters = []string{"name", "label", "ancestor", "status"}
+
 // zypper-docker ps
 func psCmd(ctx *cli.Context) {
+	args, _, err := parseFilters(ctx.StringSlice("filter"), containerFilters, []string{})
+	if err != nil {
+		logAndFatalf("Error: %v.\n", err)
+		return
+	}
+
+	all := ctx.Bool("all")
+	state := "running "
+	if all {
+		state = ""
+	}
+
 	client := getDockerClient()
-	containers, err := client.ContainerList(context.Background(), types.ContainerListOptions{})
+	containers, err := client.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     all,
+		Filters: args,
+	})
 	if err != nil {
-		logAndFatalf("Error while fetching running containers: %v\n", err)
+		logAndFatalf("Error while fetching %scontainers: %v\n", state, err)
 		return
 	}
 
@@ -38,7 +58,7 @@ func psCmd(ctx *cli.Context) {
 	unknown := []types.Container{}
 
 	if len(containers) == 0 {
-		fmt.Println("There are no running containers to analyze.")
+		fmt.Printf("There are no %scontainers to analyze.\n", state)
 		return
 	}
 
@@ -57,19 +77,40 @@ func psCmd(ctx *cli.Context) {
 		}
 	}
 
+	var checks []containerCheck
+	if ctx.Bool("check") && len(unknown) > 0 {
+		var ignored []types.Container
+		checks, ignored, unknown = checkContainers(unknown, ctx.Int("parallel"), cache)
+		notSuse = append(notSuse, ignored...)
+		cache.flush()
+	}
+
+	// Sections are separated by an empty line.
+	separate := false
+	section := func(title string) {
+		if separate {
+			fmt.Printf("\n")
+		}
+		separate = true
+		fmt.Println(title)
+	}
+
 	if len(matches) > 0 {
-		fmt.Println("Running containers whose images have been updated:")
+		if all {
+			section("Containers whose images have been updated:")
+		} else {
+			section("Running containers whose images have been updated:")
+		}
 		for _, container := range matches {
 			fmt.Printf("  - %s [%s]\n", container.ID, container.Image)
 		}
-		fmt.Println("It is recommended to stop the container and start a new instance based on the new image created with zypper-docker")
+		fmt.Println("It is recommended to stop the container and start a new instance based on the new image created with zypper-docker. The \"rollout\" command can do it for you.")
 	}
 
+	printChecks(checks, section)
+
 	if len(notSuse) > 0 {
-		if len(matches) > 0 {
-			fmt.Printf("\n")
-		}
-		fmt.Println("The following containers have been ignored because are known to be based on non-SUSE systems:")
+		section("The following containers have been ignored because are known to be based on non-SUSE systems:")
 
 		for _, container := range notSuse {
 			fmt.Printf("  - %s [%s]\n", container.ID, container.Image)
@@ -77,10 +118,7 @@ func psCmd(ctx *cli.Context) {
 	}
 
 	if len(unknown) > 0 {
-		if len(matches) > 0 || len(notSuse) > 0 {
-			fmt.Printf("\n")
-		}
-		fmt.Println("The following containers have an unknown state:")
+		section("The following containers have an unknown state:")
 
 		for _, container := range unknown {
 			fmt.Printf("  - %s [%s]\n", container.ID, container.Image)
@@ -89,3 +127,107 @@ func psCmd(ctx *cli.Context) {
 		fmt.Println("Use either the \"list-patches-container\" or the \"list-updates-container\" commands to inspect them.")
 	}
 }
+
+// containerCheck holds the summary of the patches needed by the image of a
+// container.
+type containerCheck struct {
+	container types.Container
+	summary   *patchSummary
+}
+
+// checkContainers checks the images of the given containers for needed
+// patches. Containers sharing the same image are only checked once, and up to
+// `parallel` images are checked at the same time. It returns the results of
+// the checks, the containers that turned out to be based on non-SUSE images
+// and the containers whose image could not be checked.
+func checkContainers(containers []types.Container, parallel int, cache *cachedData) ([]containerCheck, []types.Container, []types.Container) {
+	ids, names := []string{}, []string{}
+	for _, container := range containers {
+		if !arrayIncludeString(ids, container.ImageID) {
+			ids = append(ids, container.ImageID)
+			names = append(names, container.Image)
+		}
+	}
+
+	// Images that have not been checked because of an interruption are left
+	// as non-checked, so their containers end up as failed.
+	checked := make([]bool, len(ids))
+	suse := make([]bool, len(ids))
+	summaries := make([]*patchSummary, len(ids))
+	forEachParallel(len(ids), parallel, func(i int) {
+		if suse[i] = cache.isSUSE(ids[i]); suse[i] {
+			summary, err := fetchPatchSummary(ids[i], "")
+			if err != nil {
+				log.Printf("Could not check patches of image %s: %v", names[i], err)
+			}
+			summaries[i] = summary
+		}
+		checked[i] = true
+	})
+
+	checks := []containerCheck{}
+	notSuse := []types.Container{}
+	failed := []types.Container{}
+	for _, container := range containers {
+		i := 0
+		for ids[i] != container.ImageID {
+			i++
+		}
+
+		switch {
+		case checked[i] && !suse[i]:
+			notSuse = append(notSuse, container)
+		case summaries[i] == nil:
+			failed = append(failed, container)
+		default:
+			checks = append(checks, containerCheck{container: container, summary: summaries[i]})
+		}
+	}
+	return checks, notSuse, failed
+}
+
+// printChecks prints the results of the given checks, grouped by whether the
+// image of the container has pending security patches, other pending patches
+// or no pending patches at all. As in patch-check, optional patches are not
+// taken into account. The given function is called to print the title of
+// each group.
+func printChecks(checks []containerCheck, section func(string)) {
+	var security, other, upToDate []containerCheck
+	for _, check := range checks {
+		switch {
+		case check.summary.Security > 0:
+			security = append(security, check)
+		case check.summary.Needed > check.summary.Optional:
+			other = append(other, check)
+		default:
+			upToDate = append(upToDate, check)
+		}
+	}
+
+	if len(security) > 0 {
+		section("The following containers are based on images with pending security patches:")
+		for _, check := range security {
+			fmt.Printf("  - %s [%s]: %d security patches (%d needed patches in total)\n",
+				check.container.ID, check.container.Image, check.summary.Security, check.summary.Needed)
+		}
+	}
+
+	if len(other) > 0 {
+		section("The following containers are based on images with pending patches:")
+		for _, check := range other {
+			fmt.Printf("  - %s [%s]: %d needed patches\n",
+				check.container.ID, check.container.Image, check.summary.Needed)
+		}
+	}
+
+	if len(upToDate) > 0 {
+		section("The following containers are based on images without pending patches:")
+		for _, check := range upToDate {
+			fmt.Printf("  - %s [%s]\n", check.container.ID, check.container.Image)
+		}
+	}
+
+	if len(security) > 0 || len(other) > 0 {
+		fmt.Println("Use the \"patch\" command to create patched images. Note that only the images have been checked, use \"list-patches-container\" to take into account changes made inside of the containers.")
+	}
+}
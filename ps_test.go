@@ -16,10 +16,13 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"log"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/codegangsta/cli"
 	"github.com/mssola/capture"
 )
 
@@ -58,8 +61,10 @@ func TestPsCommandNoMatches(t *testing.T) {
 
 func TestPsCommandMatches(t *testing.T) {
 	cacheFile := getCacheFile()
-	cacheFile.Outdated = []string{"2"} // this is the Id of the opensuse:13.2 image
-	cacheFile.Other = []string{"3"}    // this is the Id of the ubuntu:latest image
+	// 2 is the Id of the opensuse:13.2 image, 3 is the Id of the ubuntu:latest
+	// image.
+	cacheFile.Images["2"] = &cachedImage{SUSE: true, CheckedAt: time.Now().UTC(), Outdated: true}
+	cacheFile.Images["3"] = &cachedImage{SUSE: false, CheckedAt: time.Now().UTC()}
 	cacheFile.flush()
 
 	setupTestExitStatus()
@@ -87,3 +92,66 @@ func TestPsCommandMatches(t *testing.T) {
 		t.Fatalf("Exit status should be 1, %v given", lastCode)
 	}
 }
+
+func TestPsCommandAllAndFilters(t *testing.T) {
+	setupTestExitStatus()
+	client := &mockClient{listEmpty: true}
+	safeClient.client = client
+
+	ctx := testContextWithFlags([]string{"--all", "--filter", "status=exited", "--filter", "name=web"}, func(set *flag.FlagSet) {
+		set.Bool("all", false, "doc")
+		set.Var(&cli.StringSlice{}, "filter", "doc")
+	})
+	rec := capture.All(func() { psCmd(ctx) })
+
+	if !strings.Contains(string(rec.Stdout), "There are no containers to analyze") {
+		t.Fatalf("Wrong message: %s", rec.Stdout)
+	}
+	opts := client.lastContainerList
+	if !opts.All || !opts.Filters.ExactMatch("status", "exited") || !opts.Filters.ExactMatch("name", "web") {
+		t.Fatalf("Wrong options given to the daemon: %+v", opts)
+	}
+	if lastCode != 0 {
+		t.Fatalf("Exit status should be 0, %v given", lastCode)
+	}
+}
+
+func TestPsCommandInvalidFilter(t *testing.T) {
+	setupTestExitStatus()
+	safeClient.client = &mockClient{}
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	ctx := testContextWithFlags([]string{"--filter", "before=foo"}, func(set *flag.FlagSet) {
+		set.Var(&cli.StringSlice{}, "filter", "doc")
+	})
+	capture.All(func() { psCmd(ctx) })
+
+	if lastCode != 1 || !strings.Contains(buffer.String(), "invalid filter 'before'") {
+		t.Fatalf("Expected an invalid filter error, got %v: %s", lastCode, buffer.String())
+	}
+}
+
+func TestPsCommandCheck(t *testing.T) {
+	setupTestExitStatus()
+	safeClient.client = &mockClient{logOutput: testPatchesXML}
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+	ctx := testContextWithFlags([]string{"--check"}, func(set *flag.FlagSet) {
+		set.Bool("check", false, "doc")
+	})
+	rec := capture.All(func() { psCmd(ctx) })
+	stdout := string(rec.Stdout)
+
+	if !strings.Contains(stdout, "The following containers are based on images with pending security patches:\n"+
+		"  - 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01 [opensuse:13.2]: 1 security patches (2 needed patches in total)") {
+		t.Fatalf("Wrong message: %s", stdout)
+	}
+	if !strings.Contains(stdout, "  - 3 [ubuntu:latest]") || strings.Contains(stdout, "unknown state") {
+		t.Fatalf("Wrong message: %s", stdout)
+	}
+	if lastCode != 0 {
+		t.Fatalf("Exit status should be 0, %v given", lastCode)
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stringid"
+)
+
+// Statuses of the containers handled by the rollout command, on top of the
+// skipped and failed ones of batch operations.
+const (
+	rolloutRecreated = "recreated"
+	rolloutPending   = "to recreate"
+)
+
+// outdatedSuffix is appended to the name of the outdated containers while
+// they are being replaced, and it's kept if the --keep flag is given.
+const outdatedSuffix = "-outdated"
+
+// rolloutJob describes the recreation of a container based on an outdated
+// image.
+type rolloutJob struct {
+	// The ID and the name of the container, and the reference of the image
+	// it's based on.
+	ID    string
+	Name  string
+	Image string
+
+	// The image from which the new container is created.
+	Target string
+
+	// The outcome of the job.
+	Status  string
+	Details string
+}
+
+// latestImage returns the last image produced by patching or updating the
+// image with the given ID, as recorded in the given cache, out of the given
+// images. Images that have been removed are skipped, so the last one that is
+// still around is picked. It returns false if there's no such image.
+func latestImage(id string, images map[string]types.ImageSummary, cache *cachedData) (types.ImageSummary, bool) {
+	chain := cache.successors(id)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if img, ok := images[chain[i]]; ok {
+			return img, true
+		}
+	}
+	return types.ImageSummary{}, false
+}
+
+// imageReference returns the first tag of the given image in alphabetical
+// order, or its short ID if it's not tagged.
+func imageReference(img types.ImageSummary, cache *cachedData) string {
+	names := []string{}
+	for _, info := range newImageInfos(img, cache) {
+		if info.Repository != "<none>" {
+			names = append(names, info.Repository+":"+info.Tag)
+		}
+	}
+	if len(names) == 0 {
+		return shortImageID(img.ID)
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// containerLink converts a link as reported when inspecting a container
+// (e.g. "/db:/web/db") into the form expected when creating one ("db:db").
+func containerLink(link string) string {
+	parts := strings.SplitN(link, ":", 2)
+	if len(parts) != 2 {
+		return link
+	}
+	return strings.TrimPrefix(parts[0], "/") + ":" + path.Base(parts[1])
+}
+
+// endpointConfig returns the configuration of the given network attachment,
+// leaving out the operational data assigned by Docker.
+func endpointConfig(settings *network.EndpointSettings, shortID string) *network.EndpointSettings {
+	endpoint := &network.EndpointSettings{
+		IPAMConfig: settings.IPAMConfig,
+		Links:      settings.Links,
+		DriverOpts: settings.DriverOpts,
+	}
+	for _, alias := range settings.Aliases {
+		if alias != shortID {
+			endpoint.Aliases = append(endpoint.Aliases, alias)
+		}
+	}
+	return endpoint
+}
+
+// recreateConfig returns the configuration of a container equivalent to the
+// given one but based on the given image. Labels inherited from the original
+// image are left out, so the ones of the new image are picked instead. The
+// networking configuration contains the network given by the network mode,
+// while the rest of networks are returned separately: they have to be
+// connected once the container has been created.
+func recreateConfig(info types.ContainerJSON, image string, imageLabels map[string]string) (*container.Config, *container.HostConfig, *network.NetworkingConfig, map[string]*network.EndpointSettings) {
+	// Docker uses the truncated ID as the default hostname and as a network
+	// alias, so the new container gets its own instead.
+	shortID := stringid.TruncateID(info.ID)
+
+	config := *info.Config
+	config.Image = image
+	if config.Hostname == shortID {
+		config.Hostname = ""
+	}
+	config.Labels = map[string]string{}
+	for key, value := range info.Config.Labels {
+		if inherited, ok := imageLabels[key]; !ok || inherited != value {
+			config.Labels[key] = value
+		}
+	}
+
+	hostConfig := *info.HostConfig
+	hostConfig.Links = nil
+	for _, link := range info.HostConfig.Links {
+		hostConfig.Links = append(hostConfig.Links, containerLink(link))
+	}
+
+	// Anonymous volumes are mounted again, so the data is not lost.
+	hostConfig.Binds = append([]string{}, info.HostConfig.Binds...)
+	mounted := map[string]bool{}
+	for _, bind := range hostConfig.Binds {
+		if parts := strings.Split(bind, ":"); len(parts) > 1 {
+			mounted[parts[1]] = true
+		}
+	}
+	for _, m := range hostConfig.Mounts {
+		mounted[m.Target] = true
+	}
+	for _, m := range info.Mounts {
+		if m.Type != mount.TypeVolume || m.Name == "" || mounted[m.Destination] {
+			continue
+		}
+		bind := m.Name + ":" + m.Destination
+		if !m.RW {
+			bind += ":ro"
+		}
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+	}
+
+	primary := string(info.HostConfig.NetworkMode)
+	if primary == "default" {
+		primary = "bridge"
+	}
+	endpoints := map[string]*network.EndpointSettings{}
+	extra := map[string]*network.EndpointSettings{}
+	if info.NetworkSettings != nil {
+		for name, settings := range info.NetworkSettings.Networks {
+			if name == primary {
+				endpoints[name] = endpointConfig(settings, shortID)
+			} else {
+				extra[name] = endpointConfig(settings, shortID)
+			}
+		}
+	}
+	return &config, &hostConfig, &network.NetworkingConfig{EndpointsConfig: endpoints}, extra
+}
+
+// restoreContainer removes the new container, if any, and brings back the
+// original container under its name. The original container is started again
+// if it was running.
+func restoreContainer(info types.ContainerJSON, name, newID string, running bool) error {
+	client := getDockerClient()
+	ctx := context.Background()
+
+	if newID != "" {
+		err := client.ContainerRemove(ctx, newID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return fmt.Errorf("could not remove the new container: %v", err)
+		}
+	}
+	if err := client.ContainerRename(ctx, info.ID, name); err != nil {
+		return fmt.Errorf("could not rename %s back: %v", info.ID, err)
+	}
+	if running {
+		if err := client.ContainerStart(ctx, info.ID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf("could not start %s again: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// errInterrupted is the error returned when a signal is received while a
+// container is being recreated.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted returns whether a signal asking to shut down has been received.
+func interrupted() bool {
+	select {
+	case <-killChannel:
+		return true
+	default:
+		return false
+	}
+}
+
+// recreate stops the given container and replaces it with an equivalent
+// container based on the target image of the job. The new container is only
+// started if the original one was running. If anything goes wrong, the
+// original container is restored.
+func (job *rolloutJob) recreate(info types.ContainerJSON, timeout time.Duration, keep bool) error {
+	client := getDockerClient()
+	ctx := context.Background()
+
+	var imageLabels map[string]string
+	if img, _, err := client.ImageInspectWithRaw(ctx, info.Image); err == nil && img.Config != nil {
+		imageLabels = img.Config.Labels
+	}
+	config, hostConfig, networking, extra := recreateConfig(info, job.Target, imageLabels)
+	running := info.State != nil && info.State.Running
+
+	if running {
+		if err := client.ContainerStop(ctx, info.ID, &timeout); err != nil {
+			return fmt.Errorf("could not stop the container: %v", err)
+		}
+	}
+
+	// The outdated container gives its name up, so the new one can take it.
+	// Signals are checked between each step, so the original container is
+	// restored before shutting down.
+	outdated := job.Name + outdatedSuffix
+	err := errInterrupted
+	if !interrupted() {
+		if err = client.ContainerRename(ctx, info.ID, outdated); err != nil {
+			err = fmt.Errorf("could not rename the container to %s: %v", outdated, err)
+		}
+	}
+	if err != nil {
+		if running {
+			if serr := client.ContainerStart(ctx, info.ID, types.ContainerStartOptions{}); serr != nil {
+				return fmt.Errorf("%v; could not start it again: %v", err, serr)
+			}
+		}
+		return err
+	}
+
+	var created container.ContainerCreateCreatedBody
+	if interrupted() {
+		err = errInterrupted
+	} else if created, err = client.ContainerCreate(ctx, config, hostConfig, networking, job.Name); err != nil {
+		err = fmt.Errorf("could not create the new container: %v", err)
+	}
+	if err == nil {
+		for _, name := range sortedKeys(extra) {
+			if cerr := client.NetworkConnect(ctx, name, created.ID, extra[name]); cerr != nil {
+				err = fmt.Errorf("could not connect the new container to %s: %v", name, cerr)
+				break
+			}
+		}
+	}
+	if err == nil && interrupted() {
+		err = errInterrupted
+	}
+	if err == nil && running {
+		if serr := client.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); serr != nil {
+			err = fmt.Errorf("could not start the new container: %v", serr)
+		}
+	}
+	if err != nil {
+		if rerr := restoreContainer(info, job.Name, created.ID, running); rerr != nil {
+			return fmt.Errorf("%v; the rollback failed: %v", err, rerr)
+		}
+		return fmt.Errorf("%v; the original container has been restored", err)
+	}
+
+	job.Details = "new container " + stringid.TruncateID(created.ID)
+	if keep {
+		job.Details += ", outdated one kept as " + outdated
+		return nil
+	}
+
+	// Volumes are shared with the new container, so they are not removed.
+	if err := client.ContainerRemove(ctx, info.ID, types.ContainerRemoveOptions{}); err != nil {
+		log.Printf("Could not remove the outdated container %s: %v", outdated, err)
+		job.Details += ", could not remove " + outdated
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the given map in alphabetical order.
+func sortedKeys(m map[string]*network.EndpointSettings) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// run recreates the container of the given job, unless dryRun is set. The
+// outcome is set as the status and the details of the job.
+func (job *rolloutJob) run(dryRun, keep bool, timeout time.Duration) {
+	info, err := getDockerClient().ContainerInspect(context.Background(), job.ID)
+	if err != nil {
+		job.Status, job.Details = batchFailed, fmt.Sprintf("could not inspect the container: %v", err)
+		log.Printf("Could not inspect container %s: %v", job.Name, err)
+		return
+	}
+	if info.ContainerJSONBase == nil || info.Config == nil || info.HostConfig == nil {
+		job.Status, job.Details = batchFailed, "incomplete container information"
+		return
+	}
+	if info.HostConfig.AutoRemove {
+		// Stopping it would remove it, so it could not be restored.
+		job.Status, job.Details = batchSkipped, "started with --rm"
+		return
+	}
+	if dryRun {
+		job.Status = rolloutPending
+		return
+	}
+
+	if err := job.recreate(info, timeout, keep); err != nil {
+		job.Status, job.Details = batchFailed, err.Error()
+		log.Printf("Could not recreate container %s: %v", job.Name, err)
+		return
+	}
+	job.Status = rolloutRecreated
+}
+
+// printRolloutJobs prints a table with the outcome of the given jobs,
+// followed by a summary line.
+func printRolloutJobs(jobs []*rolloutJob, done string) {
+	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(writer, "CONTAINER\tIMAGE\tNEW IMAGE\tSTATUS\tDETAILS")
+
+	counts := map[string]int{}
+	for _, job := range jobs {
+		counts[job.Status]++
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", job.Name, job.Image,
+			valueOrDash(job.Target), job.Status, valueOrDash(job.Details))
+	}
+	writer.Flush()
+
+	fmt.Printf("\n%d %s, %d %s, %d %s.\n", counts[done], done,
+		counts[batchSkipped], batchSkipped, counts[batchFailed], batchFailed)
+}
+
+// zypper-docker rollout [flags]
+func rolloutCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 0 {
+		logAndFatalf("Wrong invocation: expected no arguments, %d given.\n", len(ctx.Args()))
+		return
+	}
+	if ctx.Int("time") < 0 {
+		logAndFatalf("Error: the value of --time cannot be negative.\n")
+		return
+	}
+	args, _, err := parseFilters(ctx.StringSlice("filter"), containerFilters, []string{})
+	if err != nil {
+		logAndFatalf("Error: %v.\n", err)
+		return
+	}
+
+	all := ctx.Bool("all")
+	state := "running "
+	if all {
+		state = ""
+	}
+
+	client := getDockerClient()
+	containers, err := client.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     all,
+		Filters: args,
+	})
+	if err != nil {
+		logAndFatalf("Error while fetching %scontainers: %v\n", state, err)
+		return
+	}
+
+	cache := getCacheFile()
+	outdated := []types.Container{}
+	for _, c := range containers {
+		if cache.isImageOutdated(c.ImageID) {
+			outdated = append(outdated, c)
+		}
+	}
+	if len(outdated) == 0 {
+		fmt.Printf("There are no %scontainers based on outdated images.\n", state)
+		exitWithCode(0)
+		return
+	}
+
+	list, err := client.ImageList(context.Background(), types.ImageListOptions{})
+	if err != nil {
+		logAndFatalf("Cannot proceed safely: %v.\n", err)
+		return
+	}
+	images := map[string]types.ImageSummary{}
+	for _, img := range list {
+		images[img.ID] = img
+	}
+
+	jobs := []*rolloutJob{}
+	for _, c := range outdated {
+		job := &rolloutJob{ID: c.ID, Name: c.ID, Image: c.Image}
+		if len(c.Names) > 0 {
+			job.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if img, ok := latestImage(c.ImageID, images, cache); ok {
+			job.Target = imageReference(img, cache)
+		} else {
+			job.Status, job.Details = batchSkipped, "no patched image found"
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	dryRun := ctx.Bool("dry-run")
+	timeout := time.Duration(ctx.Int("time")) * time.Second
+	for _, job := range jobs {
+		if interrupted() {
+			return
+		}
+		if job.Status == "" {
+			job.run(dryRun, ctx.Bool("keep"), timeout)
+		}
+	}
+
+	done := rolloutRecreated
+	if dryRun {
+		fmt.Println("Dry run: no container will be touched.")
+		fmt.Println()
+		done = rolloutPending
+	}
+	printRolloutJobs(jobs, done)
+
+	for _, job := range jobs {
+		if job.Status == batchFailed {
+			exitWithCode(1)
+			return
+		}
+	}
+	exitWithCode(0)
+}
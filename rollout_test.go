@@ -0,0 +1,357 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+)
+
+// The ID of the image of the "suse" container returned by the mock.
+const testOutdatedImageID = "sha256:7f31a825a11ec6557fbddd5fea8b823a4709ee552233352e435b4840e14388bd"
+
+// testRolloutClient returns a mock client whose "suse" container is based on
+// an image that has been patched into "opensuse:13.2-patched".
+func testRolloutClient() *mockClient {
+	const id = "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01"
+
+	return &mockClient{
+		labels: map[string]string{"vendor": "SUSE"},
+		images: []types.ImageSummary{
+			{
+				ID:       "sha256:patched",
+				RepoTags: []string{"opensuse:13.2-patched"},
+			},
+		},
+		containers: map[string]types.ContainerJSON{
+			id: {
+				ContainerJSONBase: &types.ContainerJSONBase{
+					ID:    id,
+					Name:  "/suse",
+					Image: testOutdatedImageID,
+					State: &types.ContainerState{Running: true},
+					HostConfig: &container.HostConfig{
+						NetworkMode: "frontend",
+						Links:       []string{"/db:/suse/db"},
+						Binds:       []string{"data:/data"},
+					},
+				},
+				Mounts: []types.MountPoint{
+					{Type: mount.TypeVolume, Name: "data", Destination: "/data", RW: true},
+					{Type: mount.TypeVolume, Name: "anonymous", Destination: "/cache"},
+				},
+				Config: &container.Config{
+					Hostname: "35ae93c88cf8",
+					Image:    "opensuse:13.2",
+					Labels:   map[string]string{"vendor": "SUSE", "app": "web"},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"frontend": {Aliases: []string{"35ae93c88cf8", "web"}, IPAddress: "172.18.0.2"},
+						"backend":  {IPAddress: "172.19.0.2"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// runRolloutCommand runs the rollout command with the given client and
+// arguments, with the image of the "suse" and "not_suse" containers marked as
+// outdated. Only the former has been patched into "opensuse:13.2-patched".
+func runRolloutCommand(client *mockClient, args ...string) (string, string) {
+	defer restoreOutdatedImages()
+
+	cd := getCacheFile()
+	outdated := cd.entry(testOutdatedImageID)
+	outdated.Outdated, outdated.Successor = true, "sha256:patched"
+	cd.entry("2").Outdated = true
+	cd.flush()
+
+	return runCommand(client, append([]string{"rollout"}, args...)...)
+}
+
+func TestLatestImage(t *testing.T) {
+	cache := &cachedData{Valid: true, Images: map[string]*cachedImage{
+		"a": {Outdated: true, Successor: "b"},
+		"b": {Outdated: true, Successor: "c"},
+		"c": {Outdated: true, Successor: "d"},
+		"e": {Outdated: true},
+		"f": {Outdated: true, Successor: "g"},
+		"g": {Outdated: true, Successor: "f"},
+		"h": {Outdated: true, Successor: "removed"},
+	}}
+	// Image "d" has been removed since.
+	images := map[string]types.ImageSummary{}
+	for _, id := range []string{"a", "b", "c", "e", "f", "g", "h"} {
+		images[id] = types.ImageSummary{ID: id}
+	}
+
+	cases := []struct {
+		id, expected string
+	}{
+		{"a", "c"},
+		{"b", "c"},
+		{"c", ""},
+		{"d", ""},
+		{"e", ""},
+		{"f", "g"},
+		{"h", ""},
+	}
+	for _, c := range cases {
+		img, ok := latestImage(c.id, images, cache)
+		if ok != (c.expected != "") || img.ID != c.expected {
+			t.Fatalf("Expected %q for %s, got %q (%v)", c.expected, c.id, img.ID, ok)
+		}
+	}
+}
+
+func TestContainerLink(t *testing.T) {
+	for link, expected := range map[string]string{
+		"/db:/web/db":      "db:db",
+		"/db:/web/storage": "db:storage",
+		"db:storage":       "db:storage",
+		"db":               "db",
+	} {
+		if got := containerLink(link); got != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, link, got)
+		}
+	}
+}
+
+func TestRolloutCommand(t *testing.T) {
+	client := testRolloutClient()
+	stdout, _ := runRolloutCommand(client)
+
+	if lastCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", lastCode, stdout)
+	}
+	expected := []string{
+		"stop 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01",
+		"rename 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01 suse-outdated",
+		"create suse",
+		"connect backend new-suse",
+		"start new-suse",
+		"remove 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01",
+	}
+	if err := compareStringSlices(client.actions, expected); err != nil {
+		t.Fatalf("Unexpected actions %v: %v", client.actions, err)
+	}
+
+	config := client.lastConfig
+	if config.Image != "opensuse:13.2-patched" || config.Hostname != "" {
+		t.Fatalf("Unexpected config: %+v", config)
+	}
+	if len(config.Labels) != 1 || config.Labels["app"] != "web" {
+		t.Fatalf("Only the labels of the container should be kept: %v", config.Labels)
+	}
+	if err := compareStringSlices(client.lastHostConfig.Binds, []string{"data:/data", "anonymous:/cache:ro"}); err != nil {
+		t.Fatalf("Unexpected binds %v: %v", client.lastHostConfig.Binds, err)
+	}
+	if err := compareStringSlices(client.lastHostConfig.Links, []string{"db:db"}); err != nil {
+		t.Fatalf("Unexpected links %v: %v", client.lastHostConfig.Links, err)
+	}
+	endpoint, ok := client.lastNetworking.EndpointsConfig["frontend"]
+	if !ok || len(client.lastNetworking.EndpointsConfig) != 1 {
+		t.Fatalf("Unexpected networking config: %v", client.lastNetworking.EndpointsConfig)
+	}
+	if endpoint.IPAddress != "" || len(endpoint.Aliases) != 1 || endpoint.Aliases[0] != "web" {
+		t.Fatalf("Unexpected endpoint: %+v", endpoint)
+	}
+
+	for _, line := range []string{
+		"CONTAINER           IMAGE               NEW IMAGE               STATUS              DETAILS",
+		"not_suse            busybox:latest      -                       skipped             no patched image found",
+		"suse                opensuse:13.2       opensuse:13.2-patched   recreated           new container new-suse",
+		"1 recreated, 1 skipped, 0 failed.",
+	} {
+		if !strings.Contains(stdout, line) {
+			t.Fatalf("Expected %q in:\n%s", line, stdout)
+		}
+	}
+}
+
+func TestRolloutCommandKeep(t *testing.T) {
+	client := testRolloutClient()
+	stdout, _ := runRolloutCommand(client, "--keep")
+
+	for _, action := range client.actions {
+		if strings.HasPrefix(action, "remove") {
+			t.Fatalf("The outdated container should have been kept: %v", client.actions)
+		}
+	}
+	if !strings.Contains(stdout, "outdated one kept as suse-outdated") {
+		t.Fatalf("Unexpected output:\n%s", stdout)
+	}
+}
+
+func TestRolloutCommandDryRun(t *testing.T) {
+	client := testRolloutClient()
+	stdout, _ := runRolloutCommand(client, "--dry-run")
+
+	if len(client.actions) != 0 {
+		t.Fatalf("Nothing should have been done: %v", client.actions)
+	}
+	if lastCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", lastCode)
+	}
+	for _, line := range []string{
+		"Dry run: no container will be touched.",
+		"suse                opensuse:13.2       opensuse:13.2-patched   to recreate         -",
+		"1 to recreate, 1 skipped, 0 failed.",
+	} {
+		if !strings.Contains(stdout, line) {
+			t.Fatalf("Expected %q in:\n%s", line, stdout)
+		}
+	}
+}
+
+func TestRolloutCommandRollback(t *testing.T) {
+	client := testRolloutClient()
+	client.startFailFor = "new-suse"
+	stdout, logged := runRolloutCommand(client)
+
+	if lastCode != 1 {
+		t.Fatalf("Expected exit code 1, got %d", lastCode)
+	}
+	expected := []string{
+		"stop 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01",
+		"rename 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01 suse-outdated",
+		"create suse",
+		"connect backend new-suse",
+		"remove new-suse",
+		"rename 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01 suse",
+		"start 35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01",
+	}
+	if err := compareStringSlices(client.actions, expected); err != nil {
+		t.Fatalf("Unexpected actions %v: %v", client.actions, err)
+	}
+	msg := "could not start the new container: Start failed; the original container has been restored"
+	if !strings.Contains(stdout, msg) || !strings.Contains(logged, "Could not recreate container suse: "+msg) {
+		t.Fatalf("Unexpected output:\n%s\n%s", stdout, logged)
+	}
+	if !strings.Contains(stdout, "0 recreated, 1 skipped, 1 failed.") {
+		t.Fatalf("Unexpected summary:\n%s", stdout)
+	}
+}
+
+func TestRolloutCommandInterrupted(t *testing.T) {
+	const id = "35ae93c88cf8ab18da63bb2ad2dfd2399d745f292a344625fbb65892b7c25a01"
+	oldKill := killChannel
+	defer func() { killChannel = oldKill }()
+
+	// The signal is received right after the given action, and the original
+	// container is restored before giving up. The restart fails in the last
+	// case, which is reported as a failed rollback.
+	cases := []struct {
+		after    string
+		startFor string
+		actions  []string
+		msg      string
+	}{
+		{"stop " + id, "", []string{"stop " + id, "start " + id},
+			"Could not recreate container suse: interrupted"},
+		{"rename " + id + " suse-outdated", "", []string{
+			"stop " + id, "rename " + id + " suse-outdated", "rename " + id + " suse", "start " + id,
+		}, "Could not recreate container suse: interrupted; the original container has been restored"},
+		{"create suse", "", []string{
+			"stop " + id, "rename " + id + " suse-outdated", "create suse", "connect backend new-suse",
+			"remove new-suse", "rename " + id + " suse", "start " + id,
+		}, "Could not recreate container suse: interrupted; the original container has been restored"},
+		{"create suse", id, []string{
+			"stop " + id, "rename " + id + " suse-outdated", "create suse", "connect backend new-suse",
+			"remove new-suse", "rename " + id + " suse",
+		}, "Could not recreate container suse: interrupted; the rollback failed: could not start suse again: Start failed"},
+	}
+
+	for _, c := range cases {
+		killChannel = make(chan bool)
+		client := testRolloutClient()
+		client.startFailFor = c.startFor
+		after := c.after
+		client.onAction = func(action string) {
+			if action == after {
+				close(killChannel)
+			}
+		}
+		_, logged := runRolloutCommand(client)
+
+		if err := compareStringSlices(client.actions, c.actions); err != nil {
+			t.Fatalf("Interrupted after %q: unexpected actions %v: %v", c.after, client.actions, err)
+		}
+		if !strings.Contains(logged, c.msg) {
+			t.Fatalf("Interrupted after %q: expected %q in:\n%s", c.after, c.msg, logged)
+		}
+	}
+}
+
+func TestRolloutCommandFailures(t *testing.T) {
+	cases := []struct {
+		name     string
+		setup    func(*mockClient)
+		expected string
+	}{
+		{"Stop fails", func(mc *mockClient) { mc.stopFail = true },
+			"could not stop the container: Stop failed"},
+		{"Rename fails", func(mc *mockClient) { mc.renameFail = true },
+			"could not rename the container to suse-outdated: Rename failed"},
+		{"Create fails", func(mc *mockClient) { mc.createFail = true },
+			"could not create the new container: Create failed; the original container has been restored"},
+		{"Connect fails", func(mc *mockClient) { mc.connectFail = true },
+			"could not connect the new container to backend: Connect failed; the original container has been restored"},
+		{"Inspect fails", func(mc *mockClient) { mc.inspectFail = true },
+			"could not inspect the container: inspect fail"},
+	}
+
+	for _, c := range cases {
+		client := testRolloutClient()
+		c.setup(client)
+		stdout, _ := runRolloutCommand(client)
+
+		if lastCode != 1 {
+			t.Fatalf("%s: expected exit code 1, got %d", c.name, lastCode)
+		}
+		if !strings.Contains(stdout, c.expected) {
+			t.Fatalf("%s: expected %q in:\n%s", c.name, c.expected, stdout)
+		}
+	}
+}
+
+func TestRolloutCommandErrors(t *testing.T) {
+	_, logged := runRolloutCommand(testRolloutClient(), "suse")
+	if lastCode != 1 || !strings.Contains(logged, "Wrong invocation: expected no arguments, 1 given.") {
+		t.Fatalf("Unexpected outcome (%d): %s", lastCode, logged)
+	}
+
+	_, logged = runRolloutCommand(&mockClient{listFail: true})
+	if lastCode != 1 || !strings.Contains(logged, "Error while fetching running containers") {
+		t.Fatalf("Unexpected outcome (%d): %s", lastCode, logged)
+	}
+
+	stdout, _ := runRolloutCommand(&mockClient{listEmpty: true}, "--all")
+	if lastCode != 0 || !strings.Contains(stdout, "There are no containers based on outdated images.") {
+		t.Fatalf("Unexpected outcome (%d): %s", lastCode, stdout)
+	}
+
+	stdout, _ = runRolloutCommand(testRolloutClient(), "--time", "-1")
+	if lastCode != 1 {
+		t.Fatalf("Unexpected outcome (%d): %s", lastCode, stdout)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rpmQueryFormat is the query format given to `rpm -qa`. Each package is
+// printed in a single line with tab-separated fields.
+const rpmQueryFormat = `%{NAME}\t%{EPOCH}\t%{VERSION}\t%{RELEASE}\t%{ARCH}\t%{LICENSE}\t%{VENDOR}\t%{SOURCERPM}\t%{INSTALLTIME}\n`
+
+// rpmPackage is a package installed in an image, as reported by its rpm
+// database.
+type rpmPackage struct {
+	Name    string `json:"name"`
+	Epoch   string `json:"epoch,omitempty"`
+	Version string `json:"version"`
+	Release string `json:"release"`
+	Arch    string `json:"arch"`
+
+	// The license, the vendor and the source RPM of the package. They are
+	// empty if unknown.
+	License   string `json:"license,omitempty"`
+	Vendor    string `json:"vendor,omitempty"`
+	SourceRPM string `json:"source_rpm,omitempty"`
+
+	// InstallTime is when the package was installed in the image.
+	InstallTime time.Time `json:"install_time"`
+}
+
+// evr returns the "[epoch:]version-release" string of the package.
+func (p rpmPackage) evr() string {
+	if p.Epoch == "" {
+		return p.Version + "-" + p.Release
+	}
+	return p.Epoch + ":" + p.Version + "-" + p.Release
+}
+
+// compare compares the epoch, the version and the release of both packages
+// as rpm does. It returns 1 if p is newer than other, -1 if it's older and 0
+// if both are the same.
+func (p rpmPackage) compare(other rpmPackage) int {
+	if res := rpmvercmp(epochOrZero(p.Epoch), epochOrZero(other.Epoch)); res != 0 {
+		return res
+	}
+	if res := rpmvercmp(p.Version, other.Version); res != 0 {
+		return res
+	}
+	return rpmvercmp(p.Release, other.Release)
+}
+
+// epochOrZero returns the given epoch, or "0" if it's not set.
+func epochOrZero(epoch string) string {
+	if epoch == "" {
+		return "0"
+	}
+	return epoch
+}
+
+// fetchPackages returns the packages installed in the given image, sorted by
+// name and architecture. The rpm database is queried directly, so the
+// repositories of the image are not needed.
+func fetchPackages(img string) ([]rpmPackage, error) {
+	buf := bytes.NewBuffer([]byte{})
+	id, err := runCommandInContainer(img, []string{"rpm -qa --qf '" + rpmQueryFormat + "'"}, buf)
+	removeContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	return parsePackages(buf.String())
+}
+
+// parsePackages parses the output of `rpm -qa` with the rpmQueryFormat
+// format. The gpg-pubkey pseudo-packages are skipped.
+func parsePackages(output string) ([]rpmPackage, error) {
+	packages := []rpmPackage{}
+	for _, line := range strings.Split(output, "\n") {
+		// The container is attached to a TTY, so lines might end with "\r".
+		line = strings.TrimRight(line, "\r")
+		fields := strings.Split(line, "\t")
+		if len(fields) != 9 {
+			continue
+		}
+		if fields[0] == "gpg-pubkey" {
+			continue
+		}
+		pkg := rpmPackage{
+			Name:      fields[0],
+			Epoch:     fields[1],
+			Version:   fields[2],
+			Release:   fields[3],
+			Arch:      fields[4],
+			License:   fields[5],
+			Vendor:    fields[6],
+			SourceRPM: fields[7],
+		}
+		// Tags that are not set are printed as "(none)".
+		for _, field := range []*string{&pkg.Epoch, &pkg.License, &pkg.Vendor, &pkg.SourceRPM} {
+			if *field == "(none)" {
+				*field = ""
+			}
+		}
+		if secs, err := strconv.ParseInt(fields[8], 10, 64); err == nil {
+			pkg.InstallTime = time.Unix(secs, 0).UTC()
+		}
+		packages = append(packages, pkg)
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("no packages were found in the rpm database")
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		if packages[i].Arch != packages[j].Arch {
+			return packages[i].Arch < packages[j].Arch
+		}
+		return packages[i].compare(packages[j]) < 0
+	})
+	return packages, nil
+}
+
+// isDigit returns whether the given byte is an ASCII digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isAlpha returns whether the given byte is an ASCII letter.
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// rpmvercmp compares two version (or release) strings with the same algorithm
+// as rpm. Strings are split into alternating segments of digits and letters,
+// which are compared one by one: numeric segments are newer than alphabetic
+// ones, a tilde sorts before everything (even the end of the string) and a
+// caret sorts after the end of the string but before anything else. It
+// returns 1 if a is newer than b, -1 if it's older and 0 if both are equal.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	for a != "" || b != "" {
+		a = strings.TrimLeftFunc(a, isSeparator)
+		b = strings.TrimLeftFunc(b, isSeparator)
+
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if a == "" {
+				return -1
+			}
+			if b == "" {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		numeric := isDigit(a[0])
+		var segA, segB string
+		segA, a = splitSegment(a, numeric)
+		segB, b = splitSegment(b, numeric)
+
+		// Segments of different types: the numeric one is newer.
+		if segB == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if res := strings.Compare(segA, segB); res != 0 {
+			return res
+		}
+	}
+
+	// Whichever version still has characters left over wins.
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// isSeparator returns whether the given rune separates the segments of a
+// version. Tildes and carets are not separators since they are meaningful.
+func isSeparator(r rune) bool {
+	if r > 127 {
+		return true
+	}
+	c := byte(r)
+	return !isDigit(c) && !isAlpha(c) && c != '~' && c != '^'
+}
+
+// splitSegment returns the leading segment of the given string that is made
+// either of digits or of letters, and the rest of the string.
+func splitSegment(s string, numeric bool) (string, string) {
+	i := 0
+	for i < len(s) && ((numeric && isDigit(s[i])) || (!numeric && isAlpha(s[i]))) {
+		i++
+	}
+	return s[:i], s[i:]
+}
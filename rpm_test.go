@@ -0,0 +1,107 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRpmvercmp(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0", "1.0", 1},
+		{"2.0.1", "2.0.1", 0},
+		{"2.0", "2.0.1", -1},
+		{"2.0.1a", "2.0.1a", 0},
+		{"2.0.1a", "2.0.1", 1},
+		{"5.5p1", "5.5p2", -1},
+		{"5.5p10", "5.5p1", 1},
+		{"10xyz", "10.1xyz", -1},
+		{"xyz10", "xyz10.1", -1},
+		{"xyz.4", "8", -1},
+		{"8", "xyz.4", 1},
+		{"1.010", "1.10", 0},
+		{"1.001", "1.1", 0},
+		{"20101121", "20101121", 0},
+		{"1b.fc17", "1.fc17", -1},
+		{"1.fc17", "1g.fc17", -1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~rc1~git123", "1.0~rc1", -1},
+		{"1.0^", "1.0", 1},
+		{"1.0^git1", "1.0^git2", -1},
+		{"1.0^git1", "1.01", -1},
+		{"1.0^git1~pre", "1.0^git1", -1},
+		{"1.0", "1.0^", -1},
+		{"1.0^20160101", "1.0.1", -1},
+		{"1.0_1", "1.0.1", 0},
+		{"7.5p1", "7.5_p1", 0},
+	}
+
+	for _, test := range tests {
+		if res := rpmvercmp(test.a, test.b); res != test.expected {
+			t.Fatalf("Expected %d when comparing '%s' and '%s', got %d", test.expected, test.a, test.b, res)
+		}
+	}
+}
+
+func TestRpmPackageCompare(t *testing.T) {
+	a := rpmPackage{Name: "curl", Version: "7.60.0", Release: "3.1"}
+	b := rpmPackage{Name: "curl", Version: "7.60.0", Release: "11.1"}
+	if a.compare(b) != -1 || b.compare(a) != 1 || a.compare(a) != 0 {
+		t.Fatal("Releases should have been compared")
+	}
+
+	c := rpmPackage{Name: "curl", Epoch: "1", Version: "7.0.0", Release: "1.1"}
+	if c.compare(b) != 1 {
+		t.Fatal("The epoch has precedence over the version")
+	}
+	if c.evr() != "1:7.0.0-1.1" || a.evr() != "7.60.0-3.1" {
+		t.Fatalf("Unexpected EVR strings: %s, %s", c.evr(), a.evr())
+	}
+}
+
+func TestParsePackages(t *testing.T) {
+	output := "zypper\t(none)\t1.14.5\t1.1\tx86_64\tGPL-2.0-or-later\tSUSE LLC <https://www.suse.com/>\tzypper-1.14.5-1.1.src.rpm\t1527811200\r\n" +
+		"gpg-pubkey\t(none)\t3dbdc284\t53674dd4\t(none)\tpubkey\t(none)\t(none)\t1527811200\r\n" +
+		"warning: something unrelated\r\n" +
+		"bash\t1\t4.4\t9.3\tx86_64\tGPL-3.0-or-later\t(none)\t(none)\t1527814800\r\n"
+
+	packages, err := parsePackages(output)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(packages) != 2 {
+		t.Fatalf("Expected 2 packages, got: %+v", packages)
+	}
+	if packages[0] != (rpmPackage{Name: "bash", Epoch: "1", Version: "4.4", Release: "9.3", Arch: "x86_64", License: "GPL-3.0-or-later",
+		InstallTime: time.Date(2018, 6, 1, 1, 0, 0, 0, time.UTC)}) {
+		t.Fatalf("Unexpected package: %+v", packages[0])
+	}
+	if packages[1] != (rpmPackage{Name: "zypper", Version: "1.14.5", Release: "1.1", Arch: "x86_64",
+		License: "GPL-2.0-or-later", Vendor: "SUSE LLC <https://www.suse.com/>", SourceRPM: "zypper-1.14.5-1.1.src.rpm",
+		InstallTime: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)}) {
+		t.Fatalf("Unexpected package: %+v", packages[1])
+	}
+
+	if _, err := parsePackages("sh: rpm: command not found\n"); err == nil {
+		t.Fatal("An error was expected")
+	}
+}
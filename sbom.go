@@ -0,0 +1,388 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// The formats supported by the `--format` flag of the sbom command.
+const (
+	formatSPDX      = "spdx"
+	formatCycloneDX = "cyclonedx"
+)
+
+// sbomSource is the data out of which an SBOM is generated.
+type sbomSource struct {
+	// The image as given by the user, and its ID.
+	Name string
+	ID   string
+
+	// The operating system of the image, if known.
+	OS *osRelease
+
+	Packages  []rpmPackage
+	CreatedAt time.Time
+}
+
+// fetchSBOMSource lists the packages installed in the given image and
+// identifies its operating system.
+func fetchSBOMSource(img string) (*sbomSource, error) {
+	id, err := getImageID(img)
+	if err != nil {
+		return nil, err
+	}
+	packages, err := fetchPackages(img)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the packages of image '%s': %v", img, err)
+	}
+
+	src := &sbomSource{Name: img, ID: id, Packages: packages, CreatedAt: time.Now().UTC()}
+	if fields, err := readOSRelease(img); err == nil {
+		src.OS = newOSRelease(fields)
+	} else {
+		log.Printf("Could not read the os-release file of %s: %v", img, err)
+	}
+	return src, nil
+}
+
+// purlEscape percent-encodes the given component of a package URL.
+func purlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isDigit(c) || isAlpha(c) || strings.IndexByte(".-_~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// purl returns the package URL of the given package (e.g.
+// "pkg:rpm/sles/curl@7.60.0-3.1?arch=x86_64&distro=sles-15"). The namespace
+// and the distro are taken from the operating system of the image.
+func (src *sbomSource) purl(pkg rpmPackage) string {
+	purl := "pkg:rpm/"
+	if src.OS != nil {
+		purl += purlEscape(src.OS.ID) + "/"
+	}
+	purl += purlEscape(pkg.Name) + "@" + purlEscape(pkg.Version+"-"+pkg.Release)
+
+	qualifiers := []string{"arch=" + purlEscape(pkg.Arch)}
+	if src.OS != nil && src.OS.VersionID != "" {
+		qualifiers = append(qualifiers, "distro="+purlEscape(src.OS.ID+"-"+src.OS.VersionID))
+	}
+	if pkg.Epoch != "" {
+		qualifiers = append(qualifiers, "epoch="+purlEscape(pkg.Epoch))
+	}
+	return purl + "?" + strings.Join(qualifiers, "&")
+}
+
+// licenseExpressionRegexp matches licenses that are syntactically valid SPDX
+// license expressions. The license tag of a RPM is free text, so anything
+// else cannot be given as an expression.
+var licenseExpressionRegexp = regexp.MustCompile(`^[A-Za-z0-9.+-]+( (AND|OR|WITH) [A-Za-z0-9.+-]+)*$`)
+
+// isLicenseExpression returns whether the given license can be used as an
+// SPDX license expression.
+func isLicenseExpression(license string) bool {
+	return licenseExpressionRegexp.MatchString(license)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// spdxDocument is an SPDX 2.3 document in its JSON form.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	Supplier         string            `json:"supplier,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded,omitempty"`
+	LicenseDeclared  string            `json:"licenseDeclared,omitempty"`
+	LicenseComments  string            `json:"licenseComments,omitempty"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxIDRegexp matches the characters that are not allowed in SPDX
+// identifiers.
+var spdxIDRegexp = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// spdx returns the SPDX 2.3 document describing the image.
+func (src *sbomSource) spdx() *spdxDocument {
+	const imageRef = "SPDXRef-Image"
+
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              src.Name,
+		DocumentNamespace: "https://github.com/SUSE/zypper-docker/spdx/" + spdxIDRegexp.ReplaceAllString(src.Name, "-") + "-" + newUUID(),
+		CreationInfo: spdxCreationInfo{
+			Created:  src.CreatedAt.Format(time.RFC3339),
+			Creators: []string{"Tool: zypper-docker-" + version()},
+		},
+		Packages: []spdxPackage{{
+			Name:             src.Name,
+			SPDXID:           imageRef,
+			VersionInfo:      src.ID,
+			DownloadLocation: "NOASSERTION",
+			PrimaryPurpose:   "CONTAINER",
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: imageRef,
+		}},
+	}
+
+	for i, pkg := range src.Packages {
+		ref := fmt.Sprintf("SPDXRef-Package-rpm-%s-%d", spdxIDRegexp.ReplaceAllString(pkg.Name, "-"), i)
+		p := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           ref,
+			VersionInfo:      pkg.evr(),
+			Supplier:         "NOASSERTION",
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  src.purl(pkg),
+			}},
+		}
+		if pkg.Vendor != "" {
+			p.Supplier = "Organization: " + pkg.Vendor
+		}
+		if isLicenseExpression(pkg.License) {
+			p.LicenseDeclared = pkg.License
+		} else if pkg.License != "" {
+			p.LicenseComments = "License as given by the RPM: " + pkg.License
+		}
+		if pkg.SourceRPM != "" {
+			p.SourceInfo = "built package from: " + pkg.SourceRPM
+		}
+
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      imageRef,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: ref,
+		})
+	}
+	return doc
+}
+
+// cycloneDXDocument is a CycloneDX 1.5 document in its JSON form.
+type cycloneDXDocument struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Supplier   *cycloneDXSupplier  `json:"supplier,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXSupplier struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXLicense struct {
+	Expression string                 `json:"expression,omitempty"`
+	License    *cycloneDXNamedLicense `json:"license,omitempty"`
+}
+
+type cycloneDXNamedLicense struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// cycloneDX returns the CycloneDX 1.5 document describing the image.
+func (src *sbomSource) cycloneDX() *cycloneDXDocument {
+	doc := &cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: src.CreatedAt.Format(time.RFC3339),
+			Tools: cycloneDXTools{Components: []cycloneDXComponent{{
+				Type:    "application",
+				Name:    "zypper-docker",
+				Version: version(),
+			}}},
+			Component: cycloneDXComponent{
+				Type:    "container",
+				BOMRef:  src.ID,
+				Name:    src.Name,
+				Version: src.ID,
+			},
+		},
+		Components: []cycloneDXComponent{},
+	}
+
+	for _, pkg := range src.Packages {
+		purl := src.purl(pkg)
+		c := cycloneDXComponent{
+			Type:    "library",
+			BOMRef:  purl,
+			Name:    pkg.Name,
+			Version: pkg.evr(),
+			PURL:    purl,
+			Properties: []cycloneDXProperty{
+				{Name: "zypper-docker:rpm:arch", Value: pkg.Arch},
+			},
+		}
+		if pkg.Vendor != "" {
+			c.Supplier = &cycloneDXSupplier{Name: pkg.Vendor}
+		}
+		if isLicenseExpression(pkg.License) {
+			c.Licenses = []cycloneDXLicense{{Expression: pkg.License}}
+		} else if pkg.License != "" {
+			c.Licenses = []cycloneDXLicense{{License: &cycloneDXNamedLicense{Name: pkg.License}}}
+		}
+		if pkg.SourceRPM != "" {
+			c.Properties = append(c.Properties, cycloneDXProperty{Name: "zypper-docker:rpm:sourceRpm", Value: pkg.SourceRPM})
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	return doc
+}
+
+// writeSBOM writes the SBOM of the given image in the given format into the
+// given file, or to the standard output if it's empty or "-".
+func writeSBOM(img, format, output string) error {
+	src, err := fetchSBOMSource(img)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	switch format {
+	case formatSPDX, "":
+		doc = src.spdx()
+	case formatCycloneDX:
+		doc = src.cycloneDX()
+	default:
+		return fmt.Errorf("unknown SBOM format '%s'", format)
+	}
+
+	if output == "" || output == "-" {
+		return printJSON(doc)
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err = encodeJSON(file, doc); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// zypper-docker sbom [flags] <image>
+func sbomCmd(ctx *cli.Context) {
+	if len(ctx.Args()) != 1 {
+		logAndFatalf("Wrong invocation: expected 1 argument, %d given.\n", len(ctx.Args()))
+		return
+	}
+	if !checkFormat(ctx, formatSPDX, formatCycloneDX) {
+		return
+	}
+
+	if err := writeSBOM(ctx.Args().First(), ctx.String("format"), ctx.String("output")); err != nil {
+		logAndFatalf("Could not generate the SBOM: %v.\n", err)
+		return
+	}
+	exitWithCode(0)
+}
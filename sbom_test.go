@@ -0,0 +1,243 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSBOMPackages = "curl\t(none)\t7.60.0\t3.1\tx86_64\tcurl\tSUSE LLC <https://www.suse.com/>\tcurl-7.60.0-3.1.src.rpm\t1527811200\n" +
+	"libgcc_s1\t(none)\t8.2.1+r264010\t1.1\tx86_64\tGPL-3.0-with-GCC-exception\tSUSE LLC <https://www.suse.com/>\tgcc8-8.2.1+r264010-1.1.src.rpm\t1527811200\n" +
+	"perl\t2\t5.26.1\t5.1\tx86_64\tArtistic-1.0 OR GPL-1.0-or-later\t(none)\t(none)\t1527811200\n" +
+	"tar\t(none)\t1.30\t1.1\tx86_64\tGPL-3.0+\tSUSE LLC <https://www.suse.com/>\ttar-1.30-1.1.src.rpm\t1527811200\n" +
+	"weird\t(none)\t1.0\t1\tnoarch\tGPL-2.0 and BSD (with exception)\t(none)\t(none)\t1527811200\n"
+
+func testSBOMSource(t *testing.T) *sbomSource {
+	packages, err := parsePackages(testSBOMPackages)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return &sbomSource{
+		Name:      "opensuse:15.0",
+		ID:        "sha256:1234",
+		OS:        &osRelease{ID: "opensuse-leap", VersionID: "15.0"},
+		Packages:  packages,
+		CreatedAt: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestSBOMPurl(t *testing.T) {
+	src := testSBOMSource(t)
+
+	expected := []string{
+		"pkg:rpm/opensuse-leap/curl@7.60.0-3.1?arch=x86_64&distro=opensuse-leap-15.0",
+		"pkg:rpm/opensuse-leap/libgcc_s1@8.2.1%2Br264010-1.1?arch=x86_64&distro=opensuse-leap-15.0",
+		"pkg:rpm/opensuse-leap/perl@5.26.1-5.1?arch=x86_64&distro=opensuse-leap-15.0&epoch=2",
+	}
+	for i, purl := range expected {
+		if res := src.purl(src.Packages[i]); res != purl {
+			t.Fatalf("Expected '%s', got '%s'", purl, res)
+		}
+	}
+
+	src.OS = nil
+	if res := src.purl(src.Packages[0]); res != "pkg:rpm/curl@7.60.0-3.1?arch=x86_64" {
+		t.Fatalf("Unexpected purl: %s", res)
+	}
+}
+
+func TestIsLicenseExpression(t *testing.T) {
+	valid := []string{"MIT", "GPL-2.0-or-later", "GPL-3.0+", "Artistic-1.0 OR GPL-1.0-or-later", "Apache-2.0 WITH LLVM-exception"}
+	for _, license := range valid {
+		if !isLicenseExpression(license) {
+			t.Fatalf("Expected '%s' to be valid", license)
+		}
+	}
+	invalid := []string{"", "GPL-2.0 and BSD", "BSD (with exception)", "Public Domain"}
+	for _, license := range invalid {
+		if isLicenseExpression(license) {
+			t.Fatalf("Expected '%s' to be invalid", license)
+		}
+	}
+}
+
+func TestSBOMSPDX(t *testing.T) {
+	doc := testSBOMSource(t).spdx()
+
+	if doc.SPDXVersion != "SPDX-2.3" || doc.DataLicense != "CC0-1.0" || doc.SPDXID != "SPDXRef-DOCUMENT" {
+		t.Fatalf("Unexpected document: %+v", doc)
+	}
+	if !strings.HasPrefix(doc.DocumentNamespace, "https://github.com/SUSE/zypper-docker/spdx/opensuse-15.0-") {
+		t.Fatalf("Unexpected namespace: %s", doc.DocumentNamespace)
+	}
+	if doc.CreationInfo.Created != "2018-06-01T12:00:00Z" || doc.CreationInfo.Creators[0] != "Tool: zypper-docker-"+version() {
+		t.Fatalf("Unexpected creation info: %+v", doc.CreationInfo)
+	}
+
+	// The image plus its five packages.
+	if len(doc.Packages) != 6 || len(doc.Relationships) != 6 {
+		t.Fatalf("Unexpected number of packages or relationships: %d, %d", len(doc.Packages), len(doc.Relationships))
+	}
+	if doc.Packages[0].SPDXID != "SPDXRef-Image" || doc.Packages[0].PrimaryPurpose != "CONTAINER" {
+		t.Fatalf("Unexpected image package: %+v", doc.Packages[0])
+	}
+
+	curl := doc.Packages[1]
+	if curl.Name != "curl" || curl.VersionInfo != "7.60.0-3.1" || curl.Supplier != "Organization: SUSE LLC <https://www.suse.com/>" ||
+		curl.LicenseDeclared != "curl" || curl.SourceInfo != "built package from: curl-7.60.0-3.1.src.rpm" ||
+		curl.ExternalRefs[0].ReferenceType != "purl" || curl.SPDXID != "SPDXRef-Package-rpm-curl-0" {
+		t.Fatalf("Unexpected package: %+v", curl)
+	}
+	if libgcc := doc.Packages[2]; libgcc.SPDXID != "SPDXRef-Package-rpm-libgcc-s1-1" {
+		t.Fatalf("Unexpected package: %+v", libgcc)
+	}
+	if perl := doc.Packages[3]; perl.VersionInfo != "2:5.26.1-5.1" || perl.Supplier != "NOASSERTION" {
+		t.Fatalf("Unexpected package: %+v", perl)
+	}
+	weird := doc.Packages[5]
+	if weird.LicenseDeclared != "NOASSERTION" || !strings.Contains(weird.LicenseComments, "GPL-2.0 and BSD (with exception)") {
+		t.Fatalf("Unexpected package: %+v", weird)
+	}
+
+	rel := doc.Relationships[1]
+	if rel.SPDXElementID != "SPDXRef-Image" || rel.RelationshipType != "CONTAINS" || rel.RelatedSPDXElement != curl.SPDXID {
+		t.Fatalf("Unexpected relationship: %+v", rel)
+	}
+}
+
+func TestSBOMCycloneDX(t *testing.T) {
+	doc := testSBOMSource(t).cycloneDX()
+
+	if doc.BOMFormat != "CycloneDX" || doc.SpecVersion != "1.5" || !strings.HasPrefix(doc.SerialNumber, "urn:uuid:") || len(doc.SerialNumber) != 45 {
+		t.Fatalf("Unexpected document: %+v", doc)
+	}
+	if doc.Metadata.Component.Type != "container" || doc.Metadata.Component.Name != "opensuse:15.0" ||
+		doc.Metadata.Tools.Components[0].Name != "zypper-docker" {
+		t.Fatalf("Unexpected metadata: %+v", doc.Metadata)
+	}
+	if len(doc.Components) != 5 {
+		t.Fatalf("Expected 5 components, got %d", len(doc.Components))
+	}
+
+	curl := doc.Components[0]
+	if curl.Type != "library" || curl.Version != "7.60.0-3.1" || curl.Supplier.Name != "SUSE LLC <https://www.suse.com/>" ||
+		curl.Licenses[0].Expression != "curl" || curl.BOMRef != curl.PURL || len(curl.Properties) != 2 {
+		t.Fatalf("Unexpected component: %+v", curl)
+	}
+	if perl := doc.Components[2]; perl.Supplier != nil || len(perl.Properties) != 1 {
+		t.Fatalf("Unexpected component: %+v", perl)
+	}
+	if weird := doc.Components[4]; weird.Licenses[0].License.Name != "GPL-2.0 and BSD (with exception)" {
+		t.Fatalf("Unexpected component: %+v", weird)
+	}
+}
+
+func TestSBOMCommand(t *testing.T) {
+	client := &mockClient{logOutputs: map[string]string{"zypper-docker-private-opensuse:15.0": testSBOMPackages}}
+
+	stdout, logged := runCommand(client, "sbom", "opensuse:15.0")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+	doc := spdxDocument{}
+	if err := json.Unmarshal([]byte(stdout), &doc); err != nil {
+		t.Fatalf("Could not decode the SPDX document: %v\n%s", err, stdout)
+	}
+	if len(doc.Packages) != 6 || !strings.Contains(doc.Packages[1].ExternalRefs[0].ReferenceLocator, "distro=opensuse-leap-15.0") {
+		t.Fatalf("Unexpected document: %+v", doc)
+	}
+
+	dir, err := ioutil.TempDir("", "zypper-docker-sbom")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "sbom.json")
+	stdout, _ = runCommand(client, "sbom", "--format", "cyclonedx", "--output", output, "opensuse:15.0")
+	if lastCode != 0 || stdout != "" {
+		t.Fatalf("Unexpected result %v: %s", lastCode, stdout)
+	}
+	contents, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Could not read the SBOM: %v", err)
+	}
+	bom := cycloneDXDocument{}
+	if err := json.Unmarshal(contents, &bom); err != nil || len(bom.Components) != 5 {
+		t.Fatalf("Unexpected document (%v): %s", err, contents)
+	}
+}
+
+func TestSBOMCommandErrors(t *testing.T) {
+	_, logged := runCommand(&mockClient{}, "sbom")
+	if lastCode != 1 || !strings.Contains(logged, "expected 1 argument, 0 given") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{}, "sbom", "--format", "xml", "opensuse:15.0")
+	if lastCode != 1 || !strings.Contains(logged, "unknown format 'xml'") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{inspectFail: true}, "sbom", "opensuse:15.0")
+	if lastCode != 1 || !strings.Contains(logged, "Cannot find image opensuse:15.0") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+
+	_, logged = runCommand(&mockClient{}, "sbom", "opensuse:15.0")
+	if lastCode != 1 || !strings.Contains(logged, "could not list the packages of image 'opensuse:15.0'") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+}
+
+func TestPatchSBOM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zypper-docker-sbom")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "sbom.json")
+	client := &mockClient{logOutputs: map[string]string{"zypper-docker-private-new:patched": testSBOMPackages}}
+	_, logged := runCommand(client, "patch", "--sbom", output, "--sbom-format", "cyclonedx", "opensuse:13.2", "new:patched")
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, logged)
+	}
+
+	contents, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Could not read the SBOM: %v", err)
+	}
+	bom := cycloneDXDocument{}
+	if err := json.Unmarshal(contents, &bom); err != nil || bom.Metadata.Component.Name != "new:patched" {
+		t.Fatalf("Unexpected document (%v): %s", err, contents)
+	}
+
+	// The SBOM flags are not forwarded to zypper.
+	if cmd := strings.Join(client.lastCmd, ""); strings.Contains(cmd, "sbom") {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+
+	_, logged = runCommand(&mockClient{}, "patch", "--sbom", output, "--sbom-format", "xml", "opensuse:13.2", "new:patched")
+	if lastCode != 1 || !strings.Contains(logged, "unknown SBOM format 'xml'") {
+		t.Fatalf("Unexpected result %v: %s", lastCode, logged)
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/pkg/fileutil"
+)
+
+const scansCacheName = "docker-zypper-scans.json"
+
+// scansCacheVersion is the version of the format of the scans cache file.
+const scansCacheVersion = 1
+
+// repoState is the state of a repository at the moment of a scan.
+type repoState struct {
+	URL string `json:"url"`
+
+	// The revision as given by the repomd.xml file of the repository. An
+	// empty string means that it could not be fetched.
+	Revision string `json:"revision,omitempty"`
+}
+
+// scanResult is the result of running a read-only zypper command (e.g. `zypper
+// lp`) in a container.
+type scanResult struct {
+	Output       string      `json:"output"`
+	ExitCode     int64       `json:"exit_code"`
+	ScannedAt    time.Time   `json:"scanned_at"`
+	Repositories []repoState `json:"repositories"`
+}
+
+// expired returns whether this result is older than the given TTL or any of
+// the repositories has changed since the scan. Repositories whose revision
+// cannot be fetched are considered to be unchanged, so only the TTL applies
+// for them.
+func (sr *scanResult) expired(ttl time.Duration) bool {
+	if time.Since(sr.ScannedAt) >= ttl {
+		return true
+	}
+	for _, repo := range sr.Repositories {
+		current := ""
+		if repo.Revision != "" {
+			current = repoRevision(repo.URL)
+		}
+		if current == "" {
+			log.Printf("Could not revalidate the repository %v, relying on --scan-ttl only", repo.URL)
+			continue
+		}
+		if current != repo.Revision {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns the error that running the command originally returned.
+func (sr *scanResult) err() error {
+	if sr.ExitCode == 0 {
+		return nil
+	}
+	return dockerError{exitCode: sr.ExitCode}
+}
+
+// scannedImage contains the scans performed on an image.
+type scannedImage struct {
+	// The URLs of the enabled remote repositories of the image. A nil value
+	// means that they are not known yet.
+	Repositories []string `json:"repositories"`
+
+	// The results indexed by the full zypper command (flags included).
+	Scans map[string]*scanResult `json:"scans"`
+}
+
+// scanCache holds the results of previous scans, so they don't have to be
+// performed again for the same image as long as the repositories don't
+// change.
+type scanCache struct {
+	// The path to the original cache file.
+	Path string `json:"-"`
+
+	// The version of the format of the cache file.
+	Version int `json:"version"`
+
+	// The scanned images, indexed by their ID.
+	Images map[string]*scannedImage `json:"images"`
+
+	// How long results are considered valid.
+	TTL time.Duration `json:"-"`
+
+	// Whether this data comes from a valid file or not.
+	Valid bool `json:"-"`
+
+	mutex sync.Mutex
+}
+
+// scanTTL returns how long the results of scans are cached, as given by the
+// `--scan-ttl` global flag. Zero means that they are not cached at all.
+func scanTTL() time.Duration {
+	if currentContext == nil {
+		return 0
+	}
+	return currentContext.GlobalDuration("scan-ttl")
+}
+
+// getScanCache returns the scans cache stored next to the main cache file. If
+// that is not possible, then the returned struct will be marked as invalid.
+func getScanCache() *scanCache {
+	file := openCacheFile(scansCacheName)
+	if file == nil {
+		log.Println("Could not find path for the scans cache!")
+		return &scanCache{Valid: false, Images: map[string]*scannedImage{}}
+	}
+	defer file.Close()
+
+	sc := &scanCache{Valid: true, Path: file.Name(), TTL: scanTTL()}
+	sc.Images = sc.decode(file)
+	return sc
+}
+
+// decode returns the images stored in the given reader.
+func (sc *scanCache) decode(r io.Reader) map[string]*scannedImage {
+	data := struct {
+		Version int                      `json:"version"`
+		Images  map[string]*scannedImage `json:"images"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&data); err != nil && err != io.EOF {
+		log.Printf("Decoding of scans cache file failed: %v\n", err)
+		return map[string]*scannedImage{}
+	}
+	if data.Version != scansCacheVersion || data.Images == nil {
+		// Results are cheap to compute again compared to migrating them.
+		return map[string]*scannedImage{}
+	}
+	return data.Images
+}
+
+// lookup returns the non-expired result for the given image ID and command,
+// or nil if there is none. The lock is not held while the repositories are
+// being revalidated, since this involves network requests.
+func (sc *scanCache) lookup(id, cmd string) *scanResult {
+	var res *scanResult
+
+	sc.mutex.Lock()
+	if img, ok := sc.Images[id]; ok {
+		if cached, ok := img.Scans[cmd]; ok {
+			copied := *cached
+			copied.Repositories = append([]repoState{}, cached.Repositories...)
+			res = &copied
+		}
+	}
+	sc.mutex.Unlock()
+
+	if res == nil || res.expired(sc.TTL) {
+		return nil
+	}
+	return res
+}
+
+// repositories returns the known repositories of the given image ID, or nil
+// if they are not known yet.
+func (sc *scanCache) repositories(id string) []string {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if img, ok := sc.Images[id]; ok {
+		return img.Repositories
+	}
+	return nil
+}
+
+// store saves the given result and writes the cache back to its file.
+func (sc *scanCache) store(id string, repos []string, cmd string, res *scanResult) {
+	sc.mutex.Lock()
+	img, ok := sc.Images[id]
+	if !ok {
+		img = &scannedImage{Scans: map[string]*scanResult{}}
+		sc.Images[id] = img
+	}
+	if img.Scans == nil {
+		img.Scans = map[string]*scanResult{}
+	}
+	if repos != nil {
+		img.Repositories = repos
+	}
+	img.Scans[cmd] = res
+	sc.mutex.Unlock()
+
+	sc.flush()
+}
+
+// flush writes the cache back to its file, merging it with the contents that
+// the file might have gained in the meantime. Expired results are dropped on
+// the way.
+func (sc *scanCache) flush() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if !sc.Valid {
+		return
+	}
+
+	file, err := fileutil.LockFile(sc.Path, os.O_RDWR, 0666)
+	if err != nil {
+		log.Printf("Cannot write to the scans cache file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	for id, old := range sc.decode(file) {
+		img, ok := sc.Images[id]
+		if !ok {
+			sc.Images[id] = old
+			continue
+		}
+		if img.Repositories == nil {
+			img.Repositories = old.Repositories
+		}
+		for cmd, res := range old.Scans {
+			if cur, ok := img.Scans[cmd]; !ok || res.ScannedAt.After(cur.ScannedAt) {
+				img.Scans[cmd] = res
+			}
+		}
+	}
+
+	for id, img := range sc.Images {
+		for cmd, res := range img.Scans {
+			if time.Since(res.ScannedAt) >= sc.TTL {
+				delete(img.Scans, cmd)
+			}
+		}
+		if len(img.Scans) == 0 {
+			delete(sc.Images, id)
+		}
+	}
+
+	sc.Version = scansCacheVersion
+	file.Seek(0, 0)
+	file.Truncate(0)
+	_ = json.NewEncoder(file).Encode(sc)
+}
+
+// update applies the given function to the images stored in the scans cache
+// file and writes the result back while holding the lock of the file.
+func (sc *scanCache) update(f func(images map[string]*scannedImage)) error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if !sc.Valid {
+		return fmt.Errorf("the scans cache file is not available")
+	}
+
+	file, err := fileutil.LockFile(sc.Path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	images := sc.decode(file)
+	f(images)
+
+	sc.Images = images
+	sc.Version = scansCacheVersion
+	file.Seek(0, 0)
+	file.Truncate(0)
+	return json.NewEncoder(file).Encode(sc)
+}
+
+// runScanCommand runs the given read-only command in a container based on the
+// given image and writes its output into `dst`. If the same command has been
+// run recently for the same image and its repositories have not changed, then
+// the cached output is written instead (unless `--force` has been passed). The
+// returned error follows the same rules as in `runCommandInContainer`, and
+// `zypperExitCode` is set as if the command had been run.
+func runScanCommand(img, cmd string, dst io.Writer) error {
+	// Images committed from containers are thrown away right after the
+	// command, so there is no point in caching their results.
+	ttl := scanTTL()
+	imageID, err := getImageID(img)
+	if ttl <= 0 || err != nil || isTemporaryImage(img) {
+		id, err := runCommandInContainer(img, []string{cmd}, dst)
+		removeContainer(id)
+		return err
+	}
+
+	sc := getScanCache()
+	if !currentContext.GlobalBool("force") {
+		if res := sc.lookup(imageID, cmd); res != nil {
+			log.Printf("Using the results of the scan of %v performed at %v", img, res.ScannedAt)
+			exitCodeMutex.Lock()
+			zypperExitCode = res.ExitCode
+			exitCodeMutex.Unlock()
+			_, _ = io.WriteString(dst, res.Output)
+			return res.err()
+		}
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	id, err := runCommandInContainer(img, []string{cmd}, io.MultiWriter(dst, buf))
+	removeContainer(id)
+
+	res := &scanResult{ScannedAt: time.Now().UTC()}
+	switch err.(type) {
+	case nil:
+	case dockerError:
+		res.ExitCode = err.(dockerError).exitCode
+		if isZypperExitCodeSevere(int(res.ExitCode)) {
+			return err
+		}
+	default:
+		return err
+	}
+	res.Output = buf.String()
+
+	repos := sc.repositories(imageID)
+	if repos == nil {
+		repos = fetchRepositories(img)
+	}
+	res.Repositories = make([]repoState, 0, len(repos))
+	for _, repo := range repos {
+		res.Repositories = append(res.Repositories, repoState{URL: repo, Revision: repoRevision(repo)})
+	}
+
+	sc.store(imageID, repos, cmd, res)
+	return err
+}
+
+// fetchRepositories returns the URLs of the enabled remote repositories of the
+// given image, or nil if they could not be listed.
+func fetchRepositories(img string) []string {
+	buf := bytes.NewBuffer([]byte{})
+	id, err := runCommandInContainer(img, []string{"zypper --xmlout lr"}, buf)
+	removeContainer(id)
+	if err != nil {
+		log.Printf("Could not list the repositories of %v: %v", img, err)
+		return nil
+	}
+
+	stream, err := parseZypperXML(buf.String())
+	if err != nil {
+		log.Printf("Could not list the repositories of %v: %v", img, err)
+		return nil
+	}
+
+	repos := []string{}
+	for _, repo := range stream.Repos {
+		if u, err := url.Parse(repo.URL); err == nil && repo.Enabled &&
+			(u.Scheme == "http" || u.Scheme == "https") {
+			repos = append(repos, repo.URL)
+		}
+	}
+	return repos
+}
+
+// repoRevisions holds the revisions of the repositories that have been
+// fetched during this execution, indexed by URL.
+var repoRevisions = struct {
+	sync.Mutex
+	known map[string]*fetchedRevision
+}{known: map[string]*fetchedRevision{}}
+
+// fetchedRevision is the revision of a repository, fetched only once.
+type fetchedRevision struct {
+	once     sync.Once
+	revision string
+}
+
+// repoRevision returns the current revision of the repository with the given
+// URL, or an empty string if it could not be fetched. Revisions are fetched
+// only once per execution, and fetching the revision of a repository does not
+// block the fetches of other repositories.
+func repoRevision(repoURL string) string {
+	repoRevisions.Lock()
+	fetched, ok := repoRevisions.known[repoURL]
+	if !ok {
+		fetched = &fetchedRevision{}
+		repoRevisions.known[repoURL] = fetched
+	}
+	repoRevisions.Unlock()
+
+	fetched.once.Do(func() {
+		rev, err := fetchRepoRevision(repoURL)
+		if err != nil {
+			log.Printf("Could not fetch the revision of %v: %v", repoURL, err)
+		}
+		fetched.revision = rev
+	})
+	return fetched.revision
+}
+
+// repoHTTPClient is the client used to fetch the metadata of repositories.
+var repoHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchRepoRevision fetches the revision of the repository with the given URL
+// from its repomd.xml file.
+func fetchRepoRevision(repoURL string) (string, error) {
+	// Variables such as $releasever and credentials files are resolved by
+	// zypper inside of the image, but not from the host.
+	if strings.Contains(repoURL, "$") {
+		return "", fmt.Errorf("the URL contains repository variables")
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Query().Get("credentials") != "" {
+		return "", fmt.Errorf("the repository requires credentials")
+	}
+	u.Path = path.Join(u.Path, "repodata", "repomd.xml")
+
+	resp, err := repoHTTPClient.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	md := struct {
+		Revision string `xml:"revision"`
+	}{}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&md); err != nil {
+		return "", err
+	}
+	return md.Revision, nil
+}
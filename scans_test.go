@@ -0,0 +1,211 @@
+// Copyright (c) 2018 SUSE LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunScanCommandCached(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	mock := &mockClient{logOutput: "first", commandFail: true, commandExit: zypperExitInfUpdateNeeded}
+	safeClient.client = mock
+	buf := bytes.NewBuffer([]byte{})
+	err := runScanCommand("opensuse:42.3", "zypper lp", buf)
+	if de, ok := err.(dockerError); !ok || de.exitCode != zypperExitInfUpdateNeeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "first" {
+		t.Fatalf("Unexpected output: %v", buf.String())
+	}
+
+	// The second time the cached result is used.
+	safeClient.client = &mockClient{logOutput: "second"}
+	zypperExitCode = 0
+	buf.Reset()
+	err = runScanCommand("opensuse:42.3", "zypper lp", buf)
+	if de, ok := err.(dockerError); !ok || de.exitCode != zypperExitInfUpdateNeeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "first" {
+		t.Fatalf("Expected the cached output, got: %v", buf.String())
+	}
+	if zypperExitCode != zypperExitInfUpdateNeeded {
+		t.Fatalf("Unexpected exit code: %v", zypperExitCode)
+	}
+
+	// A different command is not cached.
+	buf.Reset()
+	if err = runScanCommand("opensuse:42.3", "zypper lu", buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "second" {
+		t.Fatalf("Unexpected output: %v", buf.String())
+	}
+}
+
+func TestRunScanCommandForce(t *testing.T) {
+	restore := scanContext(t, time.Hour, true)
+	defer restore()
+
+	safeClient.client = &mockClient{logOutput: "first"}
+	buf := bytes.NewBuffer([]byte{})
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+
+	safeClient.client = &mockClient{logOutput: "second"}
+	buf.Reset()
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+	if buf.String() != "second" {
+		t.Fatalf("The cache should have been ignored, got: %v", buf.String())
+	}
+}
+
+func TestRunScanCommandDisabled(t *testing.T) {
+	restore := scanContext(t, 0, false)
+	defer restore()
+
+	safeClient.client = &mockClient{logOutput: "first"}
+	buf := bytes.NewBuffer([]byte{})
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+
+	safeClient.client = &mockClient{logOutput: "second"}
+	buf.Reset()
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+	if buf.String() != "second" {
+		t.Fatalf("Nothing should have been cached, got: %v", buf.String())
+	}
+	if _, err := os.Stat(filepath.Join(os.Getenv("HOME"), ".cache", scansCacheName)); !os.IsNotExist(err) {
+		t.Fatal("The scans cache file should not have been created")
+	}
+}
+
+func TestRunScanCommandSevereError(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	safeClient.client = &mockClient{logOutput: "first", commandFail: true, commandExit: zypperExitErrZyp}
+	buf := bytes.NewBuffer([]byte{})
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+
+	safeClient.client = &mockClient{logOutput: "second"}
+	buf.Reset()
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+	if buf.String() != "second" {
+		t.Fatalf("Failed scans should not be cached, got: %v", buf.String())
+	}
+}
+
+func TestFetchRepositories(t *testing.T) {
+	safeClient.client = &mockClient{logOutput: `<?xml version='1.0'?>
+<stream>
+<repo-list>
+<repo alias="oss" name="Main Repository" type="rpm-md" priority="99" enabled="1" autorefresh="1" gpgcheck="1"><url>http://download.opensuse.org/distribution/leap/15.0/repo/oss/</url></repo>
+<repo alias="debug" name="Debug Repository" type="rpm-md" priority="99" enabled="0" autorefresh="1" gpgcheck="1"><url>http://download.opensuse.org/debug/distribution/leap/15.0/repo/oss/</url></repo>
+<repo alias="local" name="Local Repository" type="plaindir" priority="99" enabled="1" autorefresh="0" gpgcheck="0"><url>dir:///srv/repo</url></repo>
+</repo-list>
+</stream>`}
+
+	repos := fetchRepositories("opensuse:15.0")
+	if len(repos) != 1 || repos[0] != "http://download.opensuse.org/distribution/leap/15.0/repo/oss/" {
+		t.Fatalf("Unexpected repositories: %v", repos)
+	}
+
+	safeClient.client = &mockClient{logOutput: "garbage"}
+	if repos = fetchRepositories("opensuse:15.0"); repos != nil {
+		t.Fatalf("Expected no repositories, got: %v", repos)
+	}
+}
+
+func TestScanResultExpired(t *testing.T) {
+	revision := "1525000000"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/repodata/repomd.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo"><revision>%v</revision></repomd>`, revision)
+	}))
+	defer server.Close()
+
+	repo := server.URL + "/repo/"
+	if rev, err := fetchRepoRevision(repo); err != nil || rev != revision {
+		t.Fatalf("Unexpected revision %v: %v", rev, err)
+	}
+	if _, err := fetchRepoRevision(server.URL + "/missing/"); err == nil {
+		t.Fatal("Expected an error for a missing repository")
+	}
+
+	res := &scanResult{
+		ScannedAt:    time.Now().UTC(),
+		Repositories: []repoState{{URL: repo, Revision: revision}},
+	}
+	if res.expired(time.Hour) {
+		t.Fatal("The result should still be valid")
+	}
+	if !res.expired(time.Nanosecond) {
+		t.Fatal("The result should have expired")
+	}
+
+	res.Repositories[0].Revision = "1524000000"
+	if !res.expired(time.Hour) {
+		t.Fatal("The repository has changed, the result should have expired")
+	}
+
+	// Unknown revisions only rely on the TTL.
+	res.Repositories = []repoState{{URL: server.URL + "/missing/"}}
+	if res.expired(time.Hour) {
+		t.Fatal("The result should still be valid")
+	}
+}
+
+func TestFetchRepoRevisionUnresolvable(t *testing.T) {
+	for _, repo := range []string{
+		"http://download.opensuse.org/distribution/leap/$releasever/repo/oss/",
+		"https://updates.suse.com/SUSE/Products/SLE-BCI/15-SP4/x86_64/product/?credentials=SCCcredentials",
+	} {
+		if _, err := fetchRepoRevision(repo); err == nil {
+			t.Fatalf("Expected an error for %v", repo)
+		}
+	}
+}
+
+func TestRunScanCommandTemporaryImage(t *testing.T) {
+	restore := scanContext(t, time.Hour, false)
+	defer restore()
+
+	setTemporaryImage("opensuse:42.3", true)
+	defer setTemporaryImage("opensuse:42.3", false)
+
+	safeClient.client = &mockClient{logOutput: "first"}
+	buf := bytes.NewBuffer([]byte{})
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+
+	safeClient.client = &mockClient{logOutput: "second"}
+	buf.Reset()
+	_ = runScanCommand("opensuse:42.3", "zypper lp", buf)
+	if buf.String() != "second" {
+		t.Fatalf("Results of temporary images should not be cached, got: %v", buf.String())
+	}
+}
@@ -24,18 +24,24 @@ import (
 )
 
 // Listen to all signals, propagates SIGINT, SIGTSTP and SIGTERM
-// to the killChannel channel.
+// to the killChannel channel. The channel is closed on the first of these
+// signals, so every goroutine waiting on it (e.g. multiple workers inspecting
+// images) gets notified.
 func listenSignals() {
 	killChannel = make(chan bool)
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c)
 	go func() {
+		closed := false
 		for sig := range c {
 			switch sig {
 			case syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTSTP,
 				syscall.SIGTERM:
 				log.Printf("Signal '%v' received: shutting down gracefully.", sig)
-				killChannel <- true
+				if !closed {
+					close(killChannel)
+					closed = true
+				}
 			default:
 				log.Printf("Signal '%v' not handled. Doing nothing...", sig)
 			}
@@ -63,3 +63,17 @@ func getTtySize() (uint, uint) {
 	}
 	return uint(size.Height), uint(size.Width)
 }
+
+// isTerminal returns whether the given file descriptor refers to a terminal.
+func isTerminal(fd uintptr) bool {
+	size := &struct {
+		Height uint16
+		Width  uint16
+		x      uint16
+		y      uint16
+	}{}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(size)))
+	return errno == 0
+}
@@ -14,7 +14,26 @@
 
 package main
 
-import "github.com/codegangsta/cli"
+import (
+	"sort"
+
+	"github.com/codegangsta/cli"
+)
+
+// packageUpdate is the representation of a pending package update as printed
+// by the list-updates command when the JSON format has been requested.
+type packageUpdate struct {
+	Name             string `json:"name"`
+	CurrentVersion   string `json:"current_version"`
+	CandidateVersion string `json:"candidate_version"`
+	Arch             string `json:"arch"`
+	Repository       string `json:"repository"`
+}
+
+// updateList is the JSON document printed by the list-updates command.
+type updateList struct {
+	Updates []packageUpdate `json:"updates"`
+}
 
 // zypper-docker list-updates [flags] <image>
 func listUpdatesCmd(ctx *cli.Context) {
@@ -32,12 +51,60 @@ func listUpdatesContainerCmd(ctx *cli.Context) {
 // listUpdates lists all the updates available for the given image with the
 // given arguments.
 func listUpdates(image string, ctx *cli.Context) error {
+	if !checkFormat(ctx, formatJSON) {
+		return nil
+	}
+
+	if ctx.String("format") == formatJSON {
+		cmd := cmdWithFlags("lu", ctx, []string{}, []string{"base", "format"})
+		updates, err := fetchUpdates(image, cmd)
+		if updates != nil {
+			if jsonErr := printJSON(updateList{Updates: updates}); jsonErr != nil {
+				return jsonErr
+			}
+		}
+		return err
+	}
+
 	err := runStreamedCommand(
 		image,
-		cmdWithFlags("lu", ctx, []string{}, []string{"base"}), true)
+		cmdWithFlags("lu", ctx, []string{}, []string{"base", "format"}), true)
 	return err
 }
 
+// fetchUpdates runs the given `zypper lu` command in XML mode for the given
+// image and returns the parsed list of package updates, sorted by name. As it
+// happens with `runXMLCommand`, the returned error might be a non-severe
+// dockerError.
+func fetchUpdates(image, cmd string) ([]packageUpdate, error) {
+	stream, err := runXMLCommand(image, cmd)
+	if stream == nil {
+		return nil, err
+	}
+
+	updates := []packageUpdate{}
+	for _, update := range stream.Updates {
+		if update.Kind != "package" {
+			continue
+		}
+		updates = append(updates, packageUpdate{
+			Name:             update.Name,
+			CurrentVersion:   update.OldEdition,
+			CandidateVersion: update.Edition,
+			Arch:             update.Arch,
+			Repository:       update.Source.Alias,
+		})
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		if updates[i].Name == updates[j].Name {
+			return updates[i].Arch < updates[j].Arch
+		}
+		return updates[i].Name < updates[j].Name
+	})
+	return updates, err
+}
+
 // zypper-docker update [flags] image new-image
 func updateCmd(ctx *cli.Context) {
 	updatePatchCmd("up", ctx)
@@ -14,7 +14,16 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/mssola/capture"
+)
 
 // UPDATE
 
@@ -49,3 +58,54 @@ func TestListUpdatesContainerCommand(t *testing.T) {
 	}
 	cases.run(t, listUpdatesContainerCmd, "zypper lu", "")
 }
+
+// LIST UPDATES JSON
+
+const testUpdatesXML = `<?xml version='1.0'?>
+<stream>
+<update-status version="0.6">
+<update-list>
+<update kind="package" name="zypper" edition="1.13.40-5.1" arch="x86_64" edition-old="1.13.38-2.1">
+  <summary>Command line software manager using libzypp</summary>
+  <description></description>
+  <license></license>
+  <source url="http://download.opensuse.org/update/leap/42.3/oss/" alias="repo-update"/>
+</update>
+<update kind="package" name="curl" edition="7.37.0-37.20.1" arch="x86_64" edition-old="7.37.0-37.17.1">
+  <summary>A Tool for Transferring Data from URLs</summary>
+  <description></description>
+  <license></license>
+  <source url="http://download.opensuse.org/update/leap/42.3/oss/" alias="repo-update"/>
+</update>
+</update-list>
+</update-status>
+</stream>
+`
+
+func TestListUpdatesJSON(t *testing.T) {
+	setupTestExitStatus()
+	safeClient.client = &mockClient{logOutput: testUpdatesXML}
+
+	buffer := bytes.NewBuffer([]byte{})
+	log.SetOutput(buffer)
+
+	ctx := testContextWithFlags([]string{"--format", "json", "opensuse:13.2"}, func(set *flag.FlagSet) {
+		set.String("format", "", "doc")
+	})
+	captured := capture.All(func() { listUpdatesCmd(ctx) })
+	if lastCode != 0 {
+		t.Fatalf("Expected to exit with 0, got %v: %s", lastCode, buffer.String())
+	}
+
+	list := updateList{}
+	if err := json.Unmarshal(captured.Stdout, &list); err != nil {
+		t.Fatalf("Could not decode the JSON output: %v\n%s", err, captured.Stdout)
+	}
+	expected := []packageUpdate{
+		{"curl", "7.37.0-37.17.1", "7.37.0-37.20.1", "x86_64", "repo-update"},
+		{"zypper", "1.13.38-2.1", "1.13.40-5.1", "x86_64", "repo-update"},
+	}
+	if !reflect.DeepEqual(list.Updates, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, list.Updates)
+	}
+}
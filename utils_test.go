@@ -17,12 +17,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/mssola/capture"
@@ -60,6 +66,57 @@ func testContext(args []string, force bool) *cli.Context {
 	return c
 }
 
+// testContextWithFlags works like testContext, but the given function is
+// called before parsing the arguments so it can define extra flags.
+func testContextWithFlags(args []string, define func(set *flag.FlagSet)) *cli.Context {
+	set := flag.NewFlagSet("test", 0)
+	c := cli.NewContext(nil, set, nil)
+	set.Bool("force", false, "doc")
+	define(set)
+	err := set.Parse(args)
+	if err != nil {
+		log.Fatal("Cannot parse cli options", err)
+	}
+	return c
+}
+
+// runCommand runs zypper-docker with the given arguments through the
+// application, as it happens from the command line, while using the given
+// client. It returns the standard output and the logged messages.
+func runCommand(client *mockClient, args ...string) (string, string) {
+	setupTestExitStatus()
+	safeClient.client = client
+	defer func() { currentContext = nil }()
+
+	// The log is written into the log file of the test home directory.
+	path := filepath.Join(os.Getenv("HOME"), logFileName)
+	_ = os.Remove(path)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetPrefix("")
+		_ = os.Remove(path)
+	}()
+
+	app := newApp()
+	captured := capture.All(func() {
+		_ = app.Run(append([]string{"zypper-docker"}, args...))
+	})
+	logged, _ := ioutil.ReadFile(path)
+	return string(captured.Stdout), string(logged)
+}
+
+// restoreOutdatedImages restores the images marked as outdated in the cache,
+// so other tests are not affected.
+func restoreOutdatedImages() {
+	cd := getCacheFile()
+	for _, img := range cd.Images {
+		img.Outdated, img.Successor = false, ""
+	}
+	file, _ := os.Create(cd.Path)
+	_ = json.NewEncoder(file).Encode(cd)
+	_ = file.Close()
+}
+
 func compareStringSlices(actual, expected []string) error {
 	if len(actual) != len(expected) {
 		return fmt.Errorf("different size, actual is %d while expected is %d",
@@ -108,8 +165,13 @@ func testCommand() string {
 		return ""
 	}
 
-	// The command is basically: "zypper ref && actual command".
-	return strings.TrimSpace(strings.Split(cmd[0], "&&")[1])
+	// The command is basically: "zypper ref && actual command", although the
+	// patch command lists the patches before applying them.
+	parts := strings.Split(cmd[0], "&&")
+	if strings.HasPrefix(strings.TrimSpace(parts[1]), "{ echo "+patchesBeginMarker) {
+		return strings.TrimSpace(parts[2])
+	}
+	return strings.TrimSpace(parts[1])
 }
 
 // testCase represents anything that can be tested for a command while using
@@ -194,3 +256,50 @@ func (cases testCases) run(t *testing.T, cmd func(*cli.Context), command, debug
 		}
 	}
 }
+
+// cachedIDs returns the sorted IDs of the images in the given cache that have
+// been classified as either SUSE or non-SUSE images.
+func cachedIDs(cd *cachedData, suse bool) []string {
+	ids := []string{}
+	for id, img := range cd.Images {
+		if !img.CheckedAt.IsZero() && img.SUSE == suse {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// scanContext sets up the current context with the given global flags and a
+// temporary home directory for the cache. The returned function restores the
+// previous state.
+func scanContext(t *testing.T, ttl time.Duration, force bool) func() {
+	home, err := ioutil.TempDir("", "zypper-docker")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	if err = os.Mkdir(filepath.Join(home, ".cache"), 0755); err != nil {
+		t.Fatalf("Could not create cache directory: %v", err)
+	}
+	oldHome := os.Getenv("HOME")
+	_ = os.Setenv("HOME", home)
+	safeClient.client = &mockClient{}
+
+	globals := flag.NewFlagSet("global", 0)
+	globals.Duration("scan-ttl", ttl, "doc")
+	globals.Bool("force", force, "doc")
+	currentContext = cli.NewContext(nil, flag.NewFlagSet("test", 0), cli.NewContext(nil, globals, nil))
+
+	return func() {
+		currentContext = nil
+		_ = os.Setenv("HOME", oldHome)
+		_ = os.RemoveAll(home)
+	}
+}
+
+// sortedStrings returns a sorted copy of the given slice.
+func sortedStrings(values []string) []string {
+	res := append([]string{}, values...)
+	sort.Strings(res)
+	return res
+}
@@ -16,7 +16,10 @@
 // in a safe way.
 package main
 
-import "os"
+import (
+	"fmt"
+	"os"
+)
 
 var exitWithCode func(code int)
 var killChannel chan bool
@@ -30,6 +33,10 @@ func main() {
 
 	os.Args = fixArgsForZypper(os.Args)
 	app := newApp()
+	if err := configureApp(app, os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		os.Exit(1)
+	}
 	app.RunAndExitOnError()
 
 	// TODO: add tests to check for correctly passing exit codes
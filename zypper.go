@@ -14,6 +14,12 @@
 
 package main
 
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
 const (
 	zypperExitOK                 = 0
 	zypperExitErrBug             = 1
@@ -43,3 +49,106 @@ func isZypperExitCodeSevere(errCode int) bool {
 	}
 	return false
 }
+
+// zypperStream is the root element of the documents produced by zypper when
+// the `--xmlout` global option has been given.
+type zypperStream struct {
+	XMLName  xml.Name              `xml:"stream"`
+	Messages []zypperMessage       `xml:"message"`
+	Updates  []zypperUpdate        `xml:"update-status>update-list>update"`
+	Repos    []zypperRepo          `xml:"repo-list>repo"`
+	Prompts  []zypperPrompt        `xml:"prompt"`
+	Summary  *zypperInstallSummary `xml:"install-summary"`
+}
+
+// zypperRepo is a repository as listed by the `repos` command.
+type zypperRepo struct {
+	Alias   string `xml:"alias,attr"`
+	Type    string `xml:"type,attr"`
+	Enabled bool   `xml:"enabled,attr"`
+	URL     string `xml:"url"`
+}
+
+// zypperMessage is a message as reported by zypper in XML mode.
+type zypperMessage struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// zypperPrompt is a question asked by zypper in XML mode. In non-interactive
+// mode the default answer is taken right away.
+type zypperPrompt struct {
+	ID   int    `xml:"id,attr"`
+	Text string `xml:"text"`
+}
+
+// zypperInstallSummary is the summary of the changes to be performed by an
+// install operation (e.g. `patch` or `update`). Sizes are given in bytes.
+type zypperInstallSummary struct {
+	DownloadSize     int64            `xml:"download-size,attr"`
+	SpaceUsageDiff   int64            `xml:"space-usage-diff,attr"`
+	PackagesToChange int              `xml:"packages-to-change,attr"`
+	Install          []zypperSolvable `xml:"to-install>solvable"`
+	Upgrade          []zypperSolvable `xml:"to-upgrade>solvable"`
+	Downgrade        []zypperSolvable `xml:"to-downgrade>solvable"`
+	Reinstall        []zypperSolvable `xml:"to-reinstall>solvable"`
+	Remove           []zypperSolvable `xml:"to-remove>solvable"`
+}
+
+// zypperSolvable is a package, a patch or any other resolvable listed in an
+// install summary.
+type zypperSolvable struct {
+	Type       string `xml:"type,attr"`
+	Name       string `xml:"name,attr"`
+	Edition    string `xml:"edition,attr"`
+	OldEdition string `xml:"edition-old,attr"`
+	Arch       string `xml:"arch,attr"`
+	Summary    string `xml:"summary,attr"`
+}
+
+// zypperUpdate is an entry from the list of updates as given by either the
+// `list-patches` or the `list-updates` command.
+type zypperUpdate struct {
+	Kind       string `xml:"kind,attr"`
+	Name       string `xml:"name,attr"`
+	Edition    string `xml:"edition,attr"`
+	OldEdition string `xml:"edition-old,attr"`
+	Arch       string `xml:"arch,attr"`
+	Status     string `xml:"status,attr"`
+	Category   string `xml:"category,attr"`
+	Severity   string `xml:"severity,attr"`
+	PkgManager bool   `xml:"pkgmanager,attr"`
+	Summary    string `xml:"summary"`
+	Source     struct {
+		URL   string `xml:"url,attr"`
+		Alias string `xml:"alias,attr"`
+	} `xml:"source"`
+	IssueDate struct {
+		Time int64 `xml:"time,attr"`
+	} `xml:"issue-date"`
+	Issues []zypperIssue `xml:"issue-list>issue"`
+}
+
+// zypperIssue is a reference to an issue tracker (e.g. Bugzilla or the CVE
+// database) fixed by a patch.
+type zypperIssue struct {
+	Type string `xml:"type,attr"`
+	ID   string `xml:"id,attr"`
+}
+
+// parseZypperXML decodes the XML document contained in the given output of a
+// zypper command that has been invoked with `--xmlout`. Everything preceding
+// the XML declaration is ignored, since it may contain some garbage left by
+// the terminal.
+func parseZypperXML(output string) (*zypperStream, error) {
+	idx := strings.Index(output, "<?xml")
+	if idx < 0 {
+		return nil, fmt.Errorf("could not find the XML output of zypper")
+	}
+
+	stream := &zypperStream{}
+	if err := xml.Unmarshal([]byte(output[idx:]), stream); err != nil {
+		return nil, fmt.Errorf("could not parse the XML output of zypper: %v", err)
+	}
+	return stream, nil
+}